@@ -0,0 +1,135 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Condition types reported on Database and DatabaseServer resources
+const (
+	// ConditionReady is true when every other condition on the resource is true
+	ConditionReady = "Ready"
+	// ConditionDatabaseReady is true when the database a database user is given access to is ready
+	ConditionDatabaseReady = "DatabaseReady"
+	// ConditionBound is true when a database has been created for a database claim
+	ConditionBound = "Bound"
+	// ConditionServerReachable is true when the database server accepts the admin credentials
+	ConditionServerReachable = "ServerReachable"
+	// ConditionUserProvisioned is true when the user exists on the database server
+	ConditionUserProvisioned = "UserProvisioned"
+	// ConditionDatabaseProvisioned is true when the database exists on the database server
+	ConditionDatabaseProvisioned = "DatabaseProvisioned"
+	// ConditionPermissionsGranted is true when the user has been granted access to the database
+	ConditionPermissionsGranted = "PermissionsGranted"
+	// ConditionSecretSynced is true when the secret containing credentials exists
+	ConditionSecretSynced = "SecretSynced"
+	// ConditionCredentialsVerified is true when the user can log in with the credentials in the secret and read and write the database
+	ConditionCredentialsVerified = "CredentialsVerified"
+	// ConditionMigrationsApplied is true when the schema migrations of the database have been applied
+	ConditionMigrationsApplied = "MigrationsApplied"
+	// ConditionBackupScheduled is true when the job or cron job making backups exists
+	ConditionBackupScheduled = "BackupScheduled"
+	// ConditionBackupCompleted is true when the last backup succeeded
+	ConditionBackupCompleted = "BackupCompleted"
+	// ConditionRestoreCompleted is true when the dump has been restored
+	ConditionRestoreCompleted = "RestoreCompleted"
+	// ConditionPasswordRotated is true when the last rotation of the password succeeded
+	ConditionPasswordRotated = "PasswordRotated"
+	// ConditionDeleted is false while deleting the database, users and secret of a database being deleted fails
+	ConditionDeleted = "Deleted"
+)
+
+// Phases summarizing the conditions of a resource
+const (
+	PhasePending      = "Pending"
+	PhaseProvisioning = "Provisioning"
+	PhaseReady        = "Ready"
+	PhaseFailed       = "Failed"
+	PhaseDeleting     = "Deleting"
+)
+
+// Condition contains details for one aspect of the current state of a resource.
+// It mirrors metav1.Condition, which is not available in the apimachinery version used here.
+type Condition struct {
+	// Type of condition in CamelCase
+	Type string `json:"type"`
+	// +kubebuilder:validation:Enum=True;False;Unknown
+	// Status of the condition, one of True, False or Unknown
+	Status corev1.ConditionStatus `json:"status"`
+	// ObservedGeneration is the generation of the resource the condition was set based upon
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// LastTransitionTime is the last time the condition changed status
+	LastTransitionTime metav1.Time `json:"lastTransitionTime"`
+	// Reason is a CamelCase reason for the condition's last transition
+	Reason string `json:"reason"`
+	// Message is a human readable message indicating details about the transition
+	Message string `json:"message"`
+}
+
+// FindCondition returns the condition of the given type, or nil if it is not present
+func FindCondition(conditions []Condition, conditionType string) *Condition {
+	for i := range conditions {
+		if conditions[i].Type == conditionType {
+			return &conditions[i]
+		}
+	}
+	return nil
+}
+
+// IsConditionTrue returns true if the condition of the given type is present and true
+func IsConditionTrue(conditions []Condition, conditionType string) bool {
+	condition := FindCondition(conditions, conditionType)
+	return condition != nil && condition.Status == corev1.ConditionTrue
+}
+
+// SetCondition adds or updates a condition and reports whether anything changed.
+// LastTransitionTime is only moved when the status of the condition changes.
+func SetCondition(conditions *[]Condition, condition Condition) bool {
+	existing := FindCondition(*conditions, condition.Type)
+	if existing == nil {
+		if condition.LastTransitionTime.IsZero() {
+			condition.LastTransitionTime = metav1.Now()
+		}
+		*conditions = append(*conditions, condition)
+		return true
+	}
+
+	changed := false
+	if existing.Status != condition.Status {
+		existing.Status = condition.Status
+		existing.LastTransitionTime = metav1.Now()
+		if !condition.LastTransitionTime.IsZero() {
+			existing.LastTransitionTime = condition.LastTransitionTime
+		}
+		changed = true
+	}
+	if existing.Reason != condition.Reason {
+		existing.Reason = condition.Reason
+		changed = true
+	}
+	if existing.Message != condition.Message {
+		existing.Message = condition.Message
+		changed = true
+	}
+	if existing.ObservedGeneration != condition.ObservedGeneration {
+		existing.ObservedGeneration = condition.ObservedGeneration
+		changed = true
+	}
+	return changed
+}
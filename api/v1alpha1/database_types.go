@@ -23,20 +23,167 @@ import (
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
 // NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
 
+// Kinds of database servers
+const (
+	// DatabaseServerKind is the kind of namespaced database servers
+	DatabaseServerKind = "DatabaseServer"
+	// ClusterDatabaseServerKind is the kind of cluster-scoped database servers
+	ClusterDatabaseServerKind = "ClusterDatabaseServer"
+)
+
 // Server is the server on which the database is hosted
 type Server struct {
+	// +kubebuilder:validation:Enum=DatabaseServer;ClusterDatabaseServer
+	// Kind is DatabaseServer or ClusterDatabaseServer (default is DatabaseServer)
+	// +optional
+	Kind string `json:"kind,omitempty"`
 	// Name is the name of the database server
 	Name string `json:"name"`
-	// Namespace is the namespace of the database server
-	Namespace string `json:"namespace"`
+	// Namespace is the namespace of the database server, not set for a ClusterDatabaseServer
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// Placement policies choosing between the database servers matching a selector
+const (
+	// PlacementLeastDatabases places a database on the server with the fewest databases
+	PlacementLeastDatabases = "LeastDatabases"
+	// PlacementLeastDiskUsed places a database on the server with the least disk space used by databases
+	PlacementLeastDiskUsed = "LeastDiskUsed"
+	// PlacementRoundRobin places databases on the servers in turn, in order of namespace and name
+	PlacementRoundRobin = "RoundRobin"
+)
+
+// Placement decides which of the database servers matching a selector a database is created on
+type Placement struct {
+	// +kubebuilder:validation:Enum=LeastDatabases;LeastDiskUsed;RoundRobin
+	// Policy is LeastDatabases, LeastDiskUsed or RoundRobin (default is LeastDatabases)
+	// +optional
+	Policy string `json:"policy,omitempty"`
+	// Affinity only allows servers hosting a database in the same namespace whose resource matches the selector
+	// +optional
+	Affinity *metav1.LabelSelector `json:"affinity,omitempty"`
+	// AntiAffinity only allows servers not hosting any database in the same namespace whose resource matches the selector
+	// +optional
+	AntiAffinity *metav1.LabelSelector `json:"antiAffinity,omitempty"`
 }
 
 // Secret is the secret containing credentials
 type Secret struct {
 	// Name is the name of the secret
 	Name string `json:"name"`
-	// Namespace is the namespace of the secret
-	Namespace string `json:"namespace"`
+	// Namespace is the namespace of the secret (default is the namespace of the resource)
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// SecretTemplate is metadata applied to a secret containing credentials
+type SecretTemplate struct {
+	// Labels are added to the secret
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+	// Annotations are added to the secret
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// RotatePasswordAnnotation requests a rotation of the password when set to a value not rotated for before
+const RotatePasswordAnnotation = "database.stacc.com/rotate-password"
+
+// ForceDeleteAnnotation on a database or database user being deleted removes its finalizer when set to "true",
+// leaving the database and users on the server if they can not be deleted
+const ForceDeleteAnnotation = "database.stacc.com/force-delete"
+
+// WatchLabel set to "true" on a secret, config map or job makes the controller cache and watch it. The controller sets it
+// on the secrets and jobs it creates. Other secrets and config maps, e.g. admin secrets, are read from the API server
+// and their changes are only noticed when the resources using them are reconciled for another reason.
+const WatchLabel = "database.stacc.com/watch"
+
+// Privilege levels
+const (
+	// PrivilegeOwner allows everything in the database, including creating and dropping tables
+	PrivilegeOwner = "owner"
+	// PrivilegeReadWrite allows reading and changing data, but not the schema
+	PrivilegeReadWrite = "readwrite"
+	// PrivilegeReadOnly allows reading data
+	PrivilegeReadOnly = "readonly"
+	// PrivilegeCustom allows the privileges listed in Privileges.Custom
+	PrivilegeCustom = "custom"
+)
+
+// Privileges of a user in a database.
+// Privileges the user has which are not part of the level are revoked.
+type Privileges struct {
+	// +kubebuilder:validation:Enum=owner;readwrite;readonly;custom
+	// Level is one of owner, readwrite, readonly or custom (default is owner)
+	// +optional
+	Level string `json:"level,omitempty"`
+	// Custom is the list of privileges granted with level custom, named as by the database server.
+	// Table privileges such as SELECT or INSERT on postgres, database privileges on mysql and roles such as read on mongo.
+	// +optional
+	Custom []string `json:"custom,omitempty"`
+}
+
+// Password rotation modes
+const (
+	// RotationModeSingle changes the password of the one user of the database
+	RotationModeSingle = "single"
+	// RotationModeDual keeps two users with the same permissions, <username>_a and <username>_b.
+	// A rotation changes the password of the user not in the secret and then switches the secret to it,
+	// so the credentials held by running applications stay valid until the next rotation.
+	RotationModeDual = "dual"
+)
+
+// PasswordRotation configures rotation of the password of the user
+type PasswordRotation struct {
+	// +kubebuilder:validation:Enum=single;dual
+	// Mode is either single, rotating the password of the user, or dual, alternating between two users (default is single)
+	// +optional
+	Mode string `json:"mode,omitempty"`
+	// Interval is how often the password is rotated, e.g. "2160h" for every 90 days.
+	// When omitted the password is only rotated on request, by setting the
+	// database.stacc.com/rotate-password annotation to a new value.
+	// +optional
+	Interval *metav1.Duration `json:"interval,omitempty"`
+}
+
+// Migrations are schema migrations in the format of golang-migrate, e.g. 1_create_users.up.sql and 1_create_users.down.sql.
+// Exactly one of ConfigMap and Path must be set.
+type Migrations struct {
+	// ConfigMap is the name of a config map in the namespace of the database with a key for each migration file
+	// +optional
+	ConfigMap string `json:"configMap,omitempty"`
+	// Path is a directory containing migration files in the controller image, or in a volume mounted into it.
+	// It has to be in the migrations root of the controller.
+	// +optional
+	Path string `json:"path,omitempty"`
+	// +kubebuilder:validation:Minimum=0
+	// Version is the version to migrate to (default is the latest). Version 0 reverts every migration.
+	// +optional
+	Version *int64 `json:"version,omitempty"`
+	// AllowDown allows running down migrations when Version is lower than the current version
+	// +optional
+	AllowDown bool `json:"allowDown,omitempty"`
+}
+
+// MigrationStatus is the state of the schema migrations of a database
+type MigrationStatus struct {
+	// Version is the version of the last migration applied, 0 when none is
+	Version int64 `json:"version"`
+	// Dirty is true when the last migration failed halfway, and the database has to be fixed by hand
+	Dirty bool `json:"dirty"`
+}
+
+// DatabaseSource is the database a new database is created as a copy of, on the same database server.
+// Exactly one of Database and Template must be set.
+type DatabaseSource struct {
+	// Database is a database resource in the namespace of the database whose database is copied
+	// +optional
+	Database *DatabaseReference `json:"database,omitempty"`
+	// Template is the name of a database on the server which is copied, e.g. one kept seeded for preview environments.
+	// It must be one of the templates of the server.
+	// +optional
+	Template string `json:"template,omitempty"`
 }
 
 // DatabaseSpec defines the desired state of Database
@@ -44,38 +191,91 @@ type DatabaseSpec struct {
 	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
 
-	// Server is the namespaced name of databaseServer on which this database is to be created
-	Server Server `json:"server"`
+	// Server is the namespaced name of databaseServer on which this database is to be created.
+	// Either server or serverSelector must be set.
+	// +optional
+	Server Server `json:"server,omitempty"`
+	// ServerSelector selects the database servers the database may be created on, by label
+	// +optional
+	ServerSelector *metav1.LabelSelector `json:"serverSelector,omitempty"`
+	// ServerType restricts the servers selected by serverSelector to one type, e.g. postgres
+	// +optional
+	ServerType string `json:"serverType,omitempty"`
+	// Placement decides which of the servers selected by serverSelector the database is created on
+	// +optional
+	Placement *Placement `json:"placement,omitempty"`
+	// +kubebuilder:validation:MinLength=1
+	// +kubebuilder:validation:MaxLength=63
 	// Name is the name of the database
 	Name string `json:"name"`
 	// Secret is the secret containing credentials
 	Secret Secret `json:"secret"`
-	// Username is the username to be assigned to the database (default is name of database)
+	// SecretTemplate is applied to the secret containing credentials
+	// +optional
+	SecretTemplate *SecretTemplate `json:"secretTemplate,omitempty"`
+	// +kubebuilder:validation:MaxLength=61
+	// Username is the username to be assigned to the database (default is name of database).
+	// It leaves room for the _a and _b suffixes of dual user rotation, engines may allow less.
 	Username string `json:"username,omitempty"`
 	// +kubebuilder:validation:Enum=delete;retain
-	// ReclaimPolicy tells if database will be retained or deleted
-	ReclaimPolicy string `json:"reclaimPolicy"`
+	// ReclaimPolicy tells if database will be retained or deleted (default is retain)
+	// +optional
+	ReclaimPolicy string `json:"reclaimPolicy,omitempty"`
+	// PasswordRotation configures rotation of the password of the user
+	// +optional
+	PasswordRotation *PasswordRotation `json:"passwordRotation,omitempty"`
+	// Privileges is what the user is allowed to do in the database (default is owner)
+	// +optional
+	Privileges *Privileges `json:"privileges,omitempty"`
+	// Source is copied into the database when it is created. Databases which already exist are left as they are.
+	// +optional
+	Source *DatabaseSource `json:"source,omitempty"`
+	// Migrations are applied with the credentials of the user after permissions are granted
+	// +optional
+	Migrations *Migrations `json:"migrations,omitempty"`
 }
 
 // DatabaseStatus defines the observed state of Database
 type DatabaseStatus struct {
-	// Secret is the status of secret containg credentials
-	CreatedSecret bool `json:"secret,omitempty"`
-	// User is status of user on server
-	CreatedUser bool `json:"user,omitempty"`
-	// DB is status of the new database on server
-	CreatedDatabase bool `json:"db,omitempty"`
-	// Permissions is status of permissions given to new user
-	GrantedPermissions bool `json:"permissions,omitempty"`
-	// Connection is status of connection to new database with new user
-	Connection bool `json:"connection,omitempty"`
+	// Phase is a summary of the provisioning state of the database
+	Phase string `json:"phase,omitempty"`
+	// ObservedGeneration is the most recent generation observed by the controller
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Server is the database server the database is created on. It does not change once set.
+	// +optional
+	Server *Server `json:"server,omitempty"`
+	// Conditions describe each provisioning step of the database
+	// +optional
+	Conditions []Condition `json:"conditions,omitempty"`
+	// LastRotated is when the password of the user was last rotated
+	// +optional
+	LastRotated *metav1.Time `json:"lastRotated,omitempty"`
+	// LastRotationRequest is the value of the rotate-password annotation last rotated for
+	// +optional
+	LastRotationRequest string `json:"lastRotationRequest,omitempty"`
+	// ActiveUser is the user currently stored in the secret
+	// +optional
+	ActiveUser string `json:"activeUser,omitempty"`
+	// Migrations is the state of the schema migrations of the database
+	// +optional
+	Migrations *MigrationStatus `json:"migrations,omitempty"`
+	// Users are the users the controller created on the server for the database. Only these users have their
+	// password reset and are deleted, users which existed already are left alone.
+	// +optional
+	Users []string `json:"users,omitempty"`
+	// Databases are the databases the controller created on the server for the database. Permissions are only
+	// granted on and dropped from these databases, databases which existed already are left alone.
+	// +optional
+	Databases []string `json:"databases,omitempty"`
 }
 
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
 // +kubebuilder:printcolumn:name="Database Name",type=string,JSONPath=".spec.name",description="name of database"
-// +kubebuilder:printcolumn:name="Server",type=string,JSONPath=".spec.server.name",description="name of database server"
+// +kubebuilder:printcolumn:name="Server",type=string,JSONPath=".status.server.name",description="name of database server"
 // +kubebuilder:printcolumn:name="Reclaim Policy",type=string,JSONPath=".spec.reclaimPolicy",description="reclaim policy"
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=".status.phase",description="provisioning phase"
+// +kubebuilder:printcolumn:name="Ready",type=string,JSONPath=".status.conditions[?(@.type==\"Ready\")].status",description="ready condition"
 // +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
 
 // Database is the Schema for the databases API
@@ -0,0 +1,141 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// BackupStorage is where dumps are stored, exactly one of PersistentVolumeClaim and S3 must be set
+type BackupStorage struct {
+	// PersistentVolumeClaim stores dumps on a volume
+	// +optional
+	PersistentVolumeClaim *PersistentVolumeClaimStorage `json:"persistentVolumeClaim,omitempty"`
+	// S3 stores dumps in a bucket of an S3 compatible object store
+	// +optional
+	S3 *S3Storage `json:"s3,omitempty"`
+}
+
+// PersistentVolumeClaimStorage stores dumps on a volume
+type PersistentVolumeClaimStorage struct {
+	// ClaimName is the name of the persistent volume claim, in the namespace of the backup
+	ClaimName string `json:"claimName"`
+	// Path is the directory on the volume dumps are written to (default is the root of the volume)
+	// +optional
+	Path string `json:"path,omitempty"`
+}
+
+// S3Storage stores dumps in a bucket of an S3 compatible object store
+type S3Storage struct {
+	// Endpoint is the url of the object store, e.g. https://s3.eu-north-1.amazonaws.com or http://minio.minio:9000
+	Endpoint string `json:"endpoint"`
+	// Bucket is the name of the bucket
+	Bucket string `json:"bucket"`
+	// Prefix is the directory in the bucket dumps are written to (default is the root of the bucket)
+	// +optional
+	Prefix string `json:"prefix,omitempty"`
+	// Secret is the secret containing the fields accessKeyId and secretAccessKey, in the namespace of the backup
+	Secret string `json:"secret"`
+}
+
+// BackupRetention decides how many dumps are kept
+type BackupRetention struct {
+	// +kubebuilder:validation:Minimum=1
+	// KeepLast is the number of dumps of the database kept, older ones are deleted after each backup
+	KeepLast int32 `json:"keepLast"`
+}
+
+// DatabaseBackupSpec defines the desired state of DatabaseBackup
+type DatabaseBackupSpec struct {
+	// Database is the database resource to back up
+	Database DatabaseReference `json:"database"`
+	// Schedule is a cron schedule for recurring backups, e.g. "0 3 * * *". If omitted the database is backed up once.
+	// +optional
+	Schedule string `json:"schedule,omitempty"`
+	// Storage is where dumps are stored
+	Storage BackupStorage `json:"storage"`
+	// Retention decides how many dumps are kept (default is to keep every dump)
+	// +optional
+	Retention *BackupRetention `json:"retention,omitempty"`
+	// Image containing the dump tools of the database server, overriding the default image for its type
+	// +optional
+	Image string `json:"image,omitempty"`
+}
+
+// BackupRecord describes a single backup
+type BackupRecord struct {
+	// Job is the name of the job which made the backup
+	Job string `json:"job"`
+	// File is the location of the dump, a path on the volume or an s3 url
+	// +optional
+	File string `json:"file,omitempty"`
+	// StartTime is when the backup started
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+	// CompletionTime is when the backup completed
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+	// Succeeded tells if the backup completed successfully
+	Succeeded bool `json:"succeeded"`
+}
+
+// DatabaseBackupStatus defines the observed state of DatabaseBackup
+type DatabaseBackupStatus struct {
+	// Phase is a summary of the state of the backup
+	Phase string `json:"phase,omitempty"`
+	// ObservedGeneration is the most recent generation observed by the controller
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Conditions describe the state of the backup
+	// +optional
+	Conditions []Condition `json:"conditions,omitempty"`
+	// LastBackup is the most recent finished backup
+	// +optional
+	LastBackup *BackupRecord `json:"lastBackup,omitempty"`
+	// LastSuccessfulBackup is the most recent successful backup
+	// +optional
+	LastSuccessfulBackup *BackupRecord `json:"lastSuccessfulBackup,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Database",type=string,JSONPath=".spec.database.name",description="name of database"
+// +kubebuilder:printcolumn:name="Schedule",type=string,JSONPath=".spec.schedule",description="cron schedule"
+// +kubebuilder:printcolumn:name="Last Backup",type=string,JSONPath=".status.lastSuccessfulBackup.file",description="last successful dump"
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=".status.phase",description="backup phase"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// DatabaseBackup is the Schema for the databasebackups API
+type DatabaseBackup struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   DatabaseBackupSpec   `json:"spec,omitempty"`
+	Status DatabaseBackupStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// DatabaseBackupList contains a list of DatabaseBackup
+type DatabaseBackupList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []DatabaseBackup `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&DatabaseBackup{}, &DatabaseBackupList{})
+}
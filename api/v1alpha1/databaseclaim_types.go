@@ -0,0 +1,91 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DatabaseClaimSpec defines the desired state of DatabaseClaim
+type DatabaseClaimSpec struct {
+	// +kubebuilder:validation:MinLength=1
+	// ClassName is the name of the database class the database is provisioned by
+	ClassName string `json:"className"`
+	// +kubebuilder:validation:MaxLength=63
+	// DatabaseName is the name of the database on the server, only allowed when the class allows it
+	// (default is <namespace>-<name> of the claim followed by the start of its UID)
+	// +optional
+	DatabaseName string `json:"databaseName,omitempty"`
+	// +kubebuilder:validation:MaxLength=61
+	// Username is the username to be assigned to the database (default is name of database).
+	// It leaves room for the _a and _b suffixes of dual user rotation, engines may allow less.
+	// +optional
+	Username string `json:"username,omitempty"`
+	// SecretName is the name of the secret containing credentials, in the namespace of the claim (default is <name>-credentials)
+	// +optional
+	SecretName string `json:"secretName,omitempty"`
+	// Privileges is what the user is allowed to do in the database (default is the privileges of the class)
+	// +optional
+	Privileges *Privileges `json:"privileges,omitempty"`
+}
+
+// DatabaseClaimStatus defines the observed state of DatabaseClaim
+type DatabaseClaimStatus struct {
+	// Phase is a summary of the provisioning state of the claim
+	Phase string `json:"phase,omitempty"`
+	// ObservedGeneration is the most recent generation observed by the controller
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Conditions describe each provisioning step of the claim
+	// +optional
+	Conditions []Condition `json:"conditions,omitempty"`
+	// Database is the name of the database resource created for the claim, in the namespace of the claim
+	// +optional
+	Database string `json:"database,omitempty"`
+	// Server is the database server the claim is bound to
+	// +optional
+	Server *Server `json:"server,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Class",type=string,JSONPath=".spec.className",description="name of database class"
+// +kubebuilder:printcolumn:name="Server",type=string,JSONPath=".status.server.name",description="name of database server"
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=".status.phase",description="provisioning phase"
+// +kubebuilder:printcolumn:name="Ready",type=string,JSONPath=".status.conditions[?(@.type==\"Ready\")].status",description="ready condition"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// DatabaseClaim is the Schema for the databaseclaims API
+type DatabaseClaim struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   DatabaseClaimSpec   `json:"spec,omitempty"`
+	Status DatabaseClaimStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// DatabaseClaimList contains a list of DatabaseClaim
+type DatabaseClaimList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []DatabaseClaim `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&DatabaseClaim{}, &DatabaseClaimList{})
+}
@@ -0,0 +1,74 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DatabaseClassSpec defines the desired state of DatabaseClass
+type DatabaseClassSpec struct {
+	// Type is the type of database server databases of the class are created on, e.g. postgres
+	Type string `json:"type"`
+	// ServerSelector selects the database servers databases of the class may be created on (default is every server of the type)
+	// +optional
+	ServerSelector *metav1.LabelSelector `json:"serverSelector,omitempty"`
+	// Placement decides which of the selected servers a database of the class is created on
+	// +optional
+	Placement *Placement `json:"placement,omitempty"`
+	// +kubebuilder:validation:Enum=delete;retain
+	// ReclaimPolicy tells if databases of the class are retained or deleted with their claims (default is delete)
+	// +optional
+	ReclaimPolicy string `json:"reclaimPolicy,omitempty"`
+	// Privileges is what users of databases of the class are allowed to do, unless the claim says otherwise (default is owner)
+	// +optional
+	Privileges *Privileges `json:"privileges,omitempty"`
+	// SecretTemplate is applied to the secrets containing credentials for databases of the class
+	// +optional
+	SecretTemplate *SecretTemplate `json:"secretTemplate,omitempty"`
+	// AllowDatabaseName lets claims of the class choose the name of their database on the server.
+	// Otherwise claims setting databaseName are invalid, and every database gets a generated name.
+	// +optional
+	AllowDatabaseName bool `json:"allowDatabaseName,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster
+// +kubebuilder:printcolumn:name="Type",type=string,JSONPath=".spec.type",description="type of database server"
+// +kubebuilder:printcolumn:name="Reclaim Policy",type=string,JSONPath=".spec.reclaimPolicy",description="reclaim policy"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// DatabaseClass is the Schema for the databaseclasses API
+type DatabaseClass struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec DatabaseClassSpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// DatabaseClassList contains a list of DatabaseClass
+type DatabaseClassList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []DatabaseClass `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&DatabaseClass{}, &DatabaseClassList{})
+}
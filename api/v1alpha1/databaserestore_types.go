@@ -0,0 +1,114 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// RestoreSource is the dump to restore, either the last successful dump of a backup or a file in a storage
+type RestoreSource struct {
+	// Backup is the name of a database backup in the namespace of the restore, whose last successful dump is restored
+	// +optional
+	Backup string `json:"backup,omitempty"`
+	// Storage is where the dump is stored, when not restoring from a backup
+	// +optional
+	Storage *BackupStorage `json:"storage,omitempty"`
+	// File is the dump to restore, relative to the path or prefix of the storage.
+	// Paths starting with / are relative to the root of the volume, and s3:// urls include the bucket.
+	// +optional
+	File string `json:"file,omitempty"`
+}
+
+// NewDatabase is a database created for a restore
+type NewDatabase struct {
+	// +kubebuilder:validation:MinLength=1
+	// Name is the name of the database resource, created in the namespace of the restore
+	Name string `json:"name"`
+	// Spec is the spec of the database resource
+	Spec DatabaseSpec `json:"spec"`
+}
+
+// DatabaseRestoreSpec defines the desired state of DatabaseRestore
+type DatabaseRestoreSpec struct {
+	// Source is the dump to restore
+	Source RestoreSource `json:"source"`
+	// Database is an existing database resource in the namespace of the restore to restore into. Its data is replaced by the dump.
+	// +optional
+	Database *DatabaseReference `json:"database,omitempty"`
+	// Confirm must be set to the name of the database on the server when restoring into an existing database
+	// +optional
+	Confirm string `json:"confirm,omitempty"`
+	// NewDatabase is a database resource created to restore into, provisioned like any other database
+	// +optional
+	NewDatabase *NewDatabase `json:"newDatabase,omitempty"`
+	// Image containing the restore tools of the database server, overriding the default image for its type
+	// +optional
+	Image string `json:"image,omitempty"`
+}
+
+// DatabaseRestoreStatus defines the observed state of DatabaseRestore
+type DatabaseRestoreStatus struct {
+	// Phase is a summary of the state of the restore
+	Phase string `json:"phase,omitempty"`
+	// ObservedGeneration is the most recent generation observed by the controller
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Conditions describe the state of the restore
+	// +optional
+	Conditions []Condition `json:"conditions,omitempty"`
+	// Database is the name of the database resource restored into
+	// +optional
+	Database string `json:"database,omitempty"`
+	// File is the dump being restored, fixed when the restore starts
+	// +optional
+	File string `json:"file,omitempty"`
+	// StartTime is when the restore started
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+	// CompletionTime is when the restore completed
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Database",type=string,JSONPath=".status.database",description="name of database restored into"
+// +kubebuilder:printcolumn:name="File",type=string,JSONPath=".status.file",description="dump restored"
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=".status.phase",description="restore phase"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// DatabaseRestore is the Schema for the databaserestores API
+type DatabaseRestore struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   DatabaseRestoreSpec   `json:"spec,omitempty"`
+	Status DatabaseRestoreStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// DatabaseRestoreList contains a list of DatabaseRestore
+type DatabaseRestoreList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []DatabaseRestore `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&DatabaseRestore{}, &DatabaseRestoreList{})
+}
@@ -0,0 +1,72 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Kinds of resources keeping credentials in a secret
+const (
+	// DatabaseKind is the kind of databases
+	DatabaseKind = "Database"
+	// DatabaseUserKind is the kind of database users
+	DatabaseUserKind = "DatabaseUser"
+)
+
+// SecretGrantFrom are the resources in a namespace allowed to write secrets into the namespace of a grant
+type SecretGrantFrom struct {
+	// +kubebuilder:validation:Enum=Database;DatabaseUser
+	// Kind is the kind of the resources, Database or DatabaseUser
+	Kind string `json:"kind"`
+	// Namespace is the namespace of the resources
+	Namespace string `json:"namespace"`
+}
+
+// DatabaseSecretGrantSpec defines the desired state of DatabaseSecretGrant
+type DatabaseSecretGrantSpec struct {
+	// +kubebuilder:validation:MinItems=1
+	// From are the resources allowed to write secrets into the namespace of the grant
+	From []SecretGrantFrom `json:"from"`
+	// SecretNames are the secrets which may be written (default is every secret in the namespace)
+	// +optional
+	SecretNames []string `json:"secretNames,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// DatabaseSecretGrant allows databases and users in other namespaces to keep their credentials in the namespace of the grant
+type DatabaseSecretGrant struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec DatabaseSecretGrantSpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// DatabaseSecretGrantList contains a list of DatabaseSecretGrant
+type DatabaseSecretGrantList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []DatabaseSecretGrant `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&DatabaseSecretGrant{}, &DatabaseSecretGrantList{})
+}
@@ -45,6 +45,10 @@ type Mysql struct {
 	// +kubebuilder:validation:Enum=true;false
 	// Ssl is if ssl is enabled
 	Ssl bool `json:"ssl"`
+	// HostPattern is the host part of the accounts created for users, e.g. 10.0.% for clients in 10.0.0.0/16 (default is %, any host).
+	// Existing accounts are renamed when it changes.
+	// +optional
+	HostPattern string `json:"hostPattern,omitempty"`
 }
 
 type Mongo struct {
@@ -59,29 +63,56 @@ type Mongo struct {
 	Ssl bool `json:"ssl"`
 }
 
+// AllowedNamespaces are the namespaces databases on a server may be created from
+type AllowedNamespaces struct {
+	// Names of namespaces, "*" for every namespace
+	// +optional
+	Names []string `json:"names,omitempty"`
+	// Selector selects namespaces by label
+	// +optional
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+}
+
 // DatabaseServerSpec defines the desired state of DatabaseServer
 type DatabaseServerSpec struct {
 	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
 
-	// +kubebuilder:validation:Enum=postgres;mysql;mongo
-	// Type is the type of database server. Postgres, mongo or mysql
+	// Type is the type of database server. Postgres, mongo or mysql.
+	// Types are provided by the drivers registered in the controller, unknown types are reported in the status.
 	Type string `json:"type"`
-	// SecretName is the name of the secret stored in the cluster
-	Secret   Secret   `json:"secret"`
-	Postgres Postgres `json:"postgres,omitempty"`
-	Mysql    Mysql    `json:"mysql,omitempty"`
-	Mongo    Mongo    `json:"mongo,omitempty"`
+	// SecretName is the name of the secret stored in the cluster.
+	// The secret of a DatabaseServer must be in the namespace of the server.
+	Secret Secret `json:"secret"`
+	// AllowedNamespaces are the namespaces databases may be created from, besides the namespace of a DatabaseServer.
+	// A ClusterDatabaseServer without it allows no namespace, "*" in names allows every namespace.
+	// +optional
+	AllowedNamespaces *AllowedNamespaces `json:"allowedNamespaces,omitempty"`
+	// Templates are the databases on the server which databases may be copied from by name.
+	// Other databases belong to tenants, and are only copied from through their database resources.
+	// +optional
+	Templates []string `json:"templates,omitempty"`
+	Postgres  Postgres `json:"postgres,omitempty"`
+	Mysql     Mysql    `json:"mysql,omitempty"`
+	Mongo     Mongo    `json:"mongo,omitempty"`
 }
 
 // DatabaseServerStatus defines the observed state of DatabaseServer
 type DatabaseServerStatus struct {
-	Connected bool `json:"connected,omitempty"`
+	// Phase is a summary of the state of the database server
+	Phase string `json:"phase,omitempty"`
+	// ObservedGeneration is the most recent generation observed by the controller
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Conditions describe the state of the connection to the database server
+	// +optional
+	Conditions []Condition `json:"conditions,omitempty"`
 }
 
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
 // +kubebuilder:printcolumn:name="Type",type=string,JSONPath=".spec.type",description="type of database server"
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=".status.phase",description="connection phase"
+// +kubebuilder:printcolumn:name="Ready",type=string,JSONPath=".status.conditions[?(@.type==\"Ready\")].status",description="ready condition"
 // +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
 
 // DatabaseServer is the Schema for the databaseservers API
@@ -0,0 +1,101 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DatabaseReference refers to a database resource
+type DatabaseReference struct {
+	// Name is the name of the database resource
+	Name string `json:"name"`
+	// Namespace is the namespace of the database resource, which must be the namespace of the referring resource (default is namespace of the referring resource)
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// InNamespace reports whether the reference is to a database in the namespace of the referring resource.
+// Databases in other namespaces belong to other tenants, who have not agreed to share them.
+func (r DatabaseReference) InNamespace(namespace string) bool {
+	return r.Namespace == "" || r.Namespace == namespace
+}
+
+// DatabaseUserSpec defines the desired state of DatabaseUser
+type DatabaseUserSpec struct {
+	// Database is the database resource the user is given access to
+	Database DatabaseReference `json:"database"`
+	// +kubebuilder:validation:MinLength=1
+	// +kubebuilder:validation:MaxLength=63
+	// Username is the name of the user
+	Username string `json:"username"`
+	// Secret is the secret containing credentials
+	Secret Secret `json:"secret"`
+	// +kubebuilder:validation:Enum=delete;retain
+	// ReclaimPolicy tells if the user will be retained or deleted (default is retain)
+	// +optional
+	ReclaimPolicy string `json:"reclaimPolicy,omitempty"`
+	// Privileges is what the user is allowed to do in the database (default is owner)
+	// +optional
+	Privileges *Privileges `json:"privileges,omitempty"`
+}
+
+// DatabaseUserStatus defines the observed state of DatabaseUser
+type DatabaseUserStatus struct {
+	// Phase is a summary of the provisioning state of the user
+	Phase string `json:"phase,omitempty"`
+	// ObservedGeneration is the most recent generation observed by the controller
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Conditions describe each provisioning step of the user
+	// +optional
+	Conditions []Condition `json:"conditions,omitempty"`
+	// Users are the users the controller created on the server for the user. Only these users have their
+	// password reset and are deleted, users which existed already are left alone.
+	// +optional
+	Users []string `json:"users,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Username",type=string,JSONPath=".spec.username",description="name of user"
+// +kubebuilder:printcolumn:name="Database",type=string,JSONPath=".spec.database.name",description="name of database"
+// +kubebuilder:printcolumn:name="Reclaim Policy",type=string,JSONPath=".spec.reclaimPolicy",description="reclaim policy"
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=".status.phase",description="provisioning phase"
+// +kubebuilder:printcolumn:name="Ready",type=string,JSONPath=".status.conditions[?(@.type==\"Ready\")].status",description="ready condition"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// DatabaseUser is the Schema for the databaseusers API
+type DatabaseUser struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   DatabaseUserSpec   `json:"spec,omitempty"`
+	Status DatabaseUserStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// DatabaseUserList contains a list of DatabaseUser
+type DatabaseUserList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []DatabaseUser `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&DatabaseUser{}, &DatabaseUserList{})
+}
@@ -0,0 +1,58 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+// Default sets the fields of a database which were left out to their defaults
+func (d *Database) Default() {
+	if d.Spec.Username == "" {
+		d.Spec.Username = d.Spec.Name
+	}
+	if d.Spec.Server.Name != "" {
+		if d.Spec.Server.Kind == "" {
+			d.Spec.Server.Kind = DatabaseServerKind
+		}
+		if d.Spec.Server.Kind == DatabaseServerKind && d.Spec.Server.Namespace == "" {
+			d.Spec.Server.Namespace = d.Namespace
+		}
+	}
+	if d.Spec.Secret.Namespace == "" {
+		d.Spec.Secret.Namespace = d.Namespace
+	}
+	if d.Spec.ReclaimPolicy == "" {
+		d.Spec.ReclaimPolicy = "retain"
+	}
+}
+
+// Default sets the fields of a database user which were left out to their defaults
+func (u *DatabaseUser) Default() {
+	if u.Spec.Database.Namespace == "" {
+		u.Spec.Database.Namespace = u.Namespace
+	}
+	if u.Spec.Secret.Namespace == "" {
+		u.Spec.Secret.Namespace = u.Namespace
+	}
+	if u.Spec.ReclaimPolicy == "" {
+		u.Spec.ReclaimPolicy = "retain"
+	}
+}
+
+// Default sets the fields of a database server which were left out to their defaults
+func (s *DatabaseServer) Default() {
+	if s.Spec.Secret.Namespace == "" {
+		s.Spec.Secret.Namespace = s.Namespace
+	}
+}
@@ -0,0 +1,310 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+	db "flow.stacc.dev/database-provisioning-poc/pkg/db"
+)
+
+const (
+	// backupLabel is set on jobs to the name of the DatabaseBackup making them
+	backupLabel = "database.stacc.com/backup"
+	// storageImage copies dumps to and from volumes
+	storageImage = "busybox:1.32"
+	// s3Image copies dumps to and from S3 compatible object stores
+	s3Image = "minio/mc:RELEASE.2021-03-23T05-46-11Z"
+	// dumpVolume is shared between the containers of backup and restore jobs
+	dumpVolume = "dump"
+	// storageVolume is the volume dumps are stored on
+	storageVolume = "storage"
+)
+
+// errCredentialsNotOwned is returned when the credentials secret of a resource running jobs exists and belongs to something else
+var errCredentialsNotOwned = errors.New("credentials secret exists and is not controlled by the resource")
+
+// credentialsSecretName is the name of the secret holding a copy of the password of the database user for the jobs
+// of a resource. Jobs can only use secrets in their own namespace, and the secret of a database may be granted elsewhere.
+// The name includes the kind of the resource, so a backup and a restore of the same name do not share it.
+func credentialsSecretName(owner metav1.Object) string {
+	switch owner.(type) {
+	case *databasev1alpha1.DatabaseRestore:
+		return owner.GetName() + "-restore-credentials"
+	default:
+		return owner.GetName() + "-backup-credentials"
+	}
+}
+
+// writeCredentials copies the password of the user of a database to the credentials secret of a resource running jobs.
+// The jobs run images chosen by tenants, so they never get the password of the server.
+// A secret of the same name not created for the resource is left alone, as it would be deleted together with the resource.
+func writeCredentials(ctx context.Context, c client.Client, scheme *runtime.Scheme, owner metav1.Object, password []byte) error {
+	credentials := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: credentialsSecretName(owner), Namespace: owner.GetNamespace()}}
+	_, err := controllerutil.CreateOrUpdate(ctx, c, credentials, func() error {
+		if !credentials.CreationTimestamp.IsZero() && !metav1.IsControlledBy(credentials, owner) {
+			return fmt.Errorf("%w: %s/%s", errCredentialsNotOwned, credentials.Namespace, credentials.Name)
+		}
+		credentials.Labels = map[string]string{databasev1alpha1.WatchLabel: "true"}
+		credentials.Data = map[string][]byte{"password": password}
+		return ctrl.SetControllerReference(owner, credentials, scheme)
+	})
+	return err
+}
+
+// credentialsPassword selects the password in the credentials secret of a resource running jobs
+func credentialsPassword(owner metav1.Object) corev1.SecretKeySelector {
+	return corev1.SecretKeySelector{
+		LocalObjectReference: corev1.LocalObjectReference{Name: credentialsSecretName(owner)},
+		Key:                  "password",
+	}
+}
+
+// s3Path returns the bucket and directory of dumps in an object store
+func s3Path(storage *databasev1alpha1.S3Storage) string {
+	if prefix := strings.Trim(storage.Prefix, "/"); prefix != "" {
+		return storage.Bucket + "/" + prefix
+	}
+	return storage.Bucket
+}
+
+// storageEnv returns the environment of containers accessing the storage, with the location of dumps
+func storageEnv(storage databasev1alpha1.BackupStorage) []corev1.EnvVar {
+	if storage.S3 != nil {
+		return []corev1.EnvVar{
+			{Name: "S3_ENDPOINT", Value: storage.S3.Endpoint},
+			{Name: "S3_PATH", Value: s3Path(storage.S3)},
+			{Name: "AWS_ACCESS_KEY_ID", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: storage.S3.Secret}, Key: "accessKeyId"}}},
+			{Name: "AWS_SECRET_ACCESS_KEY", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: storage.S3.Secret}, Key: "secretAccessKey"}}},
+		}
+	}
+	return []corev1.EnvVar{
+		{Name: "STORAGE_PATH", Value: path.Join("/storage", storage.PersistentVolumeClaim.Path)},
+	}
+}
+
+// storageVolumes returns the volumes of a job using the storage, the first being where dumps are written to before upload
+func storageVolumes(storage databasev1alpha1.BackupStorage) []corev1.Volume {
+	volumes := []corev1.Volume{{Name: dumpVolume, VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}}
+	if storage.PersistentVolumeClaim != nil {
+		volumes = append(volumes, corev1.Volume{Name: storageVolume, VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: storage.PersistentVolumeClaim.ClaimName}}})
+	}
+	return volumes
+}
+
+// storageContainer returns a container running script with access to the storage and the dump volume
+func storageContainer(name string, storage databasev1alpha1.BackupStorage, script string) corev1.Container {
+	container := corev1.Container{
+		Name:         name,
+		Image:        storageImage,
+		Command:      []string{"/bin/sh", "-c", script},
+		Env:          storageEnv(storage),
+		VolumeMounts: []corev1.VolumeMount{{Name: dumpVolume, MountPath: "/dump"}},
+	}
+	if storage.S3 != nil {
+		container.Image = s3Image
+	} else {
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{Name: storageVolume, MountPath: "/storage"})
+	}
+	return container
+}
+
+// validateStorage checks that exactly one kind of storage is configured
+func validateStorage(storage databasev1alpha1.BackupStorage) error {
+	if (storage.PersistentVolumeClaim == nil) == (storage.S3 == nil) {
+		return fmt.Errorf("exactly one of persistentVolumeClaim and s3 must be set")
+	}
+	return nil
+}
+
+// dumpFilePattern matches the names of the dumps of a backup, <name>-<timestamp>.<extension>, but not those of
+// backups whose name starts with the same prefix, e.g. db-nightly for db
+func dumpFilePattern(backup *databasev1alpha1.DatabaseBackup, tool db.DumpTool) string {
+	return fmt.Sprintf(`%s-[0-9]{8}T[0-9]{6}Z\.%s`, regexp.QuoteMeta(backup.Name), regexp.QuoteMeta(tool.Extension))
+}
+
+// backupJobSpec returns the job dumping a database and storing the dump.
+// The dump is written to a shared volume by an init container with the tools of the engine, and
+// then stored by a second container, which also deletes old dumps and reports where the dump was stored
+// in its termination message.
+func backupJobSpec(backup *databasev1alpha1.DatabaseBackup, tool db.DumpTool) batchv1.JobSpec {
+	image := tool.Image
+	if backup.Spec.Image != "" {
+		image = backup.Spec.Image
+	}
+	dump := fmt.Sprintf(`set -e
+FILE="%s-$(date -u +%%Y%%m%%dT%%H%%M%%SZ).%s"
+export %s="/dump/$FILE"
+%s
+echo "$FILE" > /dump/name
+`, backup.Name, tool.Extension, db.DumpFileEnv, tool.Dump)
+
+	var store string
+	if backup.Spec.Storage.S3 != nil {
+		store = `set -e
+FILE="$(cat /dump/name)"
+mc alias set target "$S3_ENDPOINT" "$AWS_ACCESS_KEY_ID" "$AWS_SECRET_ACCESS_KEY" > /dev/null
+mc cp "/dump/$FILE" "target/$S3_PATH/$FILE"
+`
+		if backup.Spec.Retention != nil {
+			store += fmt.Sprintf(`mc find "target/$S3_PATH" --maxdepth 1 --name "%s-*" | grep -E "/%s$" | sort -r | tail -n +%d | while read -r OLD; do mc rm "$OLD"; done
+`, backup.Name, dumpFilePattern(backup, tool), backup.Spec.Retention.KeepLast+1)
+		}
+		store += `printf "s3://%s/%s" "$S3_PATH" "$FILE" > /dev/termination-log
+`
+	} else {
+		store = `set -e
+FILE="$(cat /dump/name)"
+mkdir -p "$STORAGE_PATH"
+cp "/dump/$FILE" "$STORAGE_PATH/$FILE"
+`
+		if backup.Spec.Retention != nil {
+			store += fmt.Sprintf(`ls -1 "$STORAGE_PATH" | grep -E "^%s$" | sort -r | tail -n +%d | while read -r OLD; do rm -f "$STORAGE_PATH/$OLD"; done
+`, dumpFilePattern(backup, tool), backup.Spec.Retention.KeepLast+1)
+		}
+		store += `printf "%s" "${STORAGE_PATH#/storage}/$FILE" > /dev/termination-log
+`
+	}
+
+	backoffLimit := int32(2)
+	return batchv1.JobSpec{
+		BackoffLimit: &backoffLimit,
+		Template: corev1.PodTemplateSpec{
+			Spec: corev1.PodSpec{
+				RestartPolicy: corev1.RestartPolicyNever,
+				Volumes:       storageVolumes(backup.Spec.Storage),
+				InitContainers: []corev1.Container{{
+					Name:         "dump",
+					Image:        image,
+					Command:      []string{"/bin/sh", "-c", dump},
+					Env:          tool.Env,
+					VolumeMounts: []corev1.VolumeMount{{Name: dumpVolume, MountPath: "/dump"}},
+				}},
+				Containers: []corev1.Container{storageContainer("store", backup.Spec.Storage, store)},
+			},
+		},
+	}
+}
+
+// sourceFile returns the location of a dump in the restore job, relative to the path or prefix of the storage
+// unless it is a path from the root of the volume or an s3 url
+func sourceFile(storage databasev1alpha1.BackupStorage, file string) string {
+	if storage.S3 != nil {
+		if strings.HasPrefix(file, "s3://") {
+			return "target/" + strings.TrimPrefix(file, "s3://")
+		}
+		return "target/" + s3Path(storage.S3) + "/" + strings.TrimPrefix(file, "/")
+	}
+	if strings.HasPrefix(file, "/") {
+		return path.Join("/storage", file)
+	}
+	return path.Join("/storage", storage.PersistentVolumeClaim.Path, file)
+}
+
+// restoreJobSpec returns the job restoring a dump into a database.
+// The dump is fetched from the storage to a shared volume by an init container, and then loaded
+// by a second container with the tools of the engine.
+func restoreJobSpec(restore *databasev1alpha1.DatabaseRestore, storage databasev1alpha1.BackupStorage, file string, tool db.DumpTool) batchv1.JobSpec {
+	image := tool.Image
+	if restore.Spec.Image != "" {
+		image = restore.Spec.Image
+	}
+
+	fetch := `set -e
+FILE="$(basename "$SOURCE_FILE")"
+`
+	if storage.S3 != nil {
+		fetch += `mc alias set target "$S3_ENDPOINT" "$AWS_ACCESS_KEY_ID" "$AWS_SECRET_ACCESS_KEY" > /dev/null
+mc cp "$SOURCE_FILE" "/dump/$FILE"
+`
+	} else {
+		fetch += `cp "$SOURCE_FILE" "/dump/$FILE"
+`
+	}
+	fetch += `echo "$FILE" > /dump/name
+`
+	fetchContainer := storageContainer("fetch", storage, fetch)
+	fetchContainer.Env = append(fetchContainer.Env, corev1.EnvVar{Name: "SOURCE_FILE", Value: sourceFile(storage, file)})
+
+	load := fmt.Sprintf(`set -e
+export %s="/dump/$(cat /dump/name)"
+%s
+`, db.DumpFileEnv, tool.Restore)
+
+	backoffLimit := int32(0)
+	return batchv1.JobSpec{
+		// A failed restore is left for inspection instead of being retried on top of itself
+		BackoffLimit: &backoffLimit,
+		Template: corev1.PodTemplateSpec{
+			Spec: corev1.PodSpec{
+				RestartPolicy:  corev1.RestartPolicyNever,
+				Volumes:        storageVolumes(storage),
+				InitContainers: []corev1.Container{fetchContainer},
+				Containers: []corev1.Container{{
+					Name:         "restore",
+					Image:        image,
+					Command:      []string{"/bin/sh", "-c", load},
+					Env:          tool.Env,
+					VolumeMounts: []corev1.VolumeMount{{Name: dumpVolume, MountPath: "/dump"}},
+				}},
+			},
+		},
+	}
+}
+
+// jobFinished reports whether a job has completed or failed for good
+func jobFinished(job *batchv1.Job) (finished, succeeded bool) {
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case batchv1.JobComplete:
+			return true, true
+		case batchv1.JobFailed:
+			return true, false
+		}
+	}
+	return false, false
+}
+
+// terminationMessage returns the termination message of a container of a pod which exited successfully
+func terminationMessage(pod *corev1.Pod, container string) string {
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name == container && status.State.Terminated != nil && status.State.Terminated.ExitCode == 0 {
+			return status.State.Terminated.Message
+		}
+	}
+	return ""
+}
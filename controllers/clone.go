@@ -0,0 +1,76 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+	"flow.stacc.dev/database-provisioning-poc/pkg/servers"
+)
+
+// errInvalidSource is returned when the source of a database can not be copied
+var errInvalidSource = errors.New("invalid source")
+
+// errSourceNotReady is returned while the database resource a database is copied from is not provisioned yet
+var errSourceNotReady = errors.New("source database is not provisioned")
+
+// databaseSource returns the name of the database on the server which a database is created as a copy of,
+// or an empty string if it is created empty. Only templates of the server and databases of resources in the
+// namespace of the database are copied, other databases on the server belong to other tenants.
+func (r *DatabaseReconciler) databaseSource(ctx context.Context, database *databasev1alpha1.Database, spec *databasev1alpha1.DatabaseServerSpec) (string, error) {
+	source := database.Spec.Source
+	if source == nil {
+		return "", nil
+	}
+	if (source.Database == nil) == (source.Template == "") {
+		return "", fmt.Errorf("%w: exactly one of database and template must be set", errInvalidSource)
+	}
+	if source.Template != "" {
+		if source.Template == database.Spec.Name {
+			return "", fmt.Errorf("%w: database %s can not be copied from itself", errInvalidSource, database.Spec.Name)
+		}
+		if !containsString(spec.Templates, source.Template) {
+			return "", fmt.Errorf("%w: database %s is not a template of the server", errInvalidSource, source.Template)
+		}
+		return source.Template, nil
+	}
+
+	if !source.Database.InNamespace(database.Namespace) {
+		return "", fmt.Errorf("%w: database %s/%s is not in namespace %s of the database", errInvalidSource, source.Database.Namespace, source.Database.Name, database.Namespace)
+	}
+	key := client.ObjectKey{Namespace: database.Namespace, Name: source.Database.Name}
+	if key.Name == database.Name {
+		return "", fmt.Errorf("%w: database %s can not be copied from itself", errInvalidSource, database.Spec.Name)
+	}
+	var sourceDatabase databasev1alpha1.Database
+	if err := r.Get(ctx, key, &sourceDatabase); err != nil {
+		return "", err
+	}
+	// Databases are copied by the server, so both have to be on it
+	if sourceServer, server := servers.DatabaseRef(&sourceDatabase), servers.DatabaseRef(database); sourceServer != server {
+		return "", fmt.Errorf("%w: database %s is on %s %s, not on %s %s", errInvalidSource, key, sourceServer.Kind, serverName(sourceServer), server.Kind, serverName(server))
+	}
+	if !databasev1alpha1.IsConditionTrue(sourceDatabase.Status.Conditions, databasev1alpha1.ConditionDatabaseProvisioned) {
+		return "", fmt.Errorf("%w: database %s", errSourceNotReady, key)
+	}
+	return sourceDatabase.Spec.Name, nil
+}
@@ -0,0 +1,110 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+	db "flow.stacc.dev/database-provisioning-poc/pkg/db"
+	"flow.stacc.dev/database-provisioning-poc/pkg/servers"
+)
+
+// ClusterDatabaseServerReconciler reconciles a ClusterDatabaseServer object
+type ClusterDatabaseServerReconciler struct {
+	client.Client
+	Log         logr.Logger
+	Scheme      *runtime.Scheme
+	Recorder    record.EventRecorder
+	Connections *db.Connections
+}
+
+// +kubebuilder:rbac:groups=database.stacc.com,resources=clusterdatabaseservers,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=database.stacc.com,resources=clusterdatabaseservers/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+// Reconcile ClusterDatabaseServer
+func (r *ClusterDatabaseServerReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.Background()
+	log := r.Log.WithValues("clusterdatabaseserver", req.Name)
+
+	var clusterServer databasev1alpha1.ClusterDatabaseServer
+	if err := r.Get(ctx, req.NamespacedName, &clusterServer); err != nil {
+		if apierrors.IsNotFound(err) {
+			// Close the pool of a deleted database server
+			r.Connections.Remove(req.NamespacedName)
+			forgetServer(databasev1alpha1.Server{Kind: databasev1alpha1.ClusterDatabaseServerKind, Name: req.Name})
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	// Databases being deleted need their server, so it is only deleted once no database is created on it
+	finalizer := "database.stacc.com/finalizer"
+	ref := databasev1alpha1.Server{Kind: databasev1alpha1.ClusterDatabaseServerKind, Name: clusterServer.Name}
+	if !clusterServer.ObjectMeta.DeletionTimestamp.IsZero() {
+		if !containsString(clusterServer.ObjectMeta.Finalizers, finalizer) {
+			return ctrl.Result{}, nil
+		}
+		if blocked, err := serverDeletionBlocked(ctx, r, r.Recorder, &clusterServer, ref); err != nil || blocked {
+			return ctrl.Result{}, err
+		}
+		r.Connections.Remove(req.NamespacedName)
+		forgetServer(ref)
+		clusterServer.ObjectMeta.Finalizers = removeString(clusterServer.ObjectMeta.Finalizers, finalizer)
+		return ctrl.Result{}, r.Update(ctx, &clusterServer)
+	}
+	if !containsString(clusterServer.ObjectMeta.Finalizers, finalizer) {
+		clusterServer.ObjectMeta.Finalizers = append(clusterServer.ObjectMeta.Finalizers, finalizer)
+		if err := r.Update(ctx, &clusterServer); err != nil {
+			log.Error(err, "unable to update clusterDatabaseServer resource")
+			return ctrl.Result{}, err
+		}
+	}
+
+	// Connections to cluster database servers are pooled under their name without namespace
+	check := checkServer(ctx, log, r, r.Connections, servers.FromCluster(&clusterServer))
+	recordServerCheck(ref, check)
+	if err := setServerReachable(ctx, r.Client, r.Recorder, &clusterServer, &clusterServer.Status, clusterServer.Generation, check); err != nil {
+		log.Error(err, "unable to update clusterDatabaseServer status")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: check.requeueAfter}, nil
+}
+
+// SetupWithManager for ClusterDatabaseServer
+func (r *ClusterDatabaseServerReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&databasev1alpha1.ClusterDatabaseServer{}).
+		Watches(&source.Kind{Type: &databasev1alpha1.Database{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: databaseServerRequests(databasev1alpha1.ClusterDatabaseServerKind),
+		}).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: adminSecretRequests(mgr.GetClient(), databasev1alpha1.ClusterDatabaseServerKind),
+		}).
+		Complete(r)
+}
@@ -0,0 +1,61 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+)
+
+// summarizeConditions derives the Ready condition from the required conditions and returns the resulting phase.
+// A false condition takes precedence over one which has not been reported yet.
+func summarizeConditions(conditions *[]databasev1alpha1.Condition, generation int64, required []string) (string, bool) {
+	ready := databasev1alpha1.Condition{
+		Type:               databasev1alpha1.ConditionReady,
+		Status:             corev1.ConditionTrue,
+		ObservedGeneration: generation,
+		Reason:             "Ready",
+		Message:            "All conditions are met",
+	}
+	phase := databasev1alpha1.PhaseReady
+
+	for _, conditionType := range required {
+		condition := databasev1alpha1.FindCondition(*conditions, conditionType)
+		if condition != nil && condition.Status == corev1.ConditionFalse {
+			ready.Status = corev1.ConditionFalse
+			ready.Reason = condition.Reason
+			ready.Message = condition.Message
+			phase = databasev1alpha1.PhaseFailed
+			// Waiting on the server or database is not a failure of the resource itself
+			if conditionType == databasev1alpha1.ConditionServerReachable || conditionType == databasev1alpha1.ConditionDatabaseReady || conditionType == databasev1alpha1.ConditionBound {
+				phase = databasev1alpha1.PhasePending
+			}
+			break
+		}
+		if (condition == nil || condition.Status != corev1.ConditionTrue) && phase == databasev1alpha1.PhaseReady {
+			ready.Status = corev1.ConditionUnknown
+			ready.Reason = "Provisioning"
+			ready.Message = fmt.Sprintf("Waiting for %s", conditionType)
+			phase = databasev1alpha1.PhaseProvisioning
+		}
+	}
+
+	return phase, databasev1alpha1.SetCondition(conditions, ready)
+}
@@ -18,36 +18,52 @@ package controllers
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"strings"
 	"time"
 
 	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
 	db "flow.stacc.dev/database-provisioning-poc/pkg/db"
-	kubernetes "flow.stacc.dev/database-provisioning-poc/pkg/kubernetes"
+	"flow.stacc.dev/database-provisioning-poc/pkg/secrets"
+	"flow.stacc.dev/database-provisioning-poc/pkg/servers"
 	"github.com/go-logr/logr"
 
-	"github.com/sethvargo/go-password/password"
-	coreV1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
-	k8s "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
 // DatabaseReconciler reconciles a Database object
 type DatabaseReconciler struct {
 	client.Client
-	Log                 logr.Logger
-	Scheme              *runtime.Scheme
-	KubernetesClient    *kubernetes.Client
-	KubernetesClientset *k8s.Clientset
+	Log         logr.Logger
+	Scheme      *runtime.Scheme
+	Recorder    record.EventRecorder
+	Connections *db.Connections
+	// DeletionTimeout is how long deleting the database and users on the server is retried before the finalizer is removed anyway,
+	// 0 to retry until it succeeds
+	DeletionTimeout time.Duration
+	// MigrationsRoot is the directory migrations from a path have to be in, empty to only apply migrations from config maps
+	MigrationsRoot string
+	// roundRobin is whose turn it is among the servers of the RoundRobin placement policy
+	roundRobin servers.Cursor
 }
 
 // +kubebuilder:rbac:groups=database.stacc.com,resources=databases,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=database.stacc.com,resources=databases/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups=database.stacc.com,resources=databasesecretgrants,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+// +kubebuilder:rbac:groups=database.stacc.com,resources=clusterdatabaseservers,verbs=get;list;watch
 
 func (r *DatabaseReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	ctx := context.Background()
@@ -57,135 +73,248 @@ func (r *DatabaseReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 
 	// Get database resource
 	var database databasev1alpha1.Database
-	err := r.Get(ctx, req.NamespacedName, &database)
-	if err != nil {
-		log.Info("Uanble to get database resource")
+	if err := r.Get(ctx, req.NamespacedName, &database); err != nil {
+		if !apierrors.IsNotFound(err) {
+			log.Error(err, "unable to get database resource")
+		}
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
+	// Defaults are applied here as well, for clusters running without the defaulting webhook
+	database.Default()
+
+	// Credentials may only be written to the namespace of the database, unless granted by the namespace of the secret
+	secretAllowed, err := secrets.Allowed(ctx, r, databasev1alpha1.DatabaseKind, database.Namespace, database.Spec.Secret)
+	if err != nil {
+		log.Error(err, "unable to list secret grants")
+		return ctrl.Result{}, err
+	}
+	if !secretAllowed {
+		msg := fmt.Sprintf("Secret %s/%s is not in namespace %s of the database, and no DatabaseSecretGrant allows it", database.Spec.Secret.Namespace, database.Spec.Secret.Name, database.Namespace)
+		if !database.ObjectMeta.DeletionTimestamp.IsZero() {
+			// The grant was removed after provisioning, so the secret is left alone along with the database and user
+			r.Recorder.Event(&database, corev1.EventTypeWarning, "SecretNamespaceNotAllowed", msg+", database and user are left on server")
+			database.ObjectMeta.Finalizers = removeString(database.ObjectMeta.Finalizers, finalizer)
+			return ctrl.Result{}, r.Update(ctx, &database)
+		}
+		if err := r.setCondition(ctx, &database, databasev1alpha1.ConditionSecretSynced, corev1.ConditionFalse, "SecretNamespaceNotAllowed", msg); err != nil {
+			log.Error(err, "unable to update database status")
+			return ctrl.Result{}, err
+		}
+		// Nothing changes until the secret is moved or a grant is created
+		return ctrl.Result{}, nil
+	}
+
+	// Databases being deleted are finalized without waiting for their server to be ready
+	if !database.ObjectMeta.DeletionTimestamp.IsZero() {
+		return r.finalizeDatabase(ctx, log, &database, finalizer)
+	}
+
+	// Select a database server the first time if the database has a selector instead of a server
+	if msg, err := r.placeDatabase(ctx, &database); err != nil {
+		log.Error(err, msg)
+		switch {
+		case errors.Is(err, errInvalidServer), errors.Is(err, errServerChanged):
+			// Nothing changes until the server is updated
+			if err := r.setCondition(ctx, &database, databasev1alpha1.ConditionServerReachable, corev1.ConditionFalse, "InvalidServer", err.Error()); err != nil {
+				log.Error(err, "unable to update database status")
+				return ctrl.Result{}, err
+			}
+			return ctrl.Result{}, nil
+		case errors.Is(err, errNoServer):
+			if err := r.setCondition(ctx, &database, databasev1alpha1.ConditionServerReachable, corev1.ConditionFalse, "NoServerAvailable", err.Error()); err != nil {
+				log.Error(err, "unable to update database status")
+				return ctrl.Result{}, err
+			}
+			// The database is reconciled again when a database server changes
+			return ctrl.Result{}, nil
+		}
+		if statusErr := r.setCondition(ctx, &database, databasev1alpha1.ConditionServerReachable, corev1.ConditionFalse, "PlacementFailed", fmt.Sprintf("%s: %v", msg, err)); statusErr != nil {
+			log.Error(statusErr, "unable to update database status")
+		}
+		return ctrl.Result{}, err
+	}
 
 	// Get database Server resource
-	var databaseServer databasev1alpha1.DatabaseServer
-	err = r.Get(ctx, client.ObjectKey{Namespace: database.Spec.Server.Namespace, Name: database.Spec.Server.Name}, &databaseServer)
+	databaseServer, err := servers.Get(ctx, r, servers.DatabaseRef(&database))
+	if err != nil {
+		log.Error(err, "unable to get databaseServer resource")
+		if statusErr := r.setCondition(ctx, &database, databasev1alpha1.ConditionServerReachable, corev1.ConditionFalse, "ServerNotFound", err.Error()); statusErr != nil {
+			log.Error(statusErr, "unable to update database status")
+		}
+		// The database is reconciled again when the database server is created
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	// Tenants may only use servers granted to their namespace
+	allowed, err := servers.AllowsNamespace(ctx, r, databaseServer, database.Namespace)
 	if err != nil {
-		log.Error(err, "uanble to get databaseServer resource. Retrying in 10 seconds.")
-		return ctrl.Result{RequeueAfter: time.Second * 10}, client.IgnoreNotFound(err)
+		log.Error(err, "unable to get namespace of database")
+		return ctrl.Result{}, err
+	}
+	if !allowed {
+		msg := fmt.Sprintf("Database server %s does not allow databases from namespace %s", serverName(servers.RefTo(databaseServer)), database.Namespace)
+		if err := r.setCondition(ctx, &database, databasev1alpha1.ConditionServerReachable, corev1.ConditionFalse, "NamespaceNotAllowed", msg); err != nil {
+			log.Error(err, "unable to update database status")
+			return ctrl.Result{}, err
+		}
+		// Nothing changes until the server allows the namespace
+		return ctrl.Result{}, nil
+	}
+
+	// Names longer than the engine allows would be truncated, making the users of dual user rotation the same
+	if err := validateNames(&databaseServer.Spec, &database); err != nil {
+		log.Info("Invalid name", "reason", err.Error())
+		if err := r.setCondition(ctx, &database, databasev1alpha1.ConditionDatabaseProvisioned, corev1.ConditionFalse, "InvalidName", err.Error()); err != nil {
+			log.Error(err, "unable to update database status")
+			return ctrl.Result{}, err
+		}
+		// Nothing changes until the names are updated
+		return ctrl.Result{}, nil
 	}
 
-	// Stop reconsiling if database server is not connected
-	if databaseServer.Status.Connected == false {
-		log.Info("Database server not connected. Retrying in 10 seconds.")
-		return ctrl.Result{RequeueAfter: time.Second * 10}, nil
+	// Stop reconsiling if database server is not ready
+	if !databasev1alpha1.IsConditionTrue(databaseServer.Status.Conditions, databasev1alpha1.ConditionReady) {
+		log.Info("Database server not ready")
+		msg := fmt.Sprintf("Database server %s is not ready", serverName(servers.RefTo(databaseServer)))
+		if err := r.setCondition(ctx, &database, databasev1alpha1.ConditionServerReachable, corev1.ConditionFalse, "ServerNotReady", msg); err != nil {
+			log.Error(err, "unable to update database status")
+			return ctrl.Result{}, err
+		}
+		// The database is reconciled again when the database server becomes ready
+		return ctrl.Result{}, nil
 	}
 
 	// Get secret with database server password
-	serverSecret, err := r.KubernetesClientset.CoreV1().Secrets(databaseServer.Spec.Secret.Namespace).Get(databaseServer.Spec.Secret.Name, metav1.GetOptions{})
+	serverSecret, err := secrets.Get(ctx, r, databaseServer.Spec.Secret)
 	if err != nil {
-		log.Error(err, "Error obtaining secret. Retrying in 1 minute.")
-		return ctrl.Result{RequeueAfter: time.Minute}, client.IgnoreNotFound(err)
+		log.Error(err, "Error obtaining secret")
+		if statusErr := r.setCondition(ctx, &database, databasev1alpha1.ConditionServerReachable, corev1.ConditionFalse, "ServerSecretUnavailable", err.Error()); statusErr != nil {
+			log.Error(statusErr, "unable to update database status")
+		}
+		// The database is reconciled again when the secret is created
+		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
 	// Get username, set to database name if not present
-	username := database.Spec.Username
-	if username == "" {
-		username = database.Spec.Name
-	}
+	username := databaseUsername(&database)
+	users := databaseUsers(&database, username)
 
 	var pass string
 
 	// Check if database secret exists
-	dbSecret, err := r.KubernetesClientset.CoreV1().Secrets(database.Spec.Secret.Namespace).Get(database.Spec.Secret.Name, metav1.GetOptions{})
+	dbSecret, err := secrets.Get(ctx, r, database.Spec.Secret)
 	if err != nil {
 		// If error is other than "Not found" stop reconsiling
-		if !errors.IsNotFound(err) {
+		if !apierrors.IsNotFound(err) {
 			log.Error(err, "unable to create secret")
+			if statusErr := r.setCondition(ctx, &database, databasev1alpha1.ConditionSecretSynced, corev1.ConditionFalse, "SecretUnavailable", err.Error()); statusErr != nil {
+				log.Error(statusErr, "unable to update database status")
+			}
 			return ctrl.Result{}, err
 		}
-		// Generate a password with length 48, 10 digits, allow uppercase, allow repeated chars
-		genPass, err := password.Generate(48, 10, 0, false, true)
+		genPass, err := generatePassword()
 		if err != nil {
 			log.Error(err, "unable to generate password")
+			if statusErr := r.setCondition(ctx, &database, databasev1alpha1.ConditionSecretSynced, corev1.ConditionFalse, "PasswordGenerationFailed", err.Error()); statusErr != nil {
+				log.Error(statusErr, "unable to update database status")
+			}
 			return ctrl.Result{}, err
 		}
 		pass = genPass
+		username = activeUser(&database, nil, username)
 		// Create database secret
-		dbSecret = &coreV1.Secret{
+		dbSecret = &corev1.Secret{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      database.Spec.Secret.Name,
 				Namespace: database.Spec.Secret.Namespace,
+				Labels:    map[string]string{databasev1alpha1.WatchLabel: "true"},
 			},
 			Data: map[string][]byte{
 				"username": []byte(username),
 				"password": []byte(pass),
 			},
 		}
-		_, err = r.KubernetesClientset.CoreV1().Secrets(database.Spec.Secret.Namespace).Create(dbSecret)
-		if err != nil {
+		applySecretTemplate(dbSecret, database.Spec.SecretTemplate)
+		if err := r.Create(ctx, dbSecret); err != nil {
+			if apierrors.IsAlreadyExists(err) {
+				// The secret was created by an earlier reconcile and is not in the cache yet
+				return ctrl.Result{Requeue: true}, nil
+			}
 			log.Error(err, "unable to create secret")
+			if statusErr := r.setCondition(ctx, &database, databasev1alpha1.ConditionSecretSynced, corev1.ConditionFalse, "SecretCreationFailed", err.Error()); statusErr != nil {
+				log.Error(statusErr, "unable to update database status")
+			}
 			return ctrl.Result{}, err
 		}
-		database.Status.CreatedSecret = true
+		r.Recorder.Eventf(&database, corev1.EventTypeNormal, "SecretCreated", "Created secret %s/%s with credentials of user %s", dbSecret.Namespace, dbSecret.Name, username)
+	} else {
+		pass = string(dbSecret.Data["password"])
+		username = activeUser(&database, dbSecret, username)
+		// The secret holds another user after switching rotation mode, the password is kept for the new user
+		templateChanged := applySecretTemplate(dbSecret, database.Spec.SecretTemplate)
+		// Secrets created before they were labelled are labelled, so they are cached and watched
+		unlabelled := dbSecret.Labels[databasev1alpha1.WatchLabel] != "true"
+		if unlabelled {
+			if dbSecret.Labels == nil {
+				dbSecret.Labels = map[string]string{}
+			}
+			dbSecret.Labels[databasev1alpha1.WatchLabel] = "true"
+		}
+		if string(dbSecret.Data["username"]) != username || templateChanged || unlabelled {
+			dbSecret.Data["username"] = []byte(username)
+			if err := r.Update(ctx, dbSecret); err != nil {
+				log.Error(err, "unable to update secret")
+				if statusErr := r.setCondition(ctx, &database, databasev1alpha1.ConditionSecretSynced, corev1.ConditionFalse, "SecretUpdateFailed", err.Error()); statusErr != nil {
+					log.Error(statusErr, "unable to update database status")
+				}
+				return ctrl.Result{}, err
+			}
+		}
+	}
+	msg := fmt.Sprintf("Secret %s/%s contains credentials", database.Spec.Secret.Namespace, database.Spec.Secret.Name)
+	if err := r.setCondition(ctx, &database, databasev1alpha1.ConditionSecretSynced, corev1.ConditionTrue, "SecretAvailable", msg); err != nil {
+		log.Error(err, "unable to update database status")
+		return ctrl.Result{}, err
+	}
+	if database.Status.ActiveUser != username {
+		database.Status.ActiveUser = username
 		if err := r.Status().Update(ctx, &database); err != nil {
 			log.Error(err, "unable to update database status")
 			return ctrl.Result{}, err
 		}
-	} else {
-		pass = string(dbSecret.Data["password"])
 	}
 
-	var sqlServer db.SQLServer
-
-	if databaseServer.Spec.Type == "postgresql" || databaseServer.Spec.Type == "postgres" {
-		sqlServer = &db.PostgresServer{
-			Username: databaseServer.Spec.Postgres.Username,
-			Password: string(serverSecret.Data["password"]),
-			Host:     databaseServer.Spec.Postgres.Host,
-			Port:     databaseServer.Spec.Postgres.Port,
-			SslMode:  databaseServer.Spec.Postgres.SslMode,
-			Postgres: db.Postgres{
-				Name:     database.Spec.Name,
-				Username: username,
-				Password: pass,
-			},
-		}
-	} else if databaseServer.Spec.Type == "mysql" {
-		sqlServer = &db.MysqlServer{
-			Username: databaseServer.Spec.Mysql.Username,
-			Password: string(serverSecret.Data["password"]),
-			Host:     databaseServer.Spec.Mysql.Host,
-			Port:     databaseServer.Spec.Mysql.Port,
-			Ssl:      databaseServer.Spec.Mysql.Ssl,
-
-			Mysql: db.Mysql{
-				Name:     database.Spec.Name,
-				Username: username,
-				Password: pass,
-			},
-		}
-	} else if databaseServer.Spec.Type == "mongo" || databaseServer.Spec.Type == "mongodb" {
-		sqlServer = &db.MongoServer{
-			Username: databaseServer.Spec.Mongo.Username,
-			Password: string(serverSecret.Data["password"]),
-			Host:     databaseServer.Spec.Mongo.Host,
-			Port:     databaseServer.Spec.Mongo.Port,
-			Ssl:      databaseServer.Spec.Mongo.Ssl,
-			Mongo: db.Mongo{
-				Name:     database.Spec.Name,
-				Username: username,
-				Password: pass,
-			},
-		}
+	target := db.Database{
+		Name:     database.Spec.Name,
+		Username: username,
+		Password: pass,
+		// Both users of dual user rotation create tables, which the other one is granted on
+		Owners: users,
+	}
+	if database.Spec.Privileges != nil {
+		target.Privileges = *database.Spec.Privileges
 	}
 
-	if msg, err := sqlServer.Connect(); err != nil {
+	sqlServer, msg, err := r.Connections.Get(databaseServer, string(serverSecret.Data["password"]))
+	if err != nil {
 		log.Error(err, msg)
+		if errors.Is(err, db.ErrUnsupportedType) {
+			if err := r.setCondition(ctx, &database, databasev1alpha1.ConditionServerReachable, corev1.ConditionFalse, "UnsupportedServerType", err.Error()); err != nil {
+				log.Error(err, "unable to update database status")
+				return ctrl.Result{}, err
+			}
+			// Nothing changes until the database server is updated
+			return ctrl.Result{}, nil
+		}
+		if statusErr := r.setCondition(ctx, &database, databasev1alpha1.ConditionServerReachable, corev1.ConditionFalse, "ConnectionFailed", fmt.Sprintf("%s: %v", msg, err)); statusErr != nil {
+			log.Error(statusErr, "unable to update database status")
+		}
 		return ctrl.Result{}, err
 	}
-	database.Status.Connection = true
-	if err := r.Status().Update(ctx, &database); err != nil {
+	if err := r.setCondition(ctx, &database, databasev1alpha1.ConditionServerReachable, corev1.ConditionTrue, "Connected", "Connected to database server"); err != nil {
 		log.Error(err, "unable to update database status")
 		return ctrl.Result{}, err
 	}
-	defer sqlServer.Disconnect()
 
 	// If database shall be deleted with CR, add finalizer
 	if database.Spec.ReclaimPolicy == "delete" && !containsString(database.ObjectMeta.Finalizers, finalizer) {
@@ -195,69 +324,323 @@ func (r *DatabaseReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		}
 	}
 
-	// Finalize handler
-	if !database.ObjectMeta.DeletionTimestamp.IsZero() && database.Spec.ReclaimPolicy == "delete" {
-		log.Info("Database being finalized")
-
-		if msg, err := sqlServer.DeleteDatabase(); err != nil {
-			log.Info(msg, "err", err)
+	// The source is only copied when the database is created, later changes to it are not applied
+	if !databasev1alpha1.IsConditionTrue(database.Status.Conditions, databasev1alpha1.ConditionDatabaseProvisioned) {
+		source, err := r.databaseSource(ctx, &database, &databaseServer.Spec)
+		if err != nil {
+			log.Error(err, "unable to get source of database")
+			switch {
+			case errors.Is(err, errInvalidSource):
+				// Nothing changes until the source is updated
+				if err := r.setCondition(ctx, &database, databasev1alpha1.ConditionDatabaseProvisioned, corev1.ConditionFalse, "InvalidSource", err.Error()); err != nil {
+					log.Error(err, "unable to update database status")
+					return ctrl.Result{}, err
+				}
+				return ctrl.Result{}, nil
+			case errors.Is(err, errSourceNotReady), apierrors.IsNotFound(err):
+				if err := r.setCondition(ctx, &database, databasev1alpha1.ConditionDatabaseProvisioned, corev1.ConditionUnknown, "WaitingForSource", err.Error()); err != nil {
+					log.Error(err, "unable to update database status")
+					return ctrl.Result{}, err
+				}
+				// The database is reconciled again when the source database changes
+				return ctrl.Result{}, nil
+			}
+			return ctrl.Result{}, err
 		}
+		target.Source = source
+	}
 
-		if msg, err := sqlServer.DeleteUser(); err != nil {
-			log.Info(msg, "err", err)
+	// Steps which already succeeded are repeated on every reconcile, their events are only recorded the first time
+	provisioned := databasev1alpha1.IsConditionTrue(database.Status.Conditions, databasev1alpha1.ConditionDatabaseProvisioned)
+	usersProvisioned := databasev1alpha1.IsConditionTrue(database.Status.Conditions, databasev1alpha1.ConditionUserProvisioned)
+	granted := databasev1alpha1.IsConditionTrue(database.Status.Conditions, databasev1alpha1.ConditionPermissionsGranted)
+
+	target.DatabaseOwned = ownedDatabase(&database)
+	if msg, err := timeOperation(databaseServer.Spec.Type, "create_database", func() (string, error) { return sqlServer.CreateDatabase(target) }); err != nil {
+		// Databases the resource did not create may be system databases or belong to someone else, and are never taken over
+		if errors.Is(err, db.ErrDatabaseExists) {
+			msg := fmt.Sprintf("Database %s exists on the server and was not created for the database resource", target.Name)
+			if err := r.setCondition(ctx, &database, databasev1alpha1.ConditionDatabaseProvisioned, corev1.ConditionFalse, "DatabaseNotOwned", msg); err != nil {
+				log.Error(err, "unable to update database status")
+				return ctrl.Result{}, err
+			}
+			// Nothing changes until the name is updated or the database is dropped from the server
+			return ctrl.Result{}, nil
 		}
-
-		if err := r.KubernetesClientset.CoreV1().Secrets(database.Spec.Secret.Namespace).Delete(database.Spec.Secret.Name, &metav1.DeleteOptions{}); err != nil {
-			log.Info("unable to delete secret", "err", err)
+		log.Error(err, msg)
+		if statusErr := r.setCondition(ctx, &database, databasev1alpha1.ConditionDatabaseProvisioned, corev1.ConditionFalse, "CreateDatabaseFailed", fmt.Sprintf("%s: %v", msg, err)); statusErr != nil {
+			log.Error(statusErr, "unable to update database status")
 		}
-
-		// Remove finalizer to complete finazling
-		database.ObjectMeta.Finalizers = removeString(database.ObjectMeta.Finalizers, finalizer)
-		if err := r.Update(ctx, &database); err != nil {
-			log.Error(err, "unable to update database resource")
+		return ctrl.Result{}, err
+	} else if !provisioned {
+		r.Recorder.Eventf(&database, corev1.EventTypeNormal, "DatabaseCreated", "%s: %s", msg, target.Name)
+	}
+	if !containsString(database.Status.Databases, target.Name) {
+		// Recorded right away, a database created but not recorded would never be taken over again
+		patch := client.MergeFrom(database.DeepCopy())
+		database.Status.Databases = append(database.Status.Databases, target.Name)
+		if err := r.Status().Patch(ctx, &database, patch); err != nil {
+			log.Error(err, "unable to record database in database status")
 			return ctrl.Result{}, err
 		}
+	}
+	msg = fmt.Sprintf("Database %s exists on server", database.Spec.Name)
+	if err := r.setCondition(ctx, &database, databasev1alpha1.ConditionDatabaseProvisioned, corev1.ConditionTrue, "DatabaseCreated", msg); err != nil {
+		log.Error(err, "unable to update database status")
+		return ctrl.Result{}, err
+	}
 
-		return ctrl.Result{}, nil
+	owned := ownedUsers(&database)
+	for _, user := range users {
+		d := target
+		d.Username = user
+		d.Owned = containsString(owned, user)
+		// The inactive user of dual user rotation gets a password nobody knows until it is rotated to
+		if user != target.Username {
+			if d.Password, err = generatePassword(); err != nil {
+				log.Error(err, "unable to generate password")
+				return ctrl.Result{}, err
+			}
+		}
+		if msg, err := timeOperation(databaseServer.Spec.Type, "create_user", func() (string, error) { return sqlServer.CreateUser(d) }); err != nil {
+			// Users the database did not create may be the admin user or belong to someone else, and are never taken over
+			if errors.Is(err, db.ErrUserExists) {
+				msg := fmt.Sprintf("User %s exists on the server and was not created for the database", user)
+				if err := r.setCondition(ctx, &database, databasev1alpha1.ConditionUserProvisioned, corev1.ConditionFalse, "UserNotOwned", msg); err != nil {
+					log.Error(err, "unable to update database status")
+					return ctrl.Result{}, err
+				}
+				// Nothing changes until the username is updated or the user is dropped from the server
+				return ctrl.Result{}, nil
+			}
+			log.Error(err, msg)
+			if statusErr := r.setCondition(ctx, &database, databasev1alpha1.ConditionUserProvisioned, corev1.ConditionFalse, "CreateUserFailed", fmt.Sprintf("%s: %v", msg, err)); statusErr != nil {
+				log.Error(statusErr, "unable to update database status")
+			}
+			return ctrl.Result{}, err
+		} else if !usersProvisioned {
+			r.Recorder.Eventf(&database, corev1.EventTypeNormal, "UserCreated", "%s: %s", msg, user)
+		}
+		if !containsString(database.Status.Users, user) {
+			// Recorded right away, a user created but not recorded would never be taken over again
+			patch := client.MergeFrom(database.DeepCopy())
+			database.Status.Users = owned[:len(owned):len(owned)]
+			if !d.Owned {
+				database.Status.Users = append(database.Status.Users, user)
+			}
+			if err := r.Status().Patch(ctx, &database, patch); err != nil {
+				log.Error(err, "unable to record user in database status")
+				return ctrl.Result{}, err
+			}
+			owned = database.Status.Users
+		}
 	}
 
-	if msg, err := sqlServer.CreateDatabase(); err != nil {
-		log.Error(err, msg)
-		return ctrl.Result{}, err
+	// A user created earlier keeps its old password, e.g. when the secret was deleted and created again
+	// with a new one. The password on the server is reset to the one in the secret.
+	if msg, err := timeOperation(databaseServer.Spec.Type, "verify_login", func() (string, error) { return sqlServer.VerifyLogin(target) }); err != nil {
+		log.Info("Unable to log in with credentials from secret, resetting password", "user", target.Username, "reason", msg, "err", err)
+		if msg, err := timeOperation(databaseServer.Spec.Type, "update_password", func() (string, error) { return sqlServer.UpdatePassword(target) }); err != nil {
+			log.Error(err, msg)
+			if statusErr := r.setCondition(ctx, &database, databasev1alpha1.ConditionUserProvisioned, corev1.ConditionFalse, "PasswordResetFailed", fmt.Sprintf("%s: %v", msg, err)); statusErr != nil {
+				log.Error(statusErr, "unable to update database status")
+			}
+			return ctrl.Result{}, err
+		}
+		r.Recorder.Eventf(&database, corev1.EventTypeWarning, "PasswordReset", "Password of user %s did not match secret %s/%s and was reset", target.Username, database.Spec.Secret.Namespace, database.Spec.Secret.Name)
 	}
-	database.Status.CreatedDatabase = true
-	if err := r.Status().Update(ctx, &database); err != nil {
+	msg = fmt.Sprintf("User %s exists on server", strings.Join(users, ", "))
+	if err := r.setCondition(ctx, &database, databasev1alpha1.ConditionUserProvisioned, corev1.ConditionTrue, "UserCreated", msg); err != nil {
 		log.Error(err, "unable to update database status")
 		return ctrl.Result{}, err
 	}
 
-	if msg, err := sqlServer.CreateUser(); err != nil {
-		if strings.Contains(err.Error(), "already exists") {
-			log.Info("User already exists", "user", username)
-		} else {
+	// Both users of dual user rotation get the same permissions
+	for _, user := range users {
+		d := target
+		d.Username = user
+		if msg, err := timeOperation(databaseServer.Spec.Type, "grant_permissions", func() (string, error) { return sqlServer.GrantPermissions(d) }); err != nil {
 			log.Error(err, msg)
+			if errors.Is(err, db.ErrUnsupportedPrivilege) {
+				if err := r.setCondition(ctx, &database, databasev1alpha1.ConditionPermissionsGranted, corev1.ConditionFalse, "UnsupportedPrivileges", err.Error()); err != nil {
+					log.Error(err, "unable to update database status")
+					return ctrl.Result{}, err
+				}
+				// Nothing changes until the privileges are updated
+				return ctrl.Result{}, nil
+			}
+			if statusErr := r.setCondition(ctx, &database, databasev1alpha1.ConditionPermissionsGranted, corev1.ConditionFalse, "GrantFailed", fmt.Sprintf("%s: %v", msg, err)); statusErr != nil {
+				log.Error(statusErr, "unable to update database status")
+			}
 			return ctrl.Result{}, err
+		} else if !granted {
+			r.Recorder.Eventf(&database, corev1.EventTypeNormal, "PermissionsGranted", "%s: %s", msg, user)
 		}
 	}
-	database.Status.CreatedUser = true
-	if err := r.Status().Update(ctx, &database); err != nil {
+	level := target.Privileges.Level
+	if level == "" {
+		level = databasev1alpha1.PrivilegeOwner
+	}
+	msg = fmt.Sprintf("User %s has been granted %s privileges on database %s", strings.Join(users, ", "), level, database.Spec.Name)
+	if err := r.setCondition(ctx, &database, databasev1alpha1.ConditionPermissionsGranted, corev1.ConditionTrue, "PermissionsGranted", msg); err != nil {
 		log.Error(err, "unable to update database status")
 		return ctrl.Result{}, err
 	}
 
-	if msg, err := sqlServer.GrantPermissions(); err != nil {
+	// Check that applications are able to use the credentials in the secret
+	if msg, err := timeOperation(databaseServer.Spec.Type, "verify_access", func() (string, error) { return sqlServer.VerifyAccess(target) }); err != nil {
 		log.Error(err, msg)
+		if err := r.setCondition(ctx, &database, databasev1alpha1.ConditionCredentialsVerified, corev1.ConditionFalse, "VerificationFailed", fmt.Sprintf("%s: %v", msg, err)); err != nil {
+			log.Error(err, "unable to update database status")
+			return ctrl.Result{}, err
+		}
+		// Retried with backoff
 		return ctrl.Result{}, err
 	}
-	database.Status.GrantedPermissions = true
-	if err := r.Status().Update(ctx, &database); err != nil {
+	msg = fmt.Sprintf("User %s can read and write database %s", target.Username, database.Spec.Name)
+	if err := r.setCondition(ctx, &database, databasev1alpha1.ConditionCredentialsVerified, corev1.ConditionTrue, "CredentialsVerified", msg); err != nil {
 		log.Error(err, "unable to update database status")
 		return ctrl.Result{}, err
 	}
 
+	// Apply schema migrations with the credentials applications use
+	if database.Spec.Migrations != nil {
+		previous := database.Status.Migrations
+		if msg, err := timeOperation(databaseServer.Spec.Type, "migrate", func() (string, error) { return r.applyMigrations(ctx, sqlServer, &database, target) }); err != nil {
+			log.Error(err, msg)
+			switch {
+			case errors.Is(err, errInvalidMigrations), errors.Is(err, db.ErrMigrationsPath), errors.Is(err, db.ErrUnsupportedType), errors.Is(err, db.ErrDownMigration):
+				// Nothing changes until the migrations are updated
+				if err := r.setCondition(ctx, &database, databasev1alpha1.ConditionMigrationsApplied, corev1.ConditionFalse, "InvalidMigrations", fmt.Sprintf("%s: %v", msg, err)); err != nil {
+					log.Error(err, "unable to update database status")
+					return ctrl.Result{}, err
+				}
+				return ctrl.Result{}, nil
+			case apierrors.IsNotFound(err):
+				// Nothing changes until the config map is created
+				if err := r.setCondition(ctx, &database, databasev1alpha1.ConditionMigrationsApplied, corev1.ConditionFalse, "MigrationsUnavailable", fmt.Sprintf("%s: %v", msg, err)); err != nil {
+					log.Error(err, "unable to update database status")
+					return ctrl.Result{}, err
+				}
+				return ctrl.Result{}, nil
+			case errors.Is(err, db.ErrMigrationDirty):
+				// Retried with backoff until the database is fixed by hand
+				if statusErr := r.setCondition(ctx, &database, databasev1alpha1.ConditionMigrationsApplied, corev1.ConditionFalse, "MigrationDirty", fmt.Sprintf("%s: %v", msg, err)); statusErr != nil {
+					log.Error(statusErr, "unable to update database status")
+				}
+				return ctrl.Result{}, err
+			}
+			if statusErr := r.setCondition(ctx, &database, databasev1alpha1.ConditionMigrationsApplied, corev1.ConditionFalse, "MigrationFailed", fmt.Sprintf("%s: %v", msg, err)); statusErr != nil {
+				log.Error(statusErr, "unable to update database status")
+			}
+			return ctrl.Result{}, err
+		}
+		msg = fmt.Sprintf("Database %s is at migration version %d", database.Spec.Name, database.Status.Migrations.Version)
+		if previous == nil || previous.Version != database.Status.Migrations.Version {
+			r.Recorder.Event(&database, corev1.EventTypeNormal, "MigrationsApplied", msg)
+		}
+		if err := r.setCondition(ctx, &database, databasev1alpha1.ConditionMigrationsApplied, corev1.ConditionTrue, "MigrationsApplied", msg); err != nil {
+			log.Error(err, "unable to update database status")
+			return ctrl.Result{}, err
+		}
+	}
+
+	// Rotate the password when the interval has passed or a rotation is requested
+	if passwordRotationDue(&database, dbSecret) {
+		log.Info("Rotating password", "user", username)
+		if msg, err := timeOperation(databaseServer.Spec.Type, "rotate_password", func() (string, error) { return r.rotatePassword(ctx, sqlServer, &database, dbSecret, target) }); err != nil {
+			log.Error(err, msg)
+			if statusErr := r.setCondition(ctx, &database, databasev1alpha1.ConditionPasswordRotated, corev1.ConditionFalse, "RotationFailed", fmt.Sprintf("%s: %v", msg, err)); statusErr != nil {
+				log.Error(statusErr, "unable to update database status")
+			}
+			return ctrl.Result{}, err
+		}
+		msg = fmt.Sprintf("Password of user %s has been rotated", database.Status.ActiveUser)
+		r.Recorder.Event(&database, corev1.EventTypeNormal, "PasswordRotated", msg)
+		if err := r.setCondition(ctx, &database, databasev1alpha1.ConditionPasswordRotated, corev1.ConditionTrue, "PasswordRotated", msg); err != nil {
+			log.Error(err, "unable to update database status")
+			return ctrl.Result{}, err
+		}
+	}
+
+	// Come back when the password is due to be rotated
+	if next := nextPasswordRotation(&database, dbSecret); next != nil {
+		return ctrl.Result{RequeueAfter: time.Until(*next)}, nil
+	}
+
 	return ctrl.Result{}, nil
 }
 
+// databaseConditions must all be true for a database to be ready
+var databaseConditions = []string{
+	databasev1alpha1.ConditionServerReachable,
+	databasev1alpha1.ConditionSecretSynced,
+	databasev1alpha1.ConditionDatabaseProvisioned,
+	databasev1alpha1.ConditionUserProvisioned,
+	databasev1alpha1.ConditionPermissionsGranted,
+	databasev1alpha1.ConditionCredentialsVerified,
+}
+
+// setCondition records the outcome of a provisioning step, summarizes it into the Ready condition and phase,
+// and writes the status if anything changed
+func (r *DatabaseReconciler) setCondition(ctx context.Context, database *databasev1alpha1.Database, conditionType string, status corev1.ConditionStatus, reason, message string) error {
+	changed := databasev1alpha1.SetCondition(&database.Status.Conditions, databasev1alpha1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		ObservedGeneration: database.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+
+	// Failures are recorded as events as well, for those without access to the status or the controller logs
+	if changed && status == corev1.ConditionFalse {
+		r.Recorder.Event(database, corev1.EventTypeWarning, reason, message)
+	}
+
+	required := databaseConditions
+	if database.Spec.Migrations != nil {
+		required = append(required[:len(required):len(required)], databasev1alpha1.ConditionMigrationsApplied)
+	}
+	phase, readyChanged := summarizeConditions(&database.Status.Conditions, database.Generation, required)
+	if !database.ObjectMeta.DeletionTimestamp.IsZero() {
+		phase = databasev1alpha1.PhaseDeleting
+	}
+
+	if !changed && !readyChanged && database.Status.Phase == phase && database.Status.ObservedGeneration == database.Generation {
+		return nil
+	}
+	database.Status.Phase = phase
+	database.Status.ObservedGeneration = database.Generation
+	return r.Status().Update(ctx, database)
+}
+
+// applySecretTemplate adds the labels and annotations of the template to a secret and reports whether it changed
+func applySecretTemplate(secret *corev1.Secret, template *databasev1alpha1.SecretTemplate) bool {
+	if template == nil {
+		return false
+	}
+	changed := false
+	for key, value := range template.Labels {
+		if secret.Labels[key] != value {
+			if secret.Labels == nil {
+				secret.Labels = map[string]string{}
+			}
+			secret.Labels[key] = value
+			changed = true
+		}
+	}
+	for key, value := range template.Annotations {
+		if secret.Annotations[key] != value {
+			if secret.Annotations == nil {
+				secret.Annotations = map[string]string{}
+			}
+			secret.Annotations[key] = value
+			changed = true
+		}
+	}
+	return changed
+}
+
 // Helper functions to check and remove string from a slice of strings.
 func containsString(slice []string, s string) bool {
 	for _, item := range slice {
@@ -281,5 +664,23 @@ func removeString(slice []string, s string) (result []string) {
 func (r *DatabaseReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&databasev1alpha1.Database{}).
+		Watches(&source.Kind{Type: &databasev1alpha1.DatabaseServer{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: serverDatabaseRequests(mgr.GetClient(), databasev1alpha1.DatabaseServerKind),
+		}).
+		Watches(&source.Kind{Type: &databasev1alpha1.ClusterDatabaseServer{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: serverDatabaseRequests(mgr.GetClient(), databasev1alpha1.ClusterDatabaseServerKind),
+		}).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: secretDatabaseRequests(mgr.GetClient()),
+		}).
+		Watches(&source.Kind{Type: &databasev1alpha1.Database{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: sourceDatabaseRequests(mgr.GetClient()),
+		}).
+		Watches(&source.Kind{Type: &databasev1alpha1.DatabaseSecretGrant{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: secretGrantRequests(mgr.GetClient(), databasev1alpha1.DatabaseKind),
+		}).
+		Watches(&source.Kind{Type: &corev1.ConfigMap{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: configMapDatabaseRequests(mgr.GetClient()),
+		}).
 		Complete(r)
 }
@@ -0,0 +1,359 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+)
+
+// createNamespace creates a namespace of its own for a spec, and returns its name
+func createNamespace() string {
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "test-"}}
+	Expect(k8sClient.Create(context.Background(), namespace)).To(Succeed())
+	return namespace.Name
+}
+
+// adminSecret creates the secret with the admin password of a database server
+func adminSecret(namespace, name string) databasev1alpha1.Secret {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name + "-admin"},
+		StringData: map[string]string{"password": "admin-password"},
+	}
+	Expect(k8sClient.Create(context.Background(), secret)).To(Succeed())
+	return databasev1alpha1.Secret{Name: secret.Name, Namespace: namespace}
+}
+
+// fakeServerSpec returns the spec of a database server on the fake server of a host
+func fakeServerSpec(host string, secret databasev1alpha1.Secret) databasev1alpha1.DatabaseServerSpec {
+	return databasev1alpha1.DatabaseServerSpec{
+		Type:     fakeServerType,
+		Secret:   secret,
+		Postgres: databasev1alpha1.Postgres{Host: host, Username: "admin", Port: 5432, SslMode: "disable"},
+	}
+}
+
+// createServer creates a DatabaseServer on a fake server of its own and waits for it to be ready
+func createServer(namespace, name string, labels map[string]string) *fakeServer {
+	host := name + "." + namespace
+	server := &databasev1alpha1.DatabaseServer{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: labels},
+		Spec:       fakeServerSpec(host, adminSecret(namespace, name)),
+	}
+	Expect(k8sClient.Create(context.Background(), server)).To(Succeed())
+	key := client.ObjectKey{Namespace: namespace, Name: name}
+	Eventually(func() bool {
+		if err := k8sClient.Get(context.Background(), key, server); err != nil {
+			return false
+		}
+		return databasev1alpha1.IsConditionTrue(server.Status.Conditions, databasev1alpha1.ConditionReady)
+	}, timeout, interval).Should(BeTrue())
+	return fakeServerFor(host)
+}
+
+// newDatabase returns a database on a DatabaseServer in its namespace, with a secret named after it
+func newDatabase(namespace, name, server string) *databasev1alpha1.Database {
+	return &databasev1alpha1.Database{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec: databasev1alpha1.DatabaseSpec{
+			Server: databasev1alpha1.Server{Name: server},
+			Name:   name,
+			Secret: databasev1alpha1.Secret{Name: name + "-credentials"},
+		},
+	}
+}
+
+// databaseCondition returns a function polling the status and reason of a condition of a database, e.g. "False UserNotOwned"
+func databaseCondition(key client.ObjectKey, conditionType string) func() string {
+	return func() string {
+		var database databasev1alpha1.Database
+		if err := k8sClient.Get(context.Background(), key, &database); err != nil {
+			return err.Error()
+		}
+		condition := databasev1alpha1.FindCondition(database.Status.Conditions, conditionType)
+		if condition == nil {
+			return ""
+		}
+		return string(condition.Status) + " " + condition.Reason
+	}
+}
+
+// credentials returns the username and password in a secret
+func credentials(key client.ObjectKey) (string, string) {
+	var secret corev1.Secret
+	Expect(k8sClient.Get(context.Background(), key, &secret)).To(Succeed())
+	return string(secret.Data["username"]), string(secret.Data["password"])
+}
+
+// object is a resource with metadata
+type object interface {
+	runtime.Object
+	metav1.Object
+}
+
+// annotate sets an annotation on a resource, retrying on conflicts with the controllers
+func annotate(key client.ObjectKey, obj object, name, value string) {
+	Eventually(func() error {
+		if err := k8sClient.Get(context.Background(), key, obj); err != nil {
+			return err
+		}
+		annotations := obj.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[name] = value
+		obj.SetAnnotations(annotations)
+		return k8sClient.Update(context.Background(), obj)
+	}, timeout, interval).Should(Succeed())
+}
+
+// isDeleted returns a function polling whether a resource is gone
+func isDeleted(key client.ObjectKey, obj object) func() bool {
+	return func() bool {
+		return apierrors.IsNotFound(k8sClient.Get(context.Background(), key, obj))
+	}
+}
+
+var _ = Describe("Database controller", func() {
+	var namespace string
+
+	BeforeEach(func() {
+		namespace = createNamespace()
+	})
+
+	Context("when a database is created", func() {
+		It("provisions the database and user, and writes the credentials to the secret", func() {
+			server := createServer(namespace, "server", nil)
+			database := newDatabase(namespace, "orders", "server")
+			Expect(k8sClient.Create(context.Background(), database)).To(Succeed())
+
+			key := client.ObjectKey{Namespace: namespace, Name: "orders"}
+			Eventually(databaseCondition(key, databasev1alpha1.ConditionReady), timeout, interval).Should(Equal("True Ready"))
+			username, password := credentials(client.ObjectKey{Namespace: namespace, Name: "orders-credentials"})
+			Expect(username).To(Equal("orders"))
+			Expect(server.password("orders")).To(Equal(password))
+			Expect(server.hasDatabase("orders")).To(BeTrue())
+		})
+	})
+
+	Context("when a password rotation is requested", func() {
+		It("changes the password of the user on the server and in the secret", func() {
+			server := createServer(namespace, "server", nil)
+			database := newDatabase(namespace, "orders", "server")
+			database.Spec.PasswordRotation = &databasev1alpha1.PasswordRotation{Mode: databasev1alpha1.RotationModeSingle}
+			Expect(k8sClient.Create(context.Background(), database)).To(Succeed())
+
+			key := client.ObjectKey{Namespace: namespace, Name: "orders"}
+			secretKey := client.ObjectKey{Namespace: namespace, Name: "orders-credentials"}
+			Eventually(databaseCondition(key, databasev1alpha1.ConditionReady), timeout, interval).Should(Equal("True Ready"))
+			_, oldPassword := credentials(secretKey)
+
+			annotate(key, &databasev1alpha1.Database{}, databasev1alpha1.RotatePasswordAnnotation, "1")
+			Eventually(func() string {
+				_, password := credentials(secretKey)
+				return password
+			}, timeout, interval).ShouldNot(Equal(oldPassword))
+			username, password := credentials(secretKey)
+			Expect(username).To(Equal("orders"))
+			Expect(server.password("orders")).To(Equal(password))
+			Eventually(databaseCondition(key, databasev1alpha1.ConditionPasswordRotated), timeout, interval).Should(Equal("True PasswordRotated"))
+		})
+
+		It("switches to the other user with dual user rotation, keeping the old credentials valid", func() {
+			server := createServer(namespace, "server", nil)
+			database := newDatabase(namespace, "orders", "server")
+			database.Spec.PasswordRotation = &databasev1alpha1.PasswordRotation{Mode: databasev1alpha1.RotationModeDual}
+			Expect(k8sClient.Create(context.Background(), database)).To(Succeed())
+
+			key := client.ObjectKey{Namespace: namespace, Name: "orders"}
+			secretKey := client.ObjectKey{Namespace: namespace, Name: "orders-credentials"}
+			Eventually(databaseCondition(key, databasev1alpha1.ConditionReady), timeout, interval).Should(Equal("True Ready"))
+			oldUsername, oldPassword := credentials(secretKey)
+			Expect(oldUsername).To(BeElementOf("orders_a", "orders_b"))
+			_, exists := server.password("orders_a")
+			Expect(exists).To(BeTrue())
+			_, exists = server.password("orders_b")
+			Expect(exists).To(BeTrue())
+
+			annotate(key, &databasev1alpha1.Database{}, databasev1alpha1.RotatePasswordAnnotation, "1")
+			Eventually(func() string {
+				username, _ := credentials(secretKey)
+				return username
+			}, timeout, interval).ShouldNot(Equal(oldUsername))
+			username, password := credentials(secretKey)
+			Expect(username).To(BeElementOf("orders_a", "orders_b"))
+			Expect(server.password(username)).To(Equal(password))
+			Expect(server.password(oldUsername)).To(Equal(oldPassword))
+		})
+	})
+
+	Context("when a database with reclaim policy delete is deleted", func() {
+		It("drops the database and users it created, and deletes the secret", func() {
+			server := createServer(namespace, "server", nil)
+			database := newDatabase(namespace, "orders", "server")
+			database.Spec.ReclaimPolicy = "delete"
+			Expect(k8sClient.Create(context.Background(), database)).To(Succeed())
+
+			key := client.ObjectKey{Namespace: namespace, Name: "orders"}
+			Eventually(databaseCondition(key, databasev1alpha1.ConditionReady), timeout, interval).Should(Equal("True Ready"))
+			Expect(k8sClient.Get(context.Background(), key, database)).To(Succeed())
+			Expect(database.Finalizers).To(ContainElement("database.stacc.com/finalizer"))
+
+			Expect(k8sClient.Delete(context.Background(), database)).To(Succeed())
+			Eventually(isDeleted(key, &databasev1alpha1.Database{}), timeout, interval).Should(BeTrue())
+			Expect(server.hasDatabase("orders")).To(BeFalse())
+			_, exists := server.password("orders")
+			Expect(exists).To(BeFalse())
+			Expect(isDeleted(client.ObjectKey{Namespace: namespace, Name: "orders-credentials"}, &corev1.Secret{})()).To(BeTrue())
+		})
+
+		It("leaves users it did not create on the server", func() {
+			server := createServer(namespace, "server", nil)
+			server.addUser("shared", "shared-password")
+			database := newDatabase(namespace, "orders", "server")
+			database.Spec.Username = "shared"
+			database.Spec.ReclaimPolicy = "delete"
+			Expect(k8sClient.Create(context.Background(), database)).To(Succeed())
+
+			key := client.ObjectKey{Namespace: namespace, Name: "orders"}
+			Eventually(databaseCondition(key, databasev1alpha1.ConditionUserProvisioned), timeout, interval).Should(Equal("False UserNotOwned"))
+			Expect(server.password("shared")).To(Equal("shared-password"))
+
+			Expect(k8sClient.Delete(context.Background(), database)).To(Succeed())
+			Eventually(isDeleted(key, &databasev1alpha1.Database{}), timeout, interval).Should(BeTrue())
+			Expect(server.password("shared")).To(Equal("shared-password"))
+			Expect(server.hasDatabase("orders")).To(BeFalse())
+		})
+
+		It("keeps the finalizer while deletion fails, until the deletion is forced", func() {
+			server := createServer(namespace, "server", nil)
+			database := newDatabase(namespace, "orders", "server")
+			database.Spec.ReclaimPolicy = "delete"
+			Expect(k8sClient.Create(context.Background(), database)).To(Succeed())
+
+			key := client.ObjectKey{Namespace: namespace, Name: "orders"}
+			Eventually(databaseCondition(key, databasev1alpha1.ConditionReady), timeout, interval).Should(Equal("True Ready"))
+			server.setFailDeletes(true)
+			Expect(k8sClient.Delete(context.Background(), database)).To(Succeed())
+			Eventually(databaseCondition(key, databasev1alpha1.ConditionDeleted), timeout, interval).Should(Equal("False DeleteDatabaseFailed"))
+			Expect(isDeleted(key, &databasev1alpha1.Database{})()).To(BeFalse())
+
+			annotate(key, &databasev1alpha1.Database{}, databasev1alpha1.ForceDeleteAnnotation, "true")
+			Eventually(isDeleted(key, &databasev1alpha1.Database{}), timeout, interval).Should(BeTrue())
+			Expect(server.hasDatabase("orders")).To(BeTrue())
+		})
+	})
+
+	Context("when a cluster database server allows namespaces", func() {
+		It("only provisions databases in the allowed namespaces", func() {
+			other := createNamespace()
+			host := "cluster." + namespace
+			clusterServer := &databasev1alpha1.ClusterDatabaseServer{
+				ObjectMeta: metav1.ObjectMeta{Name: namespace},
+				Spec:       fakeServerSpec(host, adminSecret(namespace, "cluster")),
+			}
+			clusterServer.Spec.AllowedNamespaces = &databasev1alpha1.AllowedNamespaces{Names: []string{namespace}}
+			Expect(k8sClient.Create(context.Background(), clusterServer)).To(Succeed())
+			server := fakeServerFor(host)
+
+			ref := databasev1alpha1.Server{Kind: databasev1alpha1.ClusterDatabaseServerKind, Name: clusterServer.Name}
+			denied := newDatabase(other, "denied", "")
+			denied.Spec.Server = ref
+			Expect(k8sClient.Create(context.Background(), denied)).To(Succeed())
+			allowed := newDatabase(namespace, "allowed", "")
+			allowed.Spec.Server = ref
+			Expect(k8sClient.Create(context.Background(), allowed)).To(Succeed())
+
+			Eventually(databaseCondition(client.ObjectKey{Namespace: namespace, Name: "allowed"}, databasev1alpha1.ConditionReady), timeout, interval).Should(Equal("True Ready"))
+			Eventually(databaseCondition(client.ObjectKey{Namespace: other, Name: "denied"}, databasev1alpha1.ConditionServerReachable), timeout, interval).Should(Equal("False NamespaceNotAllowed"))
+			Expect(server.hasDatabase("allowed")).To(BeTrue())
+			Expect(server.hasDatabase("denied")).To(BeFalse())
+		})
+	})
+
+	Context("when a database is placed by a selector", func() {
+		var pool map[string]string
+
+		// placedOn returns a function polling the name of the server a database was placed on
+		placedOn := func(name string) func() string {
+			return func() string {
+				var database databasev1alpha1.Database
+				if err := k8sClient.Get(context.Background(), client.ObjectKey{Namespace: namespace, Name: name}, &database); err != nil || database.Status.Server == nil {
+					return ""
+				}
+				return database.Status.Server.Name
+			}
+		}
+		// newPlacedDatabase returns a database placed on one of the servers of the pool
+		newPlacedDatabase := func(name string, labels map[string]string, placement *databasev1alpha1.Placement) *databasev1alpha1.Database {
+			database := newDatabase(namespace, name, "")
+			database.Labels = labels
+			database.Spec.ServerSelector = &metav1.LabelSelector{MatchLabels: pool}
+			database.Spec.ServerType = fakeServerType
+			database.Spec.Placement = placement
+			return database
+		}
+
+		BeforeEach(func() {
+			pool = map[string]string{"pool": namespace}
+			createServer(namespace, "server-a", pool)
+			createServer(namespace, "server-b", pool)
+		})
+
+		It("places databases on the server with the fewest databases", func() {
+			Expect(k8sClient.Create(context.Background(), newPlacedDatabase("first", nil, nil))).To(Succeed())
+			// Ties are broken by name
+			Eventually(placedOn("first"), timeout, interval).Should(Equal("server-a"))
+			Expect(k8sClient.Create(context.Background(), newPlacedDatabase("second", nil, nil))).To(Succeed())
+			Eventually(placedOn("second"), timeout, interval).Should(Equal("server-b"))
+		})
+
+		It("places databases matching an affinity together", func() {
+			Expect(k8sClient.Create(context.Background(), newPlacedDatabase("orders", map[string]string{"app": "shop"}, nil))).To(Succeed())
+			Eventually(placedOn("orders"), timeout, interval).Should(Equal("server-a"))
+
+			affinity := &databasev1alpha1.Placement{Affinity: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "shop"}}}
+			Expect(k8sClient.Create(context.Background(), newPlacedDatabase("payments", nil, affinity))).To(Succeed())
+			Eventually(placedOn("payments"), timeout, interval).Should(Equal("server-a"))
+		})
+
+		It("keeps databases matching an anti-affinity apart", func() {
+			// server-b hosts more databases, so it is only chosen because of the anti-affinity
+			Expect(k8sClient.Create(context.Background(), newDatabase(namespace, "reporting", "server-b"))).To(Succeed())
+			Expect(k8sClient.Create(context.Background(), newDatabase(namespace, "audit", "server-b"))).To(Succeed())
+			orders := newDatabase(namespace, "orders", "server-a")
+			orders.Labels = map[string]string{"app": "shop"}
+			Expect(k8sClient.Create(context.Background(), orders)).To(Succeed())
+			Eventually(placedOn("audit"), timeout, interval).Should(Equal("server-b"))
+			Eventually(placedOn("reporting"), timeout, interval).Should(Equal("server-b"))
+			Eventually(placedOn("orders"), timeout, interval).Should(Equal("server-a"))
+
+			antiAffinity := &databasev1alpha1.Placement{AntiAffinity: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "shop"}}}
+			Expect(k8sClient.Create(context.Background(), newPlacedDatabase("payments", nil, antiAffinity))).To(Succeed())
+			Eventually(placedOn("payments"), timeout, interval).Should(Equal("server-b"))
+		})
+	})
+})
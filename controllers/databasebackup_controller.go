@@ -0,0 +1,405 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/go-logr/logr"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+	db "flow.stacc.dev/database-provisioning-poc/pkg/db"
+	"flow.stacc.dev/database-provisioning-poc/pkg/secrets"
+	"flow.stacc.dev/database-provisioning-poc/pkg/servers"
+)
+
+// DatabaseBackupReconciler reconciles a DatabaseBackup object
+type DatabaseBackupReconciler struct {
+	client.Client
+	// APIReader reads the pods of backup jobs from the API server, so pods are not cached in every namespace
+	APIReader client.Reader
+	Log       logr.Logger
+	Scheme    *runtime.Scheme
+	Recorder  record.EventRecorder
+}
+
+// +kubebuilder:rbac:groups=database.stacc.com,resources=databasebackups,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=database.stacc.com,resources=databasebackups/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=database.stacc.com,resources=databases,verbs=get;list;watch
+// +kubebuilder:rbac:groups=database.stacc.com,resources=databaseservers,verbs=get;list;watch
+// +kubebuilder:rbac:groups=database.stacc.com,resources=clusterdatabaseservers,verbs=get;list;watch
+// +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=batch,resources=cronjobs,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+// Reconcile DatabaseBackup
+func (r *DatabaseBackupReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.Background()
+	log := r.Log.WithValues("databasebackup", req.NamespacedName)
+
+	var backup databasev1alpha1.DatabaseBackup
+	if err := r.Get(ctx, req.NamespacedName, &backup); err != nil {
+		log.Info("Unable to get databaseBackup resource")
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	// Jobs and cron jobs are owned by the backup and deleted with it
+	if !backup.ObjectMeta.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	if err := validateStorage(backup.Spec.Storage); err != nil {
+		if err := r.setCondition(ctx, &backup, databasev1alpha1.ConditionBackupScheduled, corev1.ConditionFalse, "InvalidStorage", err.Error()); err != nil {
+			log.Error(err, "unable to update databaseBackup status")
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+
+	// Backups are only made of databases in their own namespace
+	if !backup.Spec.Database.InNamespace(backup.Namespace) {
+		msg := fmt.Sprintf("Database %s/%s is not in namespace %s of the backup", backup.Spec.Database.Namespace, backup.Spec.Database.Name, backup.Namespace)
+		if err := r.setCondition(ctx, &backup, databasev1alpha1.ConditionDatabaseReady, corev1.ConditionFalse, "DatabaseNamespaceNotAllowed", msg); err != nil {
+			log.Error(err, "unable to update databaseBackup status")
+			return ctrl.Result{}, err
+		}
+		// Nothing changes until the database is updated
+		return ctrl.Result{}, nil
+	}
+
+	// Get the database to back up
+	databaseKey := client.ObjectKey{Namespace: backup.Namespace, Name: backup.Spec.Database.Name}
+	var database databasev1alpha1.Database
+	if err := r.Get(ctx, databaseKey, &database); err != nil {
+		log.Error(err, "unable to get database resource")
+		if statusErr := r.setCondition(ctx, &backup, databasev1alpha1.ConditionDatabaseReady, corev1.ConditionFalse, "DatabaseNotFound", err.Error()); statusErr != nil {
+			log.Error(statusErr, "unable to update databaseBackup status")
+		}
+		// The backup is reconciled again when the database is created
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if !databasev1alpha1.IsConditionTrue(database.Status.Conditions, databasev1alpha1.ConditionReady) {
+		log.Info("Database not ready")
+		msg := fmt.Sprintf("Database %s/%s is not ready", database.Namespace, database.Name)
+		if err := r.setCondition(ctx, &backup, databasev1alpha1.ConditionDatabaseReady, corev1.ConditionFalse, "DatabaseNotReady", msg); err != nil {
+			log.Error(err, "unable to update databaseBackup status")
+			return ctrl.Result{}, err
+		}
+		// The backup is reconciled again when the database becomes ready
+		return ctrl.Result{}, nil
+	}
+	msg := fmt.Sprintf("Database %s/%s is ready", database.Namespace, database.Name)
+	if err := r.setCondition(ctx, &backup, databasev1alpha1.ConditionDatabaseReady, corev1.ConditionTrue, "DatabaseReady", msg); err != nil {
+		log.Error(err, "unable to update databaseBackup status")
+		return ctrl.Result{}, err
+	}
+
+	databaseServer, err := servers.Get(ctx, r, servers.DatabaseRef(&database))
+	if err != nil {
+		log.Error(err, "unable to get databaseServer resource")
+		if statusErr := r.setCondition(ctx, &backup, databasev1alpha1.ConditionBackupScheduled, corev1.ConditionFalse, "ServerNotFound", err.Error()); statusErr != nil {
+			log.Error(statusErr, "unable to update databaseBackup status")
+		}
+		// The backup is reconciled again when the server is created
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	// Get secret with the credentials of the database user, which the dump runs as
+	dbSecret, err := secrets.Get(ctx, r, database.Spec.Secret)
+	if err != nil {
+		log.Error(err, "Error obtaining secret")
+		if statusErr := r.setCondition(ctx, &backup, databasev1alpha1.ConditionBackupScheduled, corev1.ConditionFalse, "DatabaseSecretUnavailable", err.Error()); statusErr != nil {
+			log.Error(statusErr, "unable to update databaseBackup status")
+		}
+		// The backup is reconciled again when the secret is created
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	dumper, err := newDumper(&databaseServer.Spec)
+	if err != nil {
+		log.Error(err, "unable to back up database server")
+		if err := r.setCondition(ctx, &backup, databasev1alpha1.ConditionBackupScheduled, corev1.ConditionFalse, "UnsupportedServerType", err.Error()); err != nil {
+			log.Error(err, "unable to update databaseBackup status")
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+
+	// Copy the password of the database user next to the jobs using it
+	if err := writeCredentials(ctx, r.Client, r.Scheme, &backup, dbSecret.Data["password"]); err != nil {
+		log.Error(err, "unable to write credentials secret")
+		reason := "SecretCreationFailed"
+		if errors.Is(err, errCredentialsNotOwned) {
+			reason = "SecretNotOwned"
+		}
+		if statusErr := r.setCondition(ctx, &backup, databasev1alpha1.ConditionBackupScheduled, corev1.ConditionFalse, reason, err.Error()); statusErr != nil {
+			log.Error(statusErr, "unable to update databaseBackup status")
+		}
+		return ctrl.Result{}, err
+	}
+
+	tool := dumper.DumpTool(db.Database{Name: database.Spec.Name, Username: string(dbSecret.Data["username"])}, credentialsPassword(&backup))
+	jobSpec := backupJobSpec(&backup, tool)
+	labels := map[string]string{backupLabel: backup.Name, databasev1alpha1.WatchLabel: "true"}
+	jobSpec.Template.Labels = labels
+
+	if msg, err := r.scheduleBackup(ctx, &backup, jobSpec, labels); err != nil {
+		log.Error(err, msg)
+		if statusErr := r.setCondition(ctx, &backup, databasev1alpha1.ConditionBackupScheduled, corev1.ConditionFalse, "JobCreationFailed", fmt.Sprintf("%s: %v", msg, err)); statusErr != nil {
+			log.Error(statusErr, "unable to update databaseBackup status")
+		}
+		return ctrl.Result{}, err
+	}
+	msg = fmt.Sprintf("Job %s backs up database %s", backup.Name, database.Spec.Name)
+	if backup.Spec.Schedule != "" {
+		msg = fmt.Sprintf("Cron job %s backs up database %s on schedule %q", backup.Name, database.Spec.Name, backup.Spec.Schedule)
+	}
+	if err := r.setCondition(ctx, &backup, databasev1alpha1.ConditionBackupScheduled, corev1.ConditionTrue, "Scheduled", msg); err != nil {
+		log.Error(err, "unable to update databaseBackup status")
+		return ctrl.Result{}, err
+	}
+
+	if err := r.recordBackups(ctx, &backup); err != nil {
+		log.Error(err, "unable to record backups")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// newDumper returns the driver of a database server if it is able to dump databases
+func newDumper(spec *databasev1alpha1.DatabaseServerSpec) (db.Dumper, error) {
+	driver, err := db.New(spec, "")
+	if err != nil {
+		return nil, err
+	}
+	dumper, ok := driver.(db.Dumper)
+	if !ok {
+		return nil, fmt.Errorf("%w: no dump tools for %q", db.ErrUnsupportedType, spec.Type)
+	}
+	return dumper, nil
+}
+
+// scheduleBackup creates the job of a one-shot backup, or creates or updates the cron job of a scheduled one
+func (r *DatabaseBackupReconciler) scheduleBackup(ctx context.Context, backup *databasev1alpha1.DatabaseBackup, jobSpec batchv1.JobSpec, labels map[string]string) (string, error) {
+	key := types.NamespacedName{Namespace: backup.Namespace, Name: backup.Name}
+	cronJob := &batchv1beta1.CronJob{ObjectMeta: metav1.ObjectMeta{Name: backup.Name, Namespace: backup.Namespace}}
+
+	if backup.Spec.Schedule == "" {
+		// The backup no longer has a schedule
+		if err := r.Delete(ctx, cronJob, client.PropagationPolicy(metav1.DeletePropagationBackground)); err != nil && !apierrors.IsNotFound(err) {
+			return "unable to delete cron job", err
+		}
+
+		// A one-shot backup runs once, so an existing job is left as it is
+		var job batchv1.Job
+		if err := r.Get(ctx, key, &job); err == nil {
+			return "Job exists", nil
+		} else if !apierrors.IsNotFound(err) {
+			return "unable to get job", err
+		}
+		job = batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{Name: backup.Name, Namespace: backup.Namespace, Labels: labels},
+			Spec:       jobSpec,
+		}
+		if err := ctrl.SetControllerReference(backup, &job, r.Scheme); err != nil {
+			return "unable to set owner of job", err
+		}
+		if err := r.Create(ctx, &job); err != nil {
+			return "unable to create job", err
+		}
+		r.Recorder.Eventf(backup, corev1.EventTypeNormal, "JobCreated", "Created job %s", job.Name)
+		return "Job created", nil
+	}
+
+	if _, err := controllerutil.CreateOrUpdate(ctx, r.Client, cronJob, func() error {
+		cronJob.Labels = labels
+		cronJob.Spec.Schedule = backup.Spec.Schedule
+		cronJob.Spec.ConcurrencyPolicy = batchv1beta1.ForbidConcurrent
+		cronJob.Spec.JobTemplate = batchv1beta1.JobTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{Labels: labels},
+			Spec:       jobSpec,
+		}
+		return ctrl.SetControllerReference(backup, cronJob, r.Scheme)
+	}); err != nil {
+		return "unable to write cron job", err
+	}
+	return "Cron job written", nil
+}
+
+// recordBackups records the most recent finished backup in the status, and the most recent successful one
+func (r *DatabaseBackupReconciler) recordBackups(ctx context.Context, backup *databasev1alpha1.DatabaseBackup) error {
+	var jobs batchv1.JobList
+	if err := r.List(ctx, &jobs, client.InNamespace(backup.Namespace), client.MatchingLabels{backupLabel: backup.Name}); err != nil {
+		return err
+	}
+
+	var last, lastSuccessful *batchv1.Job
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		finished, succeeded := jobFinished(job)
+		if !finished || job.Status.StartTime == nil {
+			continue
+		}
+		if last == nil || last.Status.StartTime.Before(job.Status.StartTime) {
+			last = job
+		}
+		if succeeded && (lastSuccessful == nil || lastSuccessful.Status.StartTime.Before(job.Status.StartTime)) {
+			lastSuccessful = job
+		}
+	}
+	if last == nil {
+		return r.setCondition(ctx, backup, databasev1alpha1.ConditionBackupCompleted, corev1.ConditionUnknown, "Waiting", "No backup has finished yet")
+	}
+
+	lastRecord, err := r.backupRecord(ctx, backup, last)
+	if err != nil {
+		return err
+	}
+	var lastSuccessfulRecord *databasev1alpha1.BackupRecord
+	if lastSuccessful != nil {
+		if lastSuccessfulRecord, err = r.backupRecord(ctx, backup, lastSuccessful); err != nil {
+			return err
+		}
+	}
+
+	if !reflect.DeepEqual(backup.Status.LastBackup, lastRecord) || !reflect.DeepEqual(backup.Status.LastSuccessfulBackup, lastSuccessfulRecord) {
+		if lastSuccessfulRecord != nil && (backup.Status.LastSuccessfulBackup == nil || backup.Status.LastSuccessfulBackup.Job != lastSuccessfulRecord.Job) {
+			r.Recorder.Eventf(backup, corev1.EventTypeNormal, "BackupSucceeded", "Database dumped to %s", lastSuccessfulRecord.File)
+		}
+		if !lastRecord.Succeeded && (backup.Status.LastBackup == nil || backup.Status.LastBackup.Job != lastRecord.Job) {
+			r.Recorder.Eventf(backup, corev1.EventTypeWarning, "BackupFailed", "Job %s failed", lastRecord.Job)
+		}
+		backup.Status.LastBackup = lastRecord
+		backup.Status.LastSuccessfulBackup = lastSuccessfulRecord
+		if err := r.Status().Update(ctx, backup); err != nil {
+			return err
+		}
+	}
+
+	if !lastRecord.Succeeded {
+		return r.setCondition(ctx, backup, databasev1alpha1.ConditionBackupCompleted, corev1.ConditionFalse, "BackupFailed", fmt.Sprintf("Job %s failed, see the logs of its pods", lastRecord.Job))
+	}
+	return r.setCondition(ctx, backup, databasev1alpha1.ConditionBackupCompleted, corev1.ConditionTrue, "BackupSucceeded", fmt.Sprintf("Database dumped to %s", lastRecord.File))
+}
+
+// backupRecord describes the backup made by a finished job, with the location of the dump taken from the
+// termination message of the container storing it
+func (r *DatabaseBackupReconciler) backupRecord(ctx context.Context, backup *databasev1alpha1.DatabaseBackup, job *batchv1.Job) (*databasev1alpha1.BackupRecord, error) {
+	_, succeeded := jobFinished(job)
+	record := &databasev1alpha1.BackupRecord{
+		Job:            job.Name,
+		StartTime:      job.Status.StartTime,
+		CompletionTime: job.Status.CompletionTime,
+		Succeeded:      succeeded,
+	}
+	if !succeeded {
+		return record, nil
+	}
+	// The file of a job recorded before is not looked up again
+	for _, previous := range []*databasev1alpha1.BackupRecord{backup.Status.LastBackup, backup.Status.LastSuccessfulBackup} {
+		if previous != nil && previous.Job == job.Name && previous.File != "" {
+			record.File = previous.File
+			return record, nil
+		}
+	}
+
+	var pods corev1.PodList
+	if err := r.APIReader.List(ctx, &pods, client.InNamespace(job.Namespace), client.MatchingLabels{"job-name": job.Name}); err != nil {
+		return nil, err
+	}
+	for i := range pods.Items {
+		if file := terminationMessage(&pods.Items[i], "store"); file != "" {
+			record.File = file
+		}
+	}
+	return record, nil
+}
+
+// databaseBackupConditions must all be true for a database backup to be ready
+var databaseBackupConditions = []string{
+	databasev1alpha1.ConditionDatabaseReady,
+	databasev1alpha1.ConditionBackupScheduled,
+	databasev1alpha1.ConditionBackupCompleted,
+}
+
+// setCondition records the state of the backup, summarizes it into the Ready condition and phase,
+// and writes the status if anything changed
+func (r *DatabaseBackupReconciler) setCondition(ctx context.Context, backup *databasev1alpha1.DatabaseBackup, conditionType string, status corev1.ConditionStatus, reason, message string) error {
+	changed := databasev1alpha1.SetCondition(&backup.Status.Conditions, databasev1alpha1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		ObservedGeneration: backup.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+
+	phase, readyChanged := summarizeConditions(&backup.Status.Conditions, backup.Generation, databaseBackupConditions)
+	if !changed && !readyChanged && backup.Status.Phase == phase && backup.Status.ObservedGeneration == backup.Generation {
+		return nil
+	}
+	backup.Status.Phase = phase
+	backup.Status.ObservedGeneration = backup.Generation
+	return r.Status().Update(ctx, backup)
+}
+
+func (r *DatabaseBackupReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&databasev1alpha1.DatabaseBackup{}).
+		Owns(&batchv1beta1.CronJob{}).
+		// Jobs of a cron job are owned by the cron job, so they are mapped to their backup by label
+		Watches(&source.Kind{Type: &batchv1.Job{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(func(object handler.MapObject) []reconcile.Request {
+				name, ok := object.Meta.GetLabels()[backupLabel]
+				if !ok {
+					return nil
+				}
+				return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: object.Meta.GetNamespace(), Name: name}}}
+			}),
+		}).
+		// The credentials copied next to the jobs are refreshed when the database or its secret changes
+		Watches(&source.Kind{Type: &databasev1alpha1.Database{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: databaseDependentRequests(mgr.GetClient(), &databasev1alpha1.DatabaseBackupList{}),
+		}).
+		Watches(&source.Kind{Type: &databasev1alpha1.DatabaseServer{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: serverDependentRequests(mgr.GetClient(), &databasev1alpha1.DatabaseBackupList{}, databasev1alpha1.DatabaseServerKind),
+		}).
+		Watches(&source.Kind{Type: &databasev1alpha1.ClusterDatabaseServer{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: serverDependentRequests(mgr.GetClient(), &databasev1alpha1.DatabaseBackupList{}, databasev1alpha1.ClusterDatabaseServerKind),
+		}).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: secretDependentRequests(mgr.GetClient(), &databasev1alpha1.DatabaseBackupList{}),
+		}).
+		Complete(r)
+}
@@ -0,0 +1,259 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+)
+
+// errInvalidClaim is returned when a claim can not be bound until it is updated
+var errInvalidClaim = errors.New("invalid claim")
+
+// DatabaseClaimReconciler reconciles a DatabaseClaim object
+type DatabaseClaimReconciler struct {
+	client.Client
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+}
+
+// +kubebuilder:rbac:groups=database.stacc.com,resources=databaseclaims,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=database.stacc.com,resources=databaseclaims/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=database.stacc.com,resources=databaseclasses,verbs=get;list;watch
+// +kubebuilder:rbac:groups=database.stacc.com,resources=databases,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+// Reconcile DatabaseClaim
+func (r *DatabaseClaimReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.Background()
+	log := r.Log.WithValues("databaseclaim", req.NamespacedName)
+
+	var claim databasev1alpha1.DatabaseClaim
+	if err := r.Get(ctx, req.NamespacedName, &claim); err != nil {
+		log.Info("Unable to get databaseClaim resource")
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	// The database is deleted by the garbage collector, according to its reclaim policy
+	if !claim.ObjectMeta.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	var class databasev1alpha1.DatabaseClass
+	if err := r.Get(ctx, client.ObjectKey{Name: claim.Spec.ClassName}, &class); err != nil {
+		log.Error(err, "unable to get databaseClass resource")
+		if statusErr := r.setCondition(ctx, &claim, databasev1alpha1.ConditionBound, corev1.ConditionFalse, "ClassNotFound", err.Error()); statusErr != nil {
+			log.Error(statusErr, "unable to update databaseClaim status")
+		}
+		// The claim is reconciled again when the class is created
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	// A claim is bound once, later changes to the class or its servers only apply to new claims
+	var database databasev1alpha1.Database
+	err := r.Get(ctx, req.NamespacedName, &database)
+	if err != nil && !apierrors.IsNotFound(err) {
+		log.Error(err, "unable to get database resource")
+		return ctrl.Result{}, err
+	}
+	if apierrors.IsNotFound(err) {
+		msg, err := r.bind(ctx, &claim, &class, &database)
+		if err != nil {
+			log.Error(err, msg)
+			if statusErr := r.setCondition(ctx, &claim, databasev1alpha1.ConditionBound, corev1.ConditionFalse, "BindFailed", fmt.Sprintf("%s: %v", msg, err)); statusErr != nil {
+				log.Error(statusErr, "unable to update databaseClaim status")
+			}
+			// Nothing changes until an invalid claim is updated
+			if errors.Is(err, errInvalidClaim) {
+				return ctrl.Result{}, nil
+			}
+			return ctrl.Result{}, err
+		}
+		r.Recorder.Eventf(&claim, corev1.EventTypeNormal, "Bound", "Created database %s/%s", database.Namespace, database.Name)
+	} else if !metav1.IsControlledBy(&database, &claim) {
+		msg := fmt.Sprintf("Database %s/%s already exists and does not belong to the claim", database.Namespace, database.Name)
+		if err := r.setCondition(ctx, &claim, databasev1alpha1.ConditionBound, corev1.ConditionFalse, "DatabaseConflict", msg); err != nil {
+			log.Error(err, "unable to update databaseClaim status")
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	} else if privileges := claimPrivileges(&claim, &class); !equality.Semantic.DeepEqual(database.Spec.Privileges, privileges) {
+		database.Spec.Privileges = privileges
+		if err := r.Update(ctx, &database); err != nil {
+			log.Error(err, "unable to update database resource")
+			return ctrl.Result{}, err
+		}
+	}
+
+	// The server is known once the database has been placed
+	if claim.Status.Database != database.Name || !equality.Semantic.DeepEqual(claim.Status.Server, database.Status.Server) {
+		claim.Status.Database = database.Name
+		claim.Status.Server = database.Status.Server
+		if err := r.Status().Update(ctx, &claim); err != nil {
+			log.Error(err, "unable to update databaseClaim status")
+			return ctrl.Result{}, err
+		}
+	}
+	msg := fmt.Sprintf("Bound to database %s/%s", database.Namespace, database.Name)
+	if err := r.setCondition(ctx, &claim, databasev1alpha1.ConditionBound, corev1.ConditionTrue, "Bound", msg); err != nil {
+		log.Error(err, "unable to update databaseClaim status")
+		return ctrl.Result{}, err
+	}
+
+	// The claim is reconciled again when the database changes
+	if ready := databasev1alpha1.FindCondition(database.Status.Conditions, databasev1alpha1.ConditionReady); ready == nil || ready.Status != corev1.ConditionTrue {
+		msg := fmt.Sprintf("Database %s/%s is not ready", database.Namespace, database.Name)
+		if ready != nil && ready.Message != "" {
+			msg = fmt.Sprintf("%s: %s", msg, ready.Message)
+		}
+		if err := r.setCondition(ctx, &claim, databasev1alpha1.ConditionDatabaseReady, corev1.ConditionFalse, "DatabaseNotReady", msg); err != nil {
+			log.Error(err, "unable to update databaseClaim status")
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+	msg = fmt.Sprintf("Database %s/%s is ready, credentials are in secret %s", database.Namespace, database.Name, database.Spec.Secret.Name)
+	if err := r.setCondition(ctx, &claim, databasev1alpha1.ConditionDatabaseReady, corev1.ConditionTrue, "DatabaseReady", msg); err != nil {
+		log.Error(err, "unable to update databaseClaim status")
+		return ctrl.Result{}, err
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// bind creates the database resource of a claim, placed on one of the servers selected by its class
+func (r *DatabaseClaimReconciler) bind(ctx context.Context, claim *databasev1alpha1.DatabaseClaim, class *databasev1alpha1.DatabaseClass, database *databasev1alpha1.Database) (string, error) {
+	name := claim.Spec.DatabaseName
+	if name == "" {
+		name = claimDatabaseName(claim)
+	} else if !class.Spec.AllowDatabaseName {
+		return "invalid claim", fmt.Errorf("%w: class %s does not allow claims to set databaseName", errInvalidClaim, class.Name)
+	}
+	secretName := claim.Spec.SecretName
+	if secretName == "" {
+		secretName = claim.Name + "-credentials"
+	}
+	reclaimPolicy := class.Spec.ReclaimPolicy
+	if reclaimPolicy == "" {
+		reclaimPolicy = "delete"
+	}
+	// Every server of the type is selected when the class has no selector
+	selector := class.Spec.ServerSelector
+	if selector == nil {
+		selector = &metav1.LabelSelector{}
+	}
+
+	*database = databasev1alpha1.Database{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      claim.Name,
+			Namespace: claim.Namespace,
+		},
+		Spec: databasev1alpha1.DatabaseSpec{
+			ServerSelector: selector,
+			ServerType:     class.Spec.Type,
+			Placement:      class.Spec.Placement,
+			Name:           name,
+			Username:       claim.Spec.Username,
+			Secret:         databasev1alpha1.Secret{Name: secretName, Namespace: claim.Namespace},
+			SecretTemplate: class.Spec.SecretTemplate,
+			ReclaimPolicy:  reclaimPolicy,
+			Privileges:     claimPrivileges(claim, class),
+		},
+	}
+	if err := ctrl.SetControllerReference(claim, database, r.Scheme); err != nil {
+		return "unable to set owner of database resource", err
+	}
+	if err := r.Create(ctx, database); err != nil {
+		return "unable to create database resource", err
+	}
+	return "", nil
+}
+
+// claimDatabaseName returns the generated name of the database of a claim on the server, <namespace>-<name> of the claim followed
+// by the start of its UID. Joining namespace and name alone is ambiguous, e.g. for claims a-b/c and a/b-c.
+func claimDatabaseName(claim *databasev1alpha1.DatabaseClaim) string {
+	uid := strings.ReplaceAll(string(claim.UID), "-", "")
+	if len(uid) > 8 {
+		uid = uid[:8]
+	}
+	name := fmt.Sprintf("%s-%s", claim.Namespace, claim.Name)
+	if max := 63 - len(uid) - 1; len(name) > max {
+		name = name[:max]
+	}
+	return name + "-" + uid
+}
+
+// claimPrivileges returns the privileges of the user of a claimed database
+func claimPrivileges(claim *databasev1alpha1.DatabaseClaim, class *databasev1alpha1.DatabaseClass) *databasev1alpha1.Privileges {
+	if claim.Spec.Privileges != nil {
+		return claim.Spec.Privileges
+	}
+	return class.Spec.Privileges
+}
+
+// databaseClaimConditions must all be true for a database claim to be ready
+var databaseClaimConditions = []string{
+	databasev1alpha1.ConditionBound,
+	databasev1alpha1.ConditionDatabaseReady,
+}
+
+// setCondition records the outcome of a provisioning step, summarizes it into the Ready condition and phase,
+// and writes the status if anything changed
+func (r *DatabaseClaimReconciler) setCondition(ctx context.Context, claim *databasev1alpha1.DatabaseClaim, conditionType string, status corev1.ConditionStatus, reason, message string) error {
+	changed := databasev1alpha1.SetCondition(&claim.Status.Conditions, databasev1alpha1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		ObservedGeneration: claim.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+
+	phase, readyChanged := summarizeConditions(&claim.Status.Conditions, claim.Generation, databaseClaimConditions)
+
+	if !changed && !readyChanged && claim.Status.Phase == phase && claim.Status.ObservedGeneration == claim.Generation {
+		return nil
+	}
+	claim.Status.Phase = phase
+	claim.Status.ObservedGeneration = claim.Generation
+	return r.Status().Update(ctx, claim)
+}
+
+func (r *DatabaseClaimReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&databasev1alpha1.DatabaseClaim{}).
+		Owns(&databasev1alpha1.Database{}).
+		Watches(&source.Kind{Type: &databasev1alpha1.DatabaseClass{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: classClaimRequests(mgr.GetClient()),
+		}).
+		Complete(r)
+}
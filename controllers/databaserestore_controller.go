@@ -0,0 +1,365 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+	db "flow.stacc.dev/database-provisioning-poc/pkg/db"
+	"flow.stacc.dev/database-provisioning-poc/pkg/secrets"
+	"flow.stacc.dev/database-provisioning-poc/pkg/servers"
+)
+
+// restoreLabel is set on databases created for a restore to the name of the DatabaseRestore
+const restoreLabel = "database.stacc.com/restore"
+
+var (
+	// errInvalidTarget is returned when the database to restore into can not be used until the restore or database is changed
+	errInvalidTarget = errors.New("invalid target")
+	// errNoSource is returned when there is no dump to restore until the restore or backup is changed
+	errNoSource = errors.New("no dump to restore")
+)
+
+// DatabaseRestoreReconciler reconciles a DatabaseRestore object
+type DatabaseRestoreReconciler struct {
+	client.Client
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+}
+
+// +kubebuilder:rbac:groups=database.stacc.com,resources=databaserestores,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=database.stacc.com,resources=databaserestores/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=database.stacc.com,resources=databases,verbs=get;list;watch;create
+// +kubebuilder:rbac:groups=database.stacc.com,resources=databasebackups,verbs=get;list;watch
+// +kubebuilder:rbac:groups=database.stacc.com,resources=databaseservers,verbs=get;list;watch
+// +kubebuilder:rbac:groups=database.stacc.com,resources=clusterdatabaseservers,verbs=get;list;watch
+// +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+// Reconcile DatabaseRestore
+func (r *DatabaseRestoreReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.Background()
+	log := r.Log.WithValues("databaserestore", req.NamespacedName)
+
+	var restore databasev1alpha1.DatabaseRestore
+	if err := r.Get(ctx, req.NamespacedName, &restore); err != nil {
+		log.Info("Unable to get databaseRestore resource")
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if !restore.ObjectMeta.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	// A restore runs once
+	if completed := databasev1alpha1.FindCondition(restore.Status.Conditions, databasev1alpha1.ConditionRestoreCompleted); completed != nil &&
+		(completed.Status == corev1.ConditionTrue || completed.Reason == "RestoreFailed") {
+		return ctrl.Result{}, nil
+	}
+
+	// Only databases in the namespace of the restore are overwritten, others belong to other tenants
+	if restore.Spec.Database != nil && !restore.Spec.Database.InNamespace(restore.Namespace) {
+		msg := fmt.Sprintf("Database %s/%s is not in namespace %s of the restore", restore.Spec.Database.Namespace, restore.Spec.Database.Name, restore.Namespace)
+		if err := r.setCondition(ctx, &restore, databasev1alpha1.ConditionDatabaseReady, corev1.ConditionFalse, "DatabaseNamespaceNotAllowed", msg); err != nil {
+			log.Error(err, "unable to update databaseRestore status")
+			return ctrl.Result{}, err
+		}
+		// Nothing changes until the database is updated
+		return ctrl.Result{}, nil
+	}
+
+	database, msg, err := r.targetDatabase(ctx, &restore)
+	if err != nil {
+		log.Error(err, msg)
+		if statusErr := r.setCondition(ctx, &restore, databasev1alpha1.ConditionDatabaseReady, corev1.ConditionFalse, "InvalidTarget", fmt.Sprintf("%s: %v", msg, err)); statusErr != nil {
+			log.Error(statusErr, "unable to update databaseRestore status")
+		}
+		// The restore is reconciled again when it or the database changes
+		if errors.Is(err, errInvalidTarget) {
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if database == nil {
+		// Database created, the restore is reconciled again when it is provisioned
+		if err := r.setCondition(ctx, &restore, databasev1alpha1.ConditionDatabaseReady, corev1.ConditionUnknown, "DatabaseCreated", msg); err != nil {
+			log.Error(err, "unable to update databaseRestore status")
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+	if restore.Spec.Database != nil && restore.Spec.Confirm != database.Spec.Name {
+		msg := fmt.Sprintf("Restoring replaces the data in database %s, set confirm to %q to continue", database.Spec.Name, database.Spec.Name)
+		if err := r.setCondition(ctx, &restore, databasev1alpha1.ConditionDatabaseReady, corev1.ConditionFalse, "ConfirmationRequired", msg); err != nil {
+			log.Error(err, "unable to update databaseRestore status")
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+	if !databasev1alpha1.IsConditionTrue(database.Status.Conditions, databasev1alpha1.ConditionReady) {
+		log.Info("Database not ready")
+		msg := fmt.Sprintf("Database %s/%s is not ready", database.Namespace, database.Name)
+		if err := r.setCondition(ctx, &restore, databasev1alpha1.ConditionDatabaseReady, corev1.ConditionFalse, "DatabaseNotReady", msg); err != nil {
+			log.Error(err, "unable to update databaseRestore status")
+			return ctrl.Result{}, err
+		}
+		// The restore is reconciled again when the database becomes ready
+		return ctrl.Result{}, nil
+	}
+	restore.Status.Database = database.Name
+	msg = fmt.Sprintf("Database %s/%s is ready", database.Namespace, database.Name)
+	if err := r.setCondition(ctx, &restore, databasev1alpha1.ConditionDatabaseReady, corev1.ConditionTrue, "DatabaseReady", msg); err != nil {
+		log.Error(err, "unable to update databaseRestore status")
+		return ctrl.Result{}, err
+	}
+
+	// The job is left as it is once created
+	var job batchv1.Job
+	if err := r.Get(ctx, req.NamespacedName, &job); err == nil {
+		return r.recordRestore(ctx, &restore, &job)
+	} else if !apierrors.IsNotFound(err) {
+		return ctrl.Result{}, err
+	}
+
+	storage, file, msg, err := r.source(ctx, &restore)
+	if err != nil {
+		log.Error(err, msg)
+		if statusErr := r.setCondition(ctx, &restore, databasev1alpha1.ConditionRestoreCompleted, corev1.ConditionFalse, "SourceUnavailable", fmt.Sprintf("%s: %v", msg, err)); statusErr != nil {
+			log.Error(statusErr, "unable to update databaseRestore status")
+		}
+		// The restore is reconciled again when it or the backup changes
+		if errors.Is(err, errNoSource) {
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	databaseServer, err := servers.Get(ctx, r, servers.DatabaseRef(database))
+	if err != nil {
+		log.Error(err, "unable to get databaseServer resource")
+		if statusErr := r.setCondition(ctx, &restore, databasev1alpha1.ConditionRestoreCompleted, corev1.ConditionFalse, "ServerNotFound", err.Error()); statusErr != nil {
+			log.Error(statusErr, "unable to update databaseRestore status")
+		}
+		// The restore is reconciled again when the server is created
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	// The restore runs as the user of the database, like the dump
+	dbSecret, err := secrets.Get(ctx, r, database.Spec.Secret)
+	if err != nil {
+		log.Error(err, "Error obtaining secret")
+		if statusErr := r.setCondition(ctx, &restore, databasev1alpha1.ConditionRestoreCompleted, corev1.ConditionFalse, "DatabaseSecretUnavailable", err.Error()); statusErr != nil {
+			log.Error(statusErr, "unable to update databaseRestore status")
+		}
+		// The restore is reconciled again when the secret is created
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	dumper, err := newDumper(&databaseServer.Spec)
+	if err != nil {
+		log.Error(err, "unable to restore to database server")
+		if err := r.setCondition(ctx, &restore, databasev1alpha1.ConditionRestoreCompleted, corev1.ConditionFalse, "UnsupportedServerType", err.Error()); err != nil {
+			log.Error(err, "unable to update databaseRestore status")
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+	if err := writeCredentials(ctx, r.Client, r.Scheme, &restore, dbSecret.Data["password"]); err != nil {
+		log.Error(err, "unable to write credentials secret")
+		reason := "SecretCreationFailed"
+		if errors.Is(err, errCredentialsNotOwned) {
+			reason = "SecretNotOwned"
+		}
+		if statusErr := r.setCondition(ctx, &restore, databasev1alpha1.ConditionRestoreCompleted, corev1.ConditionFalse, reason, err.Error()); statusErr != nil {
+			log.Error(statusErr, "unable to update databaseRestore status")
+		}
+		return ctrl.Result{}, err
+	}
+
+	tool := dumper.DumpTool(db.Database{Name: database.Spec.Name, Username: string(dbSecret.Data["username"])}, credentialsPassword(&restore))
+	job = batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: restore.Name, Namespace: restore.Namespace, Labels: map[string]string{databasev1alpha1.WatchLabel: "true"}},
+		Spec:       restoreJobSpec(&restore, storage, file, tool),
+	}
+	if err := ctrl.SetControllerReference(&restore, &job, r.Scheme); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := r.Create(ctx, &job); err != nil {
+		log.Error(err, "unable to create job")
+		if statusErr := r.setCondition(ctx, &restore, databasev1alpha1.ConditionRestoreCompleted, corev1.ConditionFalse, "JobCreationFailed", err.Error()); statusErr != nil {
+			log.Error(statusErr, "unable to update databaseRestore status")
+		}
+		return ctrl.Result{}, err
+	}
+	r.Recorder.Eventf(&restore, corev1.EventTypeNormal, "RestoreStarted", "Restoring %s into database %s with job %s", file, database.Spec.Name, job.Name)
+
+	now := metav1.Now()
+	restore.Status.File = file
+	restore.Status.StartTime = &now
+	if err := r.Status().Update(ctx, &restore); err != nil {
+		log.Error(err, "unable to update databaseRestore status")
+		return ctrl.Result{}, err
+	}
+	return r.recordRestore(ctx, &restore, &job)
+}
+
+// targetDatabase returns the database to restore into. A database which has to be created first is
+// created, and nil returned until the next reconcile.
+func (r *DatabaseRestoreReconciler) targetDatabase(ctx context.Context, restore *databasev1alpha1.DatabaseRestore) (*databasev1alpha1.Database, string, error) {
+	if (restore.Spec.Database == nil) == (restore.Spec.NewDatabase == nil) {
+		return nil, "invalid target", fmt.Errorf("%w: exactly one of database and newDatabase must be set", errInvalidTarget)
+	}
+
+	var database databasev1alpha1.Database
+	if restore.Spec.Database != nil {
+		key := client.ObjectKey{Namespace: restore.Namespace, Name: restore.Spec.Database.Name}
+		if err := r.Get(ctx, key, &database); err != nil {
+			return nil, "unable to get database resource", err
+		}
+		return &database, "", nil
+	}
+
+	key := client.ObjectKey{Namespace: restore.Namespace, Name: restore.Spec.NewDatabase.Name}
+	if err := r.Get(ctx, key, &database); err == nil {
+		// Only a database created by this restore is restored into without confirmation
+		if database.Labels[restoreLabel] != restore.Name {
+			return nil, "unable to create database resource", fmt.Errorf("%w: database %s already exists, restore into it with database and confirm instead", errInvalidTarget, key.Name)
+		}
+		return &database, "", nil
+	} else if !apierrors.IsNotFound(err) {
+		return nil, "unable to get database resource", err
+	}
+
+	database = databasev1alpha1.Database{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      key.Name,
+			Namespace: key.Namespace,
+			Labels:    map[string]string{restoreLabel: restore.Name},
+		},
+		Spec: restore.Spec.NewDatabase.Spec,
+	}
+	if err := r.Create(ctx, &database); err != nil {
+		return nil, "unable to create database resource", err
+	}
+	r.Recorder.Eventf(restore, corev1.EventTypeNormal, "DatabaseCreated", "Created database %s to restore into", database.Name)
+	return nil, fmt.Sprintf("Created database %s/%s, waiting for it to be provisioned", database.Namespace, database.Name), nil
+}
+
+// source returns the storage and location of the dump to restore
+func (r *DatabaseRestoreReconciler) source(ctx context.Context, restore *databasev1alpha1.DatabaseRestore) (databasev1alpha1.BackupStorage, string, string, error) {
+	source := restore.Spec.Source
+	if source.Backup != "" {
+		var backup databasev1alpha1.DatabaseBackup
+		if err := r.Get(ctx, client.ObjectKey{Namespace: restore.Namespace, Name: source.Backup}, &backup); err != nil {
+			return databasev1alpha1.BackupStorage{}, "", "unable to get databaseBackup resource", err
+		}
+		if backup.Status.LastSuccessfulBackup == nil || backup.Status.LastSuccessfulBackup.File == "" {
+			return databasev1alpha1.BackupStorage{}, "", "unable to restore backup", fmt.Errorf("%w: backup %s has no successful dump", errNoSource, backup.Name)
+		}
+		return backup.Spec.Storage, backup.Status.LastSuccessfulBackup.File, "", nil
+	}
+
+	if source.Storage == nil || source.File == "" {
+		return databasev1alpha1.BackupStorage{}, "", "invalid source", fmt.Errorf("%w: either backup or storage and file must be set", errNoSource)
+	}
+	if err := validateStorage(*source.Storage); err != nil {
+		return databasev1alpha1.BackupStorage{}, "", "invalid source", fmt.Errorf("%w: %v", errNoSource, err)
+	}
+	return *source.Storage, source.File, "", nil
+}
+
+// recordRestore records the outcome of the restore job
+func (r *DatabaseRestoreReconciler) recordRestore(ctx context.Context, restore *databasev1alpha1.DatabaseRestore, job *batchv1.Job) (ctrl.Result, error) {
+	finished, succeeded := jobFinished(job)
+	if !finished {
+		msg := fmt.Sprintf("Job %s is restoring %s", job.Name, restore.Status.File)
+		return ctrl.Result{}, r.setCondition(ctx, restore, databasev1alpha1.ConditionRestoreCompleted, corev1.ConditionUnknown, "Restoring", msg)
+	}
+
+	now := metav1.Now()
+	restore.Status.CompletionTime = &now
+	if !succeeded {
+		r.Recorder.Eventf(restore, corev1.EventTypeWarning, "RestoreFailed", "Job %s failed", job.Name)
+		msg := fmt.Sprintf("Job %s failed, see the logs of its pod", job.Name)
+		return ctrl.Result{}, r.setCondition(ctx, restore, databasev1alpha1.ConditionRestoreCompleted, corev1.ConditionFalse, "RestoreFailed", msg)
+	}
+	r.Recorder.Eventf(restore, corev1.EventTypeNormal, "Restored", "Restored %s into database %s", restore.Status.File, restore.Status.Database)
+	msg := fmt.Sprintf("Restored %s", restore.Status.File)
+	return ctrl.Result{}, r.setCondition(ctx, restore, databasev1alpha1.ConditionRestoreCompleted, corev1.ConditionTrue, "Restored", msg)
+}
+
+// databaseRestoreConditions must all be true for a database restore to be ready
+var databaseRestoreConditions = []string{
+	databasev1alpha1.ConditionDatabaseReady,
+	databasev1alpha1.ConditionRestoreCompleted,
+}
+
+// setCondition records the state of the restore, summarizes it into the Ready condition and phase,
+// and writes the status if anything changed
+func (r *DatabaseRestoreReconciler) setCondition(ctx context.Context, restore *databasev1alpha1.DatabaseRestore, conditionType string, status corev1.ConditionStatus, reason, message string) error {
+	changed := databasev1alpha1.SetCondition(&restore.Status.Conditions, databasev1alpha1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		ObservedGeneration: restore.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+
+	phase, readyChanged := summarizeConditions(&restore.Status.Conditions, restore.Generation, databaseRestoreConditions)
+	if !changed && !readyChanged && restore.Status.Phase == phase && restore.Status.ObservedGeneration == restore.Generation {
+		return nil
+	}
+	restore.Status.Phase = phase
+	restore.Status.ObservedGeneration = restore.Generation
+	return r.Status().Update(ctx, restore)
+}
+
+func (r *DatabaseRestoreReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&databasev1alpha1.DatabaseRestore{}).
+		Owns(&batchv1.Job{}).
+		Watches(&source.Kind{Type: &databasev1alpha1.Database{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: databaseDependentRequests(mgr.GetClient(), &databasev1alpha1.DatabaseRestoreList{}),
+		}).
+		Watches(&source.Kind{Type: &databasev1alpha1.DatabaseBackup{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: backupRestoreRequests(mgr.GetClient()),
+		}).
+		Watches(&source.Kind{Type: &databasev1alpha1.DatabaseServer{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: serverDependentRequests(mgr.GetClient(), &databasev1alpha1.DatabaseRestoreList{}, databasev1alpha1.DatabaseServerKind),
+		}).
+		Watches(&source.Kind{Type: &databasev1alpha1.ClusterDatabaseServer{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: serverDependentRequests(mgr.GetClient(), &databasev1alpha1.DatabaseRestoreList{}, databasev1alpha1.ClusterDatabaseServerKind),
+		}).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: secretDependentRequests(mgr.GetClient(), &databasev1alpha1.DatabaseRestoreList{}),
+		}).
+		Complete(r)
+}
@@ -18,34 +18,41 @@ package controllers
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 
 	"github.com/go-logr/logr"
 	"k8s.io/apimachinery/pkg/runtime"
-	k8s "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
 	db "flow.stacc.dev/database-provisioning-poc/pkg/db"
-
-	kubernetes "flow.stacc.dev/database-provisioning-poc/pkg/kubernetes"
+	"flow.stacc.dev/database-provisioning-poc/pkg/secrets"
+	"flow.stacc.dev/database-provisioning-poc/pkg/servers"
 )
 
 // DatabaseServerReconciler reconciles a DatabaseServer object
 type DatabaseServerReconciler struct {
 	client.Client
-	Log                 logr.Logger
-	Scheme              *runtime.Scheme
-	KubernetesClient    *kubernetes.Client
-	KubernetesClientset *k8s.Clientset
+	Log         logr.Logger
+	Scheme      *runtime.Scheme
+	Recorder    record.EventRecorder
+	Connections *db.Connections
 }
 
 // +kubebuilder:rbac:groups=database.stacc.com,resources=databaseservers,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=database.stacc.com,resources=databaseservers/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 // Reconcile DatabaseServer
 func (r *DatabaseServerReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
@@ -54,92 +61,154 @@ func (r *DatabaseServerReconciler) Reconcile(req ctrl.Request) (ctrl.Result, err
 
 	var databaseServer databasev1alpha1.DatabaseServer
 	if err := r.Get(ctx, req.NamespacedName, &databaseServer); err != nil {
+		if apierrors.IsNotFound(err) {
+			// Close the pool of a deleted database server
+			r.Connections.Remove(req.NamespacedName)
+			forgetServer(databasev1alpha1.Server{Kind: databasev1alpha1.DatabaseServerKind, Name: req.Name, Namespace: req.Namespace})
+		}
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
-
-	secret, err := r.KubernetesClientset.CoreV1().Secrets(databaseServer.Spec.Secret.Namespace).Get(databaseServer.Spec.Secret.Name, metav1.GetOptions{})
-	if err != nil {
-		log.Error(err, "Error obtaining secret. Retrying in 10 seconds.")
-		return ctrl.Result{RequeueAfter: time.Second * 10}, client.IgnoreNotFound(err)
+	// Defaults are applied here as well, for clusters running without the defaulting webhook
+	databaseServer.Default()
+
+	// Databases being deleted need their server, so it is only deleted once no database is created on it
+	finalizer := "database.stacc.com/finalizer"
+	if !databaseServer.ObjectMeta.DeletionTimestamp.IsZero() {
+		if !containsString(databaseServer.ObjectMeta.Finalizers, finalizer) {
+			return ctrl.Result{}, nil
+		}
+		if blocked, err := serverDeletionBlocked(ctx, r, r.Recorder, &databaseServer, servers.RefTo(&databaseServer)); err != nil || blocked {
+			return ctrl.Result{}, err
+		}
+		r.Connections.Remove(req.NamespacedName)
+		forgetServer(servers.RefTo(&databaseServer))
+		databaseServer.ObjectMeta.Finalizers = removeString(databaseServer.ObjectMeta.Finalizers, finalizer)
+		return ctrl.Result{}, r.Update(ctx, &databaseServer)
 	}
-
-	if databaseServer.Spec.Type == "postgresql" || databaseServer.Spec.Type == "postgres" {
-		server := db.PostgresServer{
-			Username: databaseServer.Spec.Postgres.Username,
-			Password: string(secret.Data["password"]),
-			Host:     databaseServer.Spec.Postgres.Host,
-			Port:     databaseServer.Spec.Postgres.Port,
-			SslMode:  databaseServer.Spec.Postgres.SslMode,
+	if !containsString(databaseServer.ObjectMeta.Finalizers, finalizer) {
+		databaseServer.ObjectMeta.Finalizers = append(databaseServer.ObjectMeta.Finalizers, finalizer)
+		if err := r.Update(ctx, &databaseServer); err != nil {
+			log.Error(err, "unable to update databaseServer resource")
+			return ctrl.Result{}, err
 		}
+	}
 
-		if msg, err := server.Connect(); err != nil {
-			log.Error(err, msg)
-			databaseServer.Status.Connected = false
-			if err := r.Status().Update(ctx, &databaseServer); err != nil {
-				log.Error(err, "unable to update databaseServer status")
-				return ctrl.Result{}, err
-			}
-			return ctrl.Result{RequeueAfter: time.Minute}, nil
-		}
+	check := checkServer(ctx, log, r, r.Connections, &databaseServer)
+	recordServerCheck(servers.RefTo(&databaseServer), check)
+	if err := setServerReachable(ctx, r.Client, r.Recorder, &databaseServer, &databaseServer.Status, databaseServer.Generation, check); err != nil {
+		log.Error(err, "unable to update databaseServer status")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: check.requeueAfter}, nil
+}
 
-		defer server.Disconnect()
-	} else if databaseServer.Spec.Type == "mysql" {
-		server := db.MysqlServer{
-			Username: databaseServer.Spec.Mysql.Username,
-			Password: string(secret.Data["password"]),
-			Host:     databaseServer.Spec.Mysql.Host,
-			Port:     databaseServer.Spec.Mysql.Port,
-			Ssl:      databaseServer.Spec.Mysql.Ssl,
-		}
+// serverCheck is the outcome of connecting to a database server
+type serverCheck struct {
+	status       corev1.ConditionStatus
+	reason       string
+	message      string
+	requeueAfter time.Duration
+	pingDuration time.Duration
+}
 
-		if msg, err := server.Connect(); err != nil {
-			log.Error(err, msg)
-			databaseServer.Status.Connected = false
-			if err := r.Status().Update(ctx, &databaseServer); err != nil {
-				log.Error(err, "unable to update databaseServer status")
-				return ctrl.Result{}, err
-			}
-			return ctrl.Result{RequeueAfter: time.Minute}, nil
-		}
+// checkServer connects to a database server with its admin credentials, and tells when to check again
+func checkServer(ctx context.Context, log logr.Logger, c client.Reader, connections *db.Connections, databaseServer *databasev1alpha1.DatabaseServer) serverCheck {
+	if !servers.SecretAllowed(databaseServer) {
+		msg := fmt.Sprintf("Secret %s/%s is not in namespace %s of the database server", databaseServer.Spec.Secret.Namespace, databaseServer.Spec.Secret.Name, databaseServer.Namespace)
+		log.Info(msg)
+		// Nothing changes until the database server is updated
+		return serverCheck{status: corev1.ConditionFalse, reason: "SecretNamespaceNotAllowed", message: msg}
+	}
 
-		defer server.Disconnect()
+	secret, err := secrets.Get(ctx, c, databaseServer.Spec.Secret)
+	if err != nil {
+		log.Error(err, "Error obtaining secret")
+		// The server is checked again when the secret changes
+		return serverCheck{status: corev1.ConditionFalse, reason: "SecretUnavailable", message: err.Error()}
+	}
 
-	} else if databaseServer.Spec.Type == "mongo" || databaseServer.Spec.Type == "mongodb" {
-		server := db.MongoServer{
-			Username: databaseServer.Spec.Mongo.Username,
-			Password: string(secret.Data["password"]),
-			Host:     databaseServer.Spec.Mongo.Host,
-			Port:     databaseServer.Spec.Mongo.Port,
-			Ssl:      databaseServer.Spec.Mongo.Ssl,
+	server, msg, err := connections.Get(databaseServer, string(secret.Data["password"]))
+	if err != nil {
+		log.Error(err, msg)
+		if errors.Is(err, db.ErrUnsupportedType) {
+			// Nothing changes until the database server is updated
+			return serverCheck{status: corev1.ConditionFalse, reason: "UnsupportedType", message: err.Error()}
 		}
+		return serverCheck{status: corev1.ConditionFalse, reason: "ConnectionFailed", message: fmt.Sprintf("%s: %v", msg, err), requeueAfter: time.Minute}
+	}
 
-		if msg, err := server.Connect(); err != nil {
-			log.Error(err, msg)
-			databaseServer.Status.Connected = false
-			if err := r.Status().Update(ctx, &databaseServer); err != nil {
-				log.Error(err, "unable to update databaseServer status")
-				return ctrl.Result{}, err
-			}
-			return ctrl.Result{RequeueAfter: time.Minute}, nil
-		}
+	// The pool may be reused from an earlier reconcile, so check that the server is still reachable
+	start := time.Now()
+	msg, err = timeOperation(databaseServer.Spec.Type, "ping", server.Ping)
+	pingDuration := time.Since(start)
+	if err != nil {
+		log.Error(err, msg)
+		return serverCheck{status: corev1.ConditionFalse, reason: "ConnectionFailed", message: fmt.Sprintf("%s: %v", msg, err), requeueAfter: time.Minute, pingDuration: pingDuration}
+	}
 
-		defer server.Disconnect()
+	log.Info("Successfully connected to database")
+	return serverCheck{status: corev1.ConditionTrue, reason: "Connected", message: "Connected to database server", requeueAfter: time.Minute, pingDuration: pingDuration}
+}
 
+// serverDeletionBlocked reports whether databases are still created on a database server of either kind being deleted,
+// recording them in an event on the server
+func serverDeletionBlocked(ctx context.Context, c client.Reader, recorder record.EventRecorder, obj runtime.Object, server databasev1alpha1.Server) (bool, error) {
+	var databases databasev1alpha1.DatabaseList
+	if err := c.List(ctx, &databases, client.MatchingField(databaseServerField, serverKey(server))); err != nil {
+		return false, err
+	}
+	if len(databases.Items) == 0 {
+		return false, nil
 	}
+	names := make([]string, 0, len(databases.Items))
+	for _, database := range databases.Items {
+		names = append(names, database.Namespace+"/"+database.Name)
+	}
+	recorder.Eventf(obj, corev1.EventTypeWarning, "DeletionBlocked", "Database server is deleted once no database is created on it, remaining: %s", strings.Join(names, ", "))
+	return true, nil
+}
 
-	log.Info("Successfully connected to database")
-	databaseServer.Status.Connected = true
-	if err := r.Status().Update(ctx, &databaseServer); err != nil {
-		log.Error(err, "unable to update databaseServer status")
-		return ctrl.Result{}, err
+// setServerReachable records whether a database server of either kind accepts the admin credentials and writes the status if it changed.
+// Changes are recorded as events as well.
+func setServerReachable(ctx context.Context, c client.Client, recorder record.EventRecorder, obj runtime.Object, serverStatus *databasev1alpha1.DatabaseServerStatus, generation int64, check serverCheck) error {
+	reachable := databasev1alpha1.IsConditionTrue(serverStatus.Conditions, databasev1alpha1.ConditionServerReachable)
+	changed := databasev1alpha1.SetCondition(&serverStatus.Conditions, databasev1alpha1.Condition{
+		Type:               databasev1alpha1.ConditionServerReachable,
+		Status:             check.status,
+		ObservedGeneration: generation,
+		Reason:             check.reason,
+		Message:            check.message,
+	})
+	switch {
+	case changed && check.status == corev1.ConditionFalse:
+		recorder.Event(obj, corev1.EventTypeWarning, check.reason, check.message)
+	case !reachable && check.status == corev1.ConditionTrue:
+		recorder.Event(obj, corev1.EventTypeNormal, check.reason, check.message)
+	}
+
+	_, readyChanged := summarizeConditions(&serverStatus.Conditions, generation, []string{databasev1alpha1.ConditionServerReachable})
+	phase := databasev1alpha1.PhaseReady
+	if check.status != corev1.ConditionTrue {
+		phase = databasev1alpha1.PhaseFailed
 	}
 
-	return ctrl.Result{RequeueAfter: time.Minute}, nil
+	if !changed && !readyChanged && serverStatus.Phase == phase && serverStatus.ObservedGeneration == generation {
+		return nil
+	}
+	serverStatus.Phase = phase
+	serverStatus.ObservedGeneration = generation
+	return c.Status().Update(ctx, obj)
 }
 
 // SetupWithManager for DatabaseServer
 func (r *DatabaseServerReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&databasev1alpha1.DatabaseServer{}).
+		Watches(&source.Kind{Type: &databasev1alpha1.Database{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: databaseServerRequests(databasev1alpha1.DatabaseServerKind),
+		}).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: adminSecretRequests(mgr.GetClient(), databasev1alpha1.DatabaseServerKind),
+		}).
 		Complete(r)
 }
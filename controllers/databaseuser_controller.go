@@ -0,0 +1,441 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+	db "flow.stacc.dev/database-provisioning-poc/pkg/db"
+	"flow.stacc.dev/database-provisioning-poc/pkg/secrets"
+	"flow.stacc.dev/database-provisioning-poc/pkg/servers"
+)
+
+// DatabaseUserReconciler reconciles a DatabaseUser object
+type DatabaseUserReconciler struct {
+	client.Client
+	Log         logr.Logger
+	Scheme      *runtime.Scheme
+	Recorder    record.EventRecorder
+	Connections *db.Connections
+	// DeletionTimeout is how long deleting the user on the server is retried before the finalizer is removed anyway,
+	// 0 to retry until it succeeds
+	DeletionTimeout time.Duration
+}
+
+// +kubebuilder:rbac:groups=database.stacc.com,resources=databaseusers,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=database.stacc.com,resources=databaseusers/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=database.stacc.com,resources=databases,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups=database.stacc.com,resources=databasesecretgrants,verbs=get;list;watch
+// +kubebuilder:rbac:groups=database.stacc.com,resources=databaseservers,verbs=get;list;watch
+// +kubebuilder:rbac:groups=database.stacc.com,resources=clusterdatabaseservers,verbs=get;list;watch
+
+// Reconcile DatabaseUser
+func (r *DatabaseUserReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.Background()
+	log := r.Log.WithValues("databaseuser", req.NamespacedName)
+
+	finalizer := "database.stacc.com/finalizer"
+
+	var user databasev1alpha1.DatabaseUser
+	if err := r.Get(ctx, req.NamespacedName, &user); err != nil {
+		log.Info("Unable to get databaseUser resource")
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	// Defaults are applied here as well, for clusters running without the defaulting webhook
+	user.Default()
+	deleting := !user.ObjectMeta.DeletionTimestamp.IsZero()
+
+	// Users are only given access to databases in their own namespace
+	if !user.Spec.Database.InNamespace(user.Namespace) {
+		msg := fmt.Sprintf("Database %s/%s is not in namespace %s of the user", user.Spec.Database.Namespace, user.Spec.Database.Name, user.Namespace)
+		if err := r.setCondition(ctx, &user, databasev1alpha1.ConditionDatabaseReady, corev1.ConditionFalse, "DatabaseNamespaceNotAllowed", msg); err != nil {
+			log.Error(err, "unable to update databaseUser status")
+			return ctrl.Result{}, err
+		}
+		if deleting {
+			user.ObjectMeta.Finalizers = removeString(user.ObjectMeta.Finalizers, finalizer)
+			return ctrl.Result{}, r.Update(ctx, &user)
+		}
+		// Nothing changes until the database is updated
+		return ctrl.Result{}, nil
+	}
+
+	// Get the database the user is given access to
+	databaseKey := client.ObjectKey{Namespace: user.Namespace, Name: user.Spec.Database.Name}
+	var database databasev1alpha1.Database
+	if err := r.Get(ctx, databaseKey, &database); err != nil {
+		if deleting && apierrors.IsNotFound(err) {
+			// The database is gone, and with it the way to reach the server the user was created on
+			log.Info("Database deleted before user, user is left on server", "user", user.Spec.Username)
+			user.ObjectMeta.Finalizers = removeString(user.ObjectMeta.Finalizers, finalizer)
+			return ctrl.Result{}, r.Update(ctx, &user)
+		}
+		log.Error(err, "unable to get database resource")
+		if statusErr := r.setCondition(ctx, &user, databasev1alpha1.ConditionDatabaseReady, corev1.ConditionFalse, "DatabaseNotFound", err.Error()); statusErr != nil {
+			log.Error(statusErr, "unable to update databaseUser status")
+		}
+		// The user is reconciled again when the database is created
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if !deleting && !databasev1alpha1.IsConditionTrue(database.Status.Conditions, databasev1alpha1.ConditionReady) {
+		log.Info("Database not ready")
+		msg := fmt.Sprintf("Database %s/%s is not ready", database.Namespace, database.Name)
+		if err := r.setCondition(ctx, &user, databasev1alpha1.ConditionDatabaseReady, corev1.ConditionFalse, "DatabaseNotReady", msg); err != nil {
+			log.Error(err, "unable to update databaseUser status")
+			return ctrl.Result{}, err
+		}
+		// The user is reconciled again when the database becomes ready
+		return ctrl.Result{}, nil
+	}
+	msg := fmt.Sprintf("Database %s/%s is ready", database.Namespace, database.Name)
+	if err := r.setCondition(ctx, &user, databasev1alpha1.ConditionDatabaseReady, corev1.ConditionTrue, "DatabaseReady", msg); err != nil {
+		log.Error(err, "unable to update databaseUser status")
+		return ctrl.Result{}, err
+	}
+
+	// The users of the database itself are managed by the database, and must not be changed or dropped here
+	if containsString(append(databaseUsers(&database, databaseUsername(&database)), databaseUsername(&database)), user.Spec.Username) {
+		msg := fmt.Sprintf("User %s belongs to database %s/%s", user.Spec.Username, database.Namespace, database.Name)
+		if err := r.setCondition(ctx, &user, databasev1alpha1.ConditionUserProvisioned, corev1.ConditionFalse, "UsernameConflict", msg); err != nil {
+			log.Error(err, "unable to update databaseUser status")
+			return ctrl.Result{}, err
+		}
+		if deleting {
+			user.ObjectMeta.Finalizers = removeString(user.ObjectMeta.Finalizers, finalizer)
+			return ctrl.Result{}, r.Update(ctx, &user)
+		}
+		return ctrl.Result{}, nil
+	}
+
+	// Credentials may only be written to the namespace of the user, unless granted by the namespace of the secret
+	secretAllowed, err := secrets.Allowed(ctx, r, databasev1alpha1.DatabaseUserKind, user.Namespace, user.Spec.Secret)
+	if err != nil {
+		log.Error(err, "unable to list secret grants")
+		return ctrl.Result{}, err
+	}
+	if deleting {
+		return r.finalizeUser(ctx, log, &user, &database, finalizer, secretAllowed)
+	}
+	if !secretAllowed {
+		msg := fmt.Sprintf("Secret %s/%s is not in namespace %s of the user, and no DatabaseSecretGrant allows it", user.Spec.Secret.Namespace, user.Spec.Secret.Name, user.Namespace)
+		if err := r.setCondition(ctx, &user, databasev1alpha1.ConditionSecretSynced, corev1.ConditionFalse, "SecretNamespaceNotAllowed", msg); err != nil {
+			log.Error(err, "unable to update databaseUser status")
+			return ctrl.Result{}, err
+		}
+		// Nothing changes until the secret is moved or a grant is created
+		return ctrl.Result{}, nil
+	}
+
+	// Get database Server resource
+	databaseServer, err := servers.Get(ctx, r, servers.DatabaseRef(&database))
+	if err != nil {
+		log.Error(err, "unable to get databaseServer resource")
+		if statusErr := r.setCondition(ctx, &user, databasev1alpha1.ConditionServerReachable, corev1.ConditionFalse, "ServerNotFound", err.Error()); statusErr != nil {
+			log.Error(statusErr, "unable to update databaseUser status")
+		}
+		// The user is reconciled again when the server is created
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	// The admin and system users of the server must never be changed or dropped by tenants
+	err = db.ValidateUsername(databaseServer.Spec.Type, user.Spec.Username)
+	if err == nil {
+		err = db.ValidateNotAdmin(&databaseServer.Spec, user.Spec.Username)
+	}
+	if err != nil {
+		if err := r.setCondition(ctx, &user, databasev1alpha1.ConditionUserProvisioned, corev1.ConditionFalse, "InvalidName", err.Error()); err != nil {
+			log.Error(err, "unable to update databaseUser status")
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+
+	// Get secret with database server password
+	serverSecret, err := secrets.Get(ctx, r, databaseServer.Spec.Secret)
+	if err != nil {
+		log.Error(err, "Error obtaining secret")
+		if statusErr := r.setCondition(ctx, &user, databasev1alpha1.ConditionServerReachable, corev1.ConditionFalse, "ServerSecretUnavailable", err.Error()); statusErr != nil {
+			log.Error(statusErr, "unable to update databaseUser status")
+		}
+		// The user is reconciled again when the secret is created
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	sqlServer, msg, err := r.Connections.Get(databaseServer, string(serverSecret.Data["password"]))
+	if err != nil {
+		log.Error(err, msg)
+		if errors.Is(err, db.ErrUnsupportedType) {
+			if err := r.setCondition(ctx, &user, databasev1alpha1.ConditionServerReachable, corev1.ConditionFalse, "UnsupportedServerType", err.Error()); err != nil {
+				log.Error(err, "unable to update databaseUser status")
+				return ctrl.Result{}, err
+			}
+			return ctrl.Result{}, nil
+		}
+		if statusErr := r.setCondition(ctx, &user, databasev1alpha1.ConditionServerReachable, corev1.ConditionFalse, "ConnectionFailed", fmt.Sprintf("%s: %v", msg, err)); statusErr != nil {
+			log.Error(statusErr, "unable to update databaseUser status")
+		}
+		return ctrl.Result{}, err
+	}
+	if err := r.setCondition(ctx, &user, databasev1alpha1.ConditionServerReachable, corev1.ConditionTrue, "Connected", "Connected to database server"); err != nil {
+		log.Error(err, "unable to update databaseUser status")
+		return ctrl.Result{}, err
+	}
+
+	target := db.Database{
+		Name:     database.Spec.Name,
+		Username: user.Spec.Username,
+		// The user is granted on the tables the users of the database create
+		Owners: databaseUsers(&database, databaseUsername(&database)),
+	}
+	if user.Spec.Privileges != nil {
+		target.Privileges = *user.Spec.Privileges
+	}
+
+	// If user shall be deleted with CR, add finalizer
+	if user.Spec.ReclaimPolicy == "delete" && !containsString(user.ObjectMeta.Finalizers, finalizer) {
+		user.ObjectMeta.Finalizers = append(user.ObjectMeta.Finalizers, finalizer)
+		if err := r.Update(ctx, &user); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	// Check if secret exists, create it with a new password if not
+	secret, err := secrets.Get(ctx, r, user.Spec.Secret)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			log.Error(err, "unable to get secret")
+			if statusErr := r.setCondition(ctx, &user, databasev1alpha1.ConditionSecretSynced, corev1.ConditionFalse, "SecretUnavailable", err.Error()); statusErr != nil {
+				log.Error(statusErr, "unable to update databaseUser status")
+			}
+			return ctrl.Result{}, err
+		}
+		pass, err := generatePassword()
+		if err != nil {
+			log.Error(err, "unable to generate password")
+			if statusErr := r.setCondition(ctx, &user, databasev1alpha1.ConditionSecretSynced, corev1.ConditionFalse, "PasswordGenerationFailed", err.Error()); statusErr != nil {
+				log.Error(statusErr, "unable to update databaseUser status")
+			}
+			return ctrl.Result{}, err
+		}
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      user.Spec.Secret.Name,
+				Namespace: user.Spec.Secret.Namespace,
+				Labels:    map[string]string{databasev1alpha1.WatchLabel: "true"},
+			},
+			Data: map[string][]byte{
+				"username": []byte(user.Spec.Username),
+				"password": []byte(pass),
+			},
+		}
+		if err := r.Create(ctx, secret); err != nil {
+			if apierrors.IsAlreadyExists(err) {
+				// The secret was created by an earlier reconcile and is not in the cache yet
+				return ctrl.Result{Requeue: true}, nil
+			}
+			log.Error(err, "unable to create secret")
+			if statusErr := r.setCondition(ctx, &user, databasev1alpha1.ConditionSecretSynced, corev1.ConditionFalse, "SecretCreationFailed", err.Error()); statusErr != nil {
+				log.Error(statusErr, "unable to update databaseUser status")
+			}
+			return ctrl.Result{}, err
+		}
+	} else if secret.Labels[databasev1alpha1.WatchLabel] != "true" {
+		// Secrets created before they were labelled are labelled, so they are cached and watched
+		if secret.Labels == nil {
+			secret.Labels = map[string]string{}
+		}
+		secret.Labels[databasev1alpha1.WatchLabel] = "true"
+		if err := r.Update(ctx, secret); err != nil {
+			log.Error(err, "unable to update secret")
+			if statusErr := r.setCondition(ctx, &user, databasev1alpha1.ConditionSecretSynced, corev1.ConditionFalse, "SecretUpdateFailed", err.Error()); statusErr != nil {
+				log.Error(statusErr, "unable to update databaseUser status")
+			}
+			return ctrl.Result{}, err
+		}
+	}
+	target.Password = string(secret.Data["password"])
+	msg = fmt.Sprintf("Secret %s/%s contains credentials", user.Spec.Secret.Namespace, user.Spec.Secret.Name)
+	if err := r.setCondition(ctx, &user, databasev1alpha1.ConditionSecretSynced, corev1.ConditionTrue, "SecretAvailable", msg); err != nil {
+		log.Error(err, "unable to update databaseUser status")
+		return ctrl.Result{}, err
+	}
+
+	target.Owned = ownedUser(&user)
+	if msg, err := timeOperation(databaseServer.Spec.Type, "create_user", func() (string, error) { return sqlServer.CreateUser(target) }); err != nil {
+		// Users the resource did not create may be the admin user or belong to someone else, and are never taken over
+		if errors.Is(err, db.ErrUserExists) {
+			msg := fmt.Sprintf("User %s exists on the server and was not created by the resource", target.Username)
+			if err := r.setCondition(ctx, &user, databasev1alpha1.ConditionUserProvisioned, corev1.ConditionFalse, "UserNotOwned", msg); err != nil {
+				log.Error(err, "unable to update databaseUser status")
+				return ctrl.Result{}, err
+			}
+			// Nothing changes until the username is updated or the user is dropped from the server
+			return ctrl.Result{}, nil
+		}
+		log.Error(err, msg)
+		if statusErr := r.setCondition(ctx, &user, databasev1alpha1.ConditionUserProvisioned, corev1.ConditionFalse, "CreateUserFailed", fmt.Sprintf("%s: %v", msg, err)); statusErr != nil {
+			log.Error(statusErr, "unable to update databaseUser status")
+		}
+		return ctrl.Result{}, err
+	}
+	if !containsString(user.Status.Users, target.Username) {
+		// Recorded right away, a user created but not recorded would never be taken over again
+		patch := client.MergeFrom(user.DeepCopy())
+		user.Status.Users = append(user.Status.Users, target.Username)
+		if err := r.Status().Patch(ctx, &user, patch); err != nil {
+			log.Error(err, "unable to record user in databaseUser status")
+			return ctrl.Result{}, err
+		}
+	}
+	// Bring the password on the server in line with the secret, as for the user of a database
+	if msg, err := timeOperation(databaseServer.Spec.Type, "verify_login", func() (string, error) { return sqlServer.VerifyLogin(target) }); err != nil {
+		log.Info("Unable to log in with credentials from secret, resetting password", "user", target.Username, "reason", msg, "err", err)
+		if msg, err := timeOperation(databaseServer.Spec.Type, "update_password", func() (string, error) { return sqlServer.UpdatePassword(target) }); err != nil {
+			log.Error(err, msg)
+			if statusErr := r.setCondition(ctx, &user, databasev1alpha1.ConditionUserProvisioned, corev1.ConditionFalse, "PasswordResetFailed", fmt.Sprintf("%s: %v", msg, err)); statusErr != nil {
+				log.Error(statusErr, "unable to update databaseUser status")
+			}
+			return ctrl.Result{}, err
+		}
+		r.Recorder.Eventf(&user, corev1.EventTypeWarning, "PasswordReset", "Password of user %s did not match secret %s/%s and was reset", target.Username, user.Spec.Secret.Namespace, user.Spec.Secret.Name)
+	}
+	msg = fmt.Sprintf("User %s exists on server", target.Username)
+	if err := r.setCondition(ctx, &user, databasev1alpha1.ConditionUserProvisioned, corev1.ConditionTrue, "UserCreated", msg); err != nil {
+		log.Error(err, "unable to update databaseUser status")
+		return ctrl.Result{}, err
+	}
+
+	if msg, err := timeOperation(databaseServer.Spec.Type, "grant_permissions", func() (string, error) { return sqlServer.GrantPermissions(target) }); err != nil {
+		log.Error(err, msg)
+		if errors.Is(err, db.ErrUnsupportedPrivilege) {
+			if err := r.setCondition(ctx, &user, databasev1alpha1.ConditionPermissionsGranted, corev1.ConditionFalse, "UnsupportedPrivileges", err.Error()); err != nil {
+				log.Error(err, "unable to update databaseUser status")
+				return ctrl.Result{}, err
+			}
+			return ctrl.Result{}, nil
+		}
+		if statusErr := r.setCondition(ctx, &user, databasev1alpha1.ConditionPermissionsGranted, corev1.ConditionFalse, "GrantFailed", fmt.Sprintf("%s: %v", msg, err)); statusErr != nil {
+			log.Error(statusErr, "unable to update databaseUser status")
+		}
+		return ctrl.Result{}, err
+	}
+	level := target.Privileges.Level
+	if level == "" {
+		level = databasev1alpha1.PrivilegeOwner
+	}
+	msg = fmt.Sprintf("User %s has been granted %s privileges on database %s", target.Username, level, target.Name)
+	if err := r.setCondition(ctx, &user, databasev1alpha1.ConditionPermissionsGranted, corev1.ConditionTrue, "PermissionsGranted", msg); err != nil {
+		log.Error(err, "unable to update databaseUser status")
+		return ctrl.Result{}, err
+	}
+
+	if msg, err := timeOperation(databaseServer.Spec.Type, "verify_access", func() (string, error) { return sqlServer.VerifyAccess(target) }); err != nil {
+		log.Error(err, msg)
+		if statusErr := r.setCondition(ctx, &user, databasev1alpha1.ConditionCredentialsVerified, corev1.ConditionFalse, "VerificationFailed", fmt.Sprintf("%s: %v", msg, err)); statusErr != nil {
+			log.Error(statusErr, "unable to update databaseUser status")
+		}
+		return ctrl.Result{}, err
+	}
+	msg = fmt.Sprintf("User %s can access database %s", target.Username, target.Name)
+	if err := r.setCondition(ctx, &user, databasev1alpha1.ConditionCredentialsVerified, corev1.ConditionTrue, "CredentialsVerified", msg); err != nil {
+		log.Error(err, "unable to update databaseUser status")
+		return ctrl.Result{}, err
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// databaseUserConditions must all be true for a database user to be ready
+var databaseUserConditions = []string{
+	databasev1alpha1.ConditionDatabaseReady,
+	databasev1alpha1.ConditionServerReachable,
+	databasev1alpha1.ConditionSecretSynced,
+	databasev1alpha1.ConditionUserProvisioned,
+	databasev1alpha1.ConditionPermissionsGranted,
+	databasev1alpha1.ConditionCredentialsVerified,
+}
+
+// setCondition records the outcome of a provisioning step, summarizes it into the Ready condition and phase,
+// and writes the status if anything changed
+func (r *DatabaseUserReconciler) setCondition(ctx context.Context, user *databasev1alpha1.DatabaseUser, conditionType string, status corev1.ConditionStatus, reason, message string) error {
+	changed := databasev1alpha1.SetCondition(&user.Status.Conditions, databasev1alpha1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		ObservedGeneration: user.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+
+	phase, readyChanged := summarizeConditions(&user.Status.Conditions, user.Generation, databaseUserConditions)
+	if !user.ObjectMeta.DeletionTimestamp.IsZero() {
+		phase = databasev1alpha1.PhaseDeleting
+	}
+
+	if !changed && !readyChanged && user.Status.Phase == phase && user.Status.ObservedGeneration == user.Generation {
+		return nil
+	}
+	user.Status.Phase = phase
+	user.Status.ObservedGeneration = user.Generation
+	return r.Status().Update(ctx, user)
+}
+
+func (r *DatabaseUserReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&databasev1alpha1.DatabaseUser{}).
+		Watches(&source.Kind{Type: &databasev1alpha1.DatabaseSecretGrant{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: secretGrantRequests(mgr.GetClient(), databasev1alpha1.DatabaseUserKind),
+		}).
+		Watches(&source.Kind{Type: &databasev1alpha1.Database{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: databaseDependentRequests(mgr.GetClient(), &databasev1alpha1.DatabaseUserList{}),
+		}).
+		Watches(&source.Kind{Type: &databasev1alpha1.DatabaseServer{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: serverDependentRequests(mgr.GetClient(), &databasev1alpha1.DatabaseUserList{}, databasev1alpha1.DatabaseServerKind),
+		}).
+		Watches(&source.Kind{Type: &databasev1alpha1.ClusterDatabaseServer{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: serverDependentRequests(mgr.GetClient(), &databasev1alpha1.DatabaseUserList{}, databasev1alpha1.ClusterDatabaseServerKind),
+		}).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: secretDependentRequests(mgr.GetClient(), &databasev1alpha1.DatabaseUserList{}),
+		}).
+		Complete(r)
+}
+
+// ownedUser reports whether the user of a database user was created by the controller. Users provisioned
+// before the users were recorded were only created by the controller then.
+func ownedUser(user *databasev1alpha1.DatabaseUser) bool {
+	if len(user.Status.Users) == 0 && databasev1alpha1.IsConditionTrue(user.Status.Conditions, databasev1alpha1.ConditionUserProvisioned) {
+		return true
+	}
+	return containsString(user.Status.Users, user.Spec.Username)
+}
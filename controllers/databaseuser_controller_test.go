@@ -0,0 +1,98 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+)
+
+// newDatabaseUser returns a database user with reclaim policy delete, with a secret named after it
+func newDatabaseUser(namespace, name, database string) *databasev1alpha1.DatabaseUser {
+	return &databasev1alpha1.DatabaseUser{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec: databasev1alpha1.DatabaseUserSpec{
+			Database:      databasev1alpha1.DatabaseReference{Name: database},
+			Username:      name,
+			Secret:        databasev1alpha1.Secret{Name: name + "-credentials"},
+			ReclaimPolicy: "delete",
+		},
+	}
+}
+
+// databaseUserCondition returns a function polling the status and reason of a condition of a database user, e.g. "False UserNotOwned"
+func databaseUserCondition(key client.ObjectKey, conditionType string) func() string {
+	return func() string {
+		var user databasev1alpha1.DatabaseUser
+		if err := k8sClient.Get(context.Background(), key, &user); err != nil {
+			return err.Error()
+		}
+		condition := databasev1alpha1.FindCondition(user.Status.Conditions, conditionType)
+		if condition == nil {
+			return ""
+		}
+		return string(condition.Status) + " " + condition.Reason
+	}
+}
+
+var _ = Describe("DatabaseUser controller", func() {
+	var namespace string
+	var server *fakeServer
+
+	BeforeEach(func() {
+		namespace = createNamespace()
+		server = createServer(namespace, "server", nil)
+		Expect(k8sClient.Create(context.Background(), newDatabase(namespace, "orders", "server"))).To(Succeed())
+		Eventually(databaseCondition(client.ObjectKey{Namespace: namespace, Name: "orders"}, databasev1alpha1.ConditionReady), timeout, interval).Should(Equal("True Ready"))
+	})
+
+	Context("when a database user with reclaim policy delete is deleted", func() {
+		It("drops the user it created", func() {
+			user := newDatabaseUser(namespace, "reporting", "orders")
+			Expect(k8sClient.Create(context.Background(), user)).To(Succeed())
+
+			key := client.ObjectKey{Namespace: namespace, Name: "reporting"}
+			Eventually(databaseUserCondition(key, databasev1alpha1.ConditionReady), timeout, interval).Should(Equal("True Ready"))
+			_, password := credentials(client.ObjectKey{Namespace: namespace, Name: "reporting-credentials"})
+			Expect(server.password("reporting")).To(Equal(password))
+
+			Expect(k8sClient.Delete(context.Background(), user)).To(Succeed())
+			Eventually(isDeleted(key, &databasev1alpha1.DatabaseUser{}), timeout, interval).Should(BeTrue())
+			_, exists := server.password("reporting")
+			Expect(exists).To(BeFalse())
+		})
+
+		It("leaves a user it did not create on the server", func() {
+			server.addUser("legacy", "legacy-password")
+			user := newDatabaseUser(namespace, "legacy", "orders")
+			Expect(k8sClient.Create(context.Background(), user)).To(Succeed())
+
+			key := client.ObjectKey{Namespace: namespace, Name: "legacy"}
+			Eventually(databaseUserCondition(key, databasev1alpha1.ConditionUserProvisioned), timeout, interval).Should(Equal("False UserNotOwned"))
+
+			Expect(k8sClient.Delete(context.Background(), user)).To(Succeed())
+			Eventually(isDeleted(key, &databasev1alpha1.DatabaseUser{}), timeout, interval).Should(BeTrue())
+			Expect(server.password("legacy")).To(Equal("legacy-password"))
+		})
+	})
+})
@@ -0,0 +1,176 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	db "flow.stacc.dev/database-provisioning-poc/pkg/db"
+)
+
+// fakeServerType is the type of the database servers of the specs, provisioned in memory by fakeServer
+const fakeServerType = "fake"
+
+// errFakeDeleteFailed is returned by fake servers failing deletions
+var errFakeDeleteFailed = errors.New("deletion failed")
+
+var (
+	fakeServersMu sync.Mutex
+	fakeServers   = map[string]*fakeServer{}
+)
+
+// fakeServer is a database server kept in memory. Each host is a server of its own, so specs do not share databases and users.
+type fakeServer struct {
+	mu        sync.Mutex
+	databases map[string]bool
+	// users are the passwords of the users on the server
+	users       map[string]string
+	failDeletes bool
+}
+
+var _ db.SQLServer = &fakeServer{}
+
+// fakeServerFor returns the fake server of a host, creating it the first time
+func fakeServerFor(host string) *fakeServer {
+	fakeServersMu.Lock()
+	defer fakeServersMu.Unlock()
+	server, ok := fakeServers[host]
+	if !ok {
+		server = &fakeServer{databases: map[string]bool{}, users: map[string]string{}}
+		fakeServers[host] = server
+	}
+	return server
+}
+
+func (s *fakeServer) Connect() (string, error) { return "Connected", nil }
+
+func (s *fakeServer) Disconnect() {}
+
+func (s *fakeServer) Ping() (string, error) { return "Pinged", nil }
+
+func (s *fakeServer) CreateUser(database db.Database) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.users[database.Username]; exists {
+		if !database.Owned {
+			return "User already exists", db.ErrUserExists
+		}
+		return "User already exists", nil
+	}
+	s.users[database.Username] = database.Password
+	return "User created successfully", nil
+}
+
+func (s *fakeServer) UpdatePassword(database db.Database) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.users[database.Username]; !exists {
+		return "unable to update password", fmt.Errorf("user %s does not exist", database.Username)
+	}
+	s.users[database.Username] = database.Password
+	return "Password updated successfully", nil
+}
+
+func (s *fakeServer) DeleteUser(database db.Database) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failDeletes {
+		return "unable to drop user", errFakeDeleteFailed
+	}
+	delete(s.users, database.Username)
+	return "User deleted successfully", nil
+}
+
+func (s *fakeServer) CreateDatabase(database db.Database) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.databases[database.Name] {
+		if !database.DatabaseOwned {
+			return "Database already exists", db.ErrDatabaseExists
+		}
+		return "Database already exists", nil
+	}
+	s.databases[database.Name] = true
+	return "Database created successfully", nil
+}
+
+func (s *fakeServer) DeleteDatabase(database db.Database) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failDeletes {
+		return "unable to drop database", errFakeDeleteFailed
+	}
+	delete(s.databases, database.Name)
+	return "Database deleted successfully", nil
+}
+
+func (s *fakeServer) GrantPermissions(database db.Database) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.users[database.Username]; !exists || !s.databases[database.Name] {
+		return "unable to grant permissions", fmt.Errorf("user %s or database %s does not exist", database.Username, database.Name)
+	}
+	return "Permissions successfully granted", nil
+}
+
+func (s *fakeServer) VerifyLogin(database db.Database) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if password, exists := s.users[database.Username]; !exists || password != database.Password {
+		return "unable to log in", fmt.Errorf("password authentication failed for user %s", database.Username)
+	}
+	return "Logged in", nil
+}
+
+func (s *fakeServer) VerifyAccess(database db.Database) (string, error) {
+	if msg, err := s.VerifyLogin(database); err != nil {
+		return msg, err
+	}
+	if !s.hasDatabase(database.Name) {
+		return "unable to access database", fmt.Errorf("database %s does not exist", database.Name)
+	}
+	return "Accessed database", nil
+}
+
+func (s *fakeServer) hasDatabase(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.databases[name]
+}
+
+// password returns the password of a user, and whether it exists
+func (s *fakeServer) password(username string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	password, exists := s.users[username]
+	return password, exists
+}
+
+// addUser creates a user on the server which no resource created
+func (s *fakeServer) addUser(username, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[username] = password
+}
+
+func (s *fakeServer) setFailDeletes(fail bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failDeletes = fail
+}
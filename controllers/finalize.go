@@ -0,0 +1,229 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+	db "flow.stacc.dev/database-provisioning-poc/pkg/db"
+	"flow.stacc.dev/database-provisioning-poc/pkg/secrets"
+	"flow.stacc.dev/database-provisioning-poc/pkg/servers"
+)
+
+// finalizeDatabase deletes the database, users and secret of a database being deleted, and then removes the finalizer.
+// Failures are retried with backoff until the deletion is forced by annotation or the deletion timeout,
+// which removes the finalizer and the secret and leaves the database and users on the server.
+func (r *DatabaseReconciler) finalizeDatabase(ctx context.Context, log logr.Logger, database *databasev1alpha1.Database, finalizer string) (ctrl.Result, error) {
+	if !containsString(database.ObjectMeta.Finalizers, finalizer) {
+		return ctrl.Result{}, nil
+	}
+
+	// The reclaim policy may have been changed to retain after the finalizer was added
+	if database.Spec.ReclaimPolicy == "delete" {
+		log.Info("Database being finalized")
+		if reason, msg, err := r.deleteFromServer(ctx, database); err != nil {
+			log.Error(err, msg)
+			if forced, why := deletionForced(database, r.DeletionTimeout); forced {
+				r.Recorder.Eventf(database, corev1.EventTypeWarning, "OrphanedResources", "%s, database %s and its users are left on server %s: %s: %v",
+					why, database.Spec.Name, serverName(servers.DatabaseRef(database)), msg, err)
+			} else {
+				if statusErr := r.setCondition(ctx, database, databasev1alpha1.ConditionDeleted, corev1.ConditionFalse, reason, fmt.Sprintf("%s: %v", msg, err)); statusErr != nil {
+					log.Error(statusErr, "unable to update database status")
+				}
+				// Retried with backoff
+				return ctrl.Result{}, err
+			}
+		}
+
+		secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: database.Spec.Secret.Namespace, Name: database.Spec.Secret.Name}}
+		if err := r.Delete(ctx, secret); err != nil && !apierrors.IsNotFound(err) {
+			log.Error(err, "unable to delete secret")
+			msg := fmt.Sprintf("unable to delete secret %s/%s: %v", database.Spec.Secret.Namespace, database.Spec.Secret.Name, err)
+			if statusErr := r.setCondition(ctx, database, databasev1alpha1.ConditionDeleted, corev1.ConditionFalse, "DeleteSecretFailed", msg); statusErr != nil {
+				log.Error(statusErr, "unable to update database status")
+			}
+			return ctrl.Result{}, err
+		}
+	}
+
+	// Remove finalizer to complete finalizing
+	database.ObjectMeta.Finalizers = removeString(database.ObjectMeta.Finalizers, finalizer)
+	if err := r.Update(ctx, database); err != nil {
+		log.Error(err, "unable to update database resource")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// deleteFromServer drops the database and its users on the server. It does not require the server to be ready,
+// or to still allow the namespace of the database, only to be reachable with the admin secret.
+// The reason for the Deleted condition is returned along with a failure.
+func (r *DatabaseReconciler) deleteFromServer(ctx context.Context, database *databasev1alpha1.Database) (string, string, error) {
+	ref := servers.DatabaseRef(database)
+	if ref.Name == "" {
+		// A database never placed on a server has nothing to delete
+		return "", "", nil
+	}
+	databaseServer, err := servers.Get(ctx, r, ref)
+	if apierrors.IsNotFound(err) {
+		// Without the resource of the server there is no way to reach it, so waiting for it would block the deletion forever
+		r.Recorder.Eventf(database, corev1.EventTypeWarning, "OrphanedResources", "Database server %s not found, database %s and its users are left on it",
+			serverName(ref), database.Spec.Name)
+		return "", "", nil
+	}
+	if err != nil {
+		return "ServerNotFound", "unable to get database server", err
+	}
+	serverSecret, err := secrets.Get(ctx, r, databaseServer.Spec.Secret)
+	if err != nil {
+		return "ServerSecretUnavailable", "unable to get secret of database server", err
+	}
+	sqlServer, msg, err := r.Connections.Get(databaseServer, string(serverSecret.Data["password"]))
+	if err != nil {
+		return "ConnectionFailed", msg, err
+	}
+
+	// Only a database created for the resource is dropped, others may be system databases or belong to someone else
+	target := db.Database{Name: database.Spec.Name}
+	if ownedDatabase(database) {
+		if msg, err := timeOperation(databaseServer.Spec.Type, "delete_database", func() (string, error) { return sqlServer.DeleteDatabase(target) }); err != nil {
+			return "DeleteDatabaseFailed", msg, err
+		}
+		r.Recorder.Eventf(database, corev1.EventTypeNormal, "DatabaseDeleted", "Database %s deleted", target.Name)
+	}
+
+	// Only users created for the database are deleted, including those left by switching between single and dual user rotation
+	users := ownedUsers(database)
+	for _, user := range users {
+		d := target
+		d.Username = user
+		if msg, err := timeOperation(databaseServer.Spec.Type, "delete_user", func() (string, error) { return sqlServer.DeleteUser(d) }); err != nil {
+			return "DeleteUserFailed", msg, err
+		}
+	}
+	if len(users) > 0 {
+		r.Recorder.Eventf(database, corev1.EventTypeNormal, "UserDeleted", "User %s deleted", strings.Join(users, ", "))
+	}
+	return "", "", nil
+}
+
+// deletionForced reports whether a database or database user is deleted without deleting what it provisioned on the server,
+// and why
+func deletionForced(obj metav1.Object, timeout time.Duration) (bool, string) {
+	if obj.GetAnnotations()[databasev1alpha1.ForceDeleteAnnotation] == "true" {
+		return true, fmt.Sprintf("Deletion forced by annotation %s", databasev1alpha1.ForceDeleteAnnotation)
+	}
+	if timeout > 0 && obj.GetDeletionTimestamp() != nil && time.Since(obj.GetDeletionTimestamp().Time) > timeout {
+		return true, fmt.Sprintf("Deletion did not succeed within %s", timeout)
+	}
+	return false, ""
+}
+
+// finalizeUser deletes the user and secret of a database user being deleted, and then removes the finalizer.
+// As for a database, failures are retried with backoff until the deletion is forced by annotation or the deletion timeout,
+// which leaves the user on the server.
+func (r *DatabaseUserReconciler) finalizeUser(ctx context.Context, log logr.Logger, user *databasev1alpha1.DatabaseUser, database *databasev1alpha1.Database, finalizer string, secretAllowed bool) (ctrl.Result, error) {
+	if !containsString(user.ObjectMeta.Finalizers, finalizer) {
+		return ctrl.Result{}, nil
+	}
+
+	// The reclaim policy may have been changed to retain after the finalizer was added
+	if user.Spec.ReclaimPolicy == "delete" {
+		log.Info("Database user being finalized")
+		if reason, msg, err := r.deleteUserFromServer(ctx, log, user, database); err != nil {
+			log.Error(err, msg)
+			if forced, why := deletionForced(user, r.DeletionTimeout); forced {
+				r.Recorder.Eventf(user, corev1.EventTypeWarning, "OrphanedResources", "%s, user %s is left on server %s: %s: %v",
+					why, user.Spec.Username, serverName(servers.DatabaseRef(database)), msg, err)
+			} else {
+				if statusErr := r.setCondition(ctx, user, databasev1alpha1.ConditionDeleted, corev1.ConditionFalse, reason, fmt.Sprintf("%s: %v", msg, err)); statusErr != nil {
+					log.Error(statusErr, "unable to update databaseUser status")
+				}
+				// Retried with backoff
+				return ctrl.Result{}, err
+			}
+		}
+
+		// A secret no longer granted to the user is left alone
+		if secretAllowed {
+			secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: user.Spec.Secret.Namespace, Name: user.Spec.Secret.Name}}
+			if err := r.Delete(ctx, secret); err != nil && !apierrors.IsNotFound(err) {
+				log.Error(err, "unable to delete secret")
+				msg := fmt.Sprintf("unable to delete secret %s/%s: %v", user.Spec.Secret.Namespace, user.Spec.Secret.Name, err)
+				if statusErr := r.setCondition(ctx, user, databasev1alpha1.ConditionDeleted, corev1.ConditionFalse, "DeleteSecretFailed", msg); statusErr != nil {
+					log.Error(statusErr, "unable to update databaseUser status")
+				}
+				return ctrl.Result{}, err
+			}
+		}
+	}
+
+	// Remove finalizer to complete finalizing
+	user.ObjectMeta.Finalizers = removeString(user.ObjectMeta.Finalizers, finalizer)
+	if err := r.Update(ctx, user); err != nil {
+		log.Error(err, "unable to update databaseUser resource")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// deleteUserFromServer drops the user of a database user on the server, unless it existed before the resource or is
+// the admin user of the server. Like deleteFromServer it only requires the server to be reachable with the admin secret.
+func (r *DatabaseUserReconciler) deleteUserFromServer(ctx context.Context, log logr.Logger, user *databasev1alpha1.DatabaseUser, database *databasev1alpha1.Database) (string, string, error) {
+	if !ownedUser(user) {
+		log.Info("User not created by the resource, user is left on server", "user", user.Spec.Username)
+		return "", "", nil
+	}
+	databaseServer, err := servers.Get(ctx, r, servers.DatabaseRef(database))
+	if apierrors.IsNotFound(err) {
+		r.Recorder.Eventf(user, corev1.EventTypeWarning, "OrphanedResources", "Database server %s not found, user %s is left on it",
+			serverName(servers.DatabaseRef(database)), user.Spec.Username)
+		return "", "", nil
+	}
+	if err != nil {
+		return "ServerNotFound", "unable to get database server", err
+	}
+	if err := db.ValidateNotAdmin(&databaseServer.Spec, user.Spec.Username); err != nil {
+		log.Info("User is the admin user of the server, user is left on server", "user", user.Spec.Username)
+		return "", "", nil
+	}
+	serverSecret, err := secrets.Get(ctx, r, databaseServer.Spec.Secret)
+	if err != nil {
+		return "ServerSecretUnavailable", "unable to get secret of database server", err
+	}
+	sqlServer, msg, err := r.Connections.Get(databaseServer, string(serverSecret.Data["password"]))
+	if err != nil {
+		return "ConnectionFailed", msg, err
+	}
+
+	target := db.Database{Name: database.Spec.Name, Username: user.Spec.Username}
+	if msg, err := timeOperation(databaseServer.Spec.Type, "delete_user", func() (string, error) { return sqlServer.DeleteUser(target) }); err != nil {
+		return "DeleteUserFailed", msg, err
+	}
+	r.Recorder.Eventf(user, corev1.EventTypeNormal, "UserDeleted", "User %s deleted", target.Username)
+	return "", "", nil
+}
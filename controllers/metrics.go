@@ -0,0 +1,149 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+	"flow.stacc.dev/database-provisioning-poc/pkg/servers"
+)
+
+var (
+	operationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "database_controller_operation_duration_seconds",
+		Help:    "Duration of the operations of provisioning steps on database servers",
+		Buckets: []float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300},
+	}, []string{"type", "operation"})
+	operationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "database_controller_operation_errors_total",
+		Help: "Number of operations on database servers which failed",
+	}, []string{"type", "operation"})
+	serverReachable = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "database_controller_server_reachable",
+		Help: "Whether the database server accepts the admin credentials, 1 if it does and 0 if not",
+	}, []string{"kind", "server"})
+	serverPingDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "database_controller_server_ping_duration_seconds",
+		Help: "Duration of the last ping of the database server",
+	}, []string{"kind", "server"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(operationDuration, operationErrors, serverReachable, serverPingDuration)
+}
+
+// timeOperation runs an operation of a driver, recording its duration and whether it failed
+func timeOperation(serverType, operation string, f func() (string, error)) (string, error) {
+	start := time.Now()
+	msg, err := f()
+	operationDuration.WithLabelValues(serverType, operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		operationErrors.WithLabelValues(serverType, operation).Inc()
+	}
+	return msg, err
+}
+
+// recordServerCheck records the outcome of connecting to a database server
+func recordServerCheck(server databasev1alpha1.Server, check serverCheck) {
+	reachable := 0.0
+	if check.status == corev1.ConditionTrue {
+		reachable = 1
+	}
+	serverReachable.WithLabelValues(server.Kind, serverName(server)).Set(reachable)
+	if check.pingDuration > 0 {
+		serverPingDuration.WithLabelValues(server.Kind, serverName(server)).Set(check.pingDuration.Seconds())
+	}
+}
+
+// forgetServer removes the metrics of a deleted database server
+func forgetServer(server databasev1alpha1.Server) {
+	serverReachable.DeleteLabelValues(server.Kind, serverName(server))
+	serverPingDuration.DeleteLabelValues(server.Kind, serverName(server))
+}
+
+var (
+	databasesDesc = prometheus.NewDesc("database_controller_databases",
+		"Number of databases by database server and phase", []string{"server", "phase"}, nil)
+	notReadyDesc = prometheus.NewDesc("database_controller_database_not_ready_seconds",
+		"Time since a database which is not ready stopped being ready, or was created", []string{"namespace", "database", "phase"}, nil)
+	passwordAgeDesc = prometheus.NewDesc("database_controller_password_age_seconds",
+		"Time since the password of the user of a database was last rotated, or the database was created", []string{"namespace", "database"}, nil)
+)
+
+// databaseCollector reports metrics derived from the databases in the cache when scraped,
+// so databases which are deleted do not leave metrics behind
+type databaseCollector struct {
+	client client.Reader
+}
+
+// NewDatabaseCollector returns a collector of metrics about the databases read through a client
+func NewDatabaseCollector(c client.Reader) prometheus.Collector {
+	return &databaseCollector{client: c}
+}
+
+// Describe implements prometheus.Collector
+func (c *databaseCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- databasesDesc
+	ch <- notReadyDesc
+	ch <- passwordAgeDesc
+}
+
+// Collect implements prometheus.Collector
+func (c *databaseCollector) Collect(ch chan<- prometheus.Metric) {
+	var databases databasev1alpha1.DatabaseList
+	if err := c.client.List(context.Background(), &databases); err != nil {
+		ch <- prometheus.NewInvalidMetric(databasesDesc, err)
+		return
+	}
+
+	now := time.Now()
+	type serverPhase struct{ server, phase string }
+	counts := make(map[serverPhase]int)
+	for i := range databases.Items {
+		database := &databases.Items[i]
+		// Databases waiting for placement are counted without a server
+		server := ""
+		if database.Status.Server != nil || database.Spec.Server.Name != "" {
+			server = serverName(servers.DatabaseRef(database))
+		}
+		counts[serverPhase{server, database.Status.Phase}]++
+
+		if ready := databasev1alpha1.FindCondition(database.Status.Conditions, databasev1alpha1.ConditionReady); ready == nil || ready.Status != corev1.ConditionTrue {
+			since := database.CreationTimestamp.Time
+			if ready != nil && !ready.LastTransitionTime.IsZero() {
+				since = ready.LastTransitionTime.Time
+			}
+			ch <- prometheus.MustNewConstMetric(notReadyDesc, prometheus.GaugeValue, now.Sub(since).Seconds(), database.Namespace, database.Name, database.Status.Phase)
+		}
+
+		rotated := database.CreationTimestamp.Time
+		if database.Status.LastRotated != nil {
+			rotated = database.Status.LastRotated.Time
+		}
+		ch <- prometheus.MustNewConstMetric(passwordAgeDesc, prometheus.GaugeValue, now.Sub(rotated).Seconds(), database.Namespace, database.Name)
+	}
+	for key, count := range counts {
+		ch <- prometheus.MustNewConstMetric(databasesDesc, prometheus.GaugeValue, float64(count), key.server, key.phase)
+	}
+}
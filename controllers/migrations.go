@@ -0,0 +1,116 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+	db "flow.stacc.dev/database-provisioning-poc/pkg/db"
+)
+
+// errInvalidMigrations is returned when the source of the migrations of a database is ambiguous
+var errInvalidMigrations = errors.New("exactly one of configMap and path must be set for migrations")
+
+// migrationsDir returns the directory containing the migrations of a database and a function to call when done with it.
+// Migrations from a config map are written to a temporary directory, a path has to be in the migrations root of the controller.
+func (r *DatabaseReconciler) migrationsDir(ctx context.Context, database *databasev1alpha1.Database) (string, func(), error) {
+	migrations := database.Spec.Migrations
+	if (migrations.ConfigMap == "") == (migrations.Path == "") {
+		return "", nil, errInvalidMigrations
+	}
+	if migrations.Path != "" {
+		if err := db.ValidateMigrationsPath(r.MigrationsRoot, migrations.Path); err != nil {
+			return "", nil, err
+		}
+		// Symlinks in the root must not lead out of it
+		root, err := filepath.EvalSymlinks(r.MigrationsRoot)
+		if err != nil {
+			return "", nil, err
+		}
+		dir, err := filepath.EvalSymlinks(migrations.Path)
+		if err != nil {
+			return "", nil, err
+		}
+		if err := db.ValidateMigrationsPath(root, dir); err != nil {
+			return "", nil, err
+		}
+		return dir, func() {}, nil
+	}
+
+	var configMap corev1.ConfigMap
+	if err := r.Get(ctx, client.ObjectKey{Namespace: database.Namespace, Name: migrations.ConfigMap}, &configMap); err != nil {
+		return "", nil, err
+	}
+	dir, err := ioutil.TempDir("", "migrations")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	files := make(map[string][]byte, len(configMap.Data)+len(configMap.BinaryData))
+	for name, data := range configMap.Data {
+		files[name] = []byte(data)
+	}
+	for name, data := range configMap.BinaryData {
+		files[name] = data
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			cleanup()
+			return "", nil, err
+		}
+	}
+	return dir, cleanup, nil
+}
+
+// applyMigrations runs the migrations of a database as its user and records the resulting version in the status
+func (r *DatabaseReconciler) applyMigrations(ctx context.Context, sqlServer db.SQLServer, database *databasev1alpha1.Database, target db.Database) (string, error) {
+	migrator, ok := sqlServer.(db.Migrator)
+	if !ok {
+		return "unable to apply migrations", fmt.Errorf("%w: migrations are not supported", db.ErrUnsupportedType)
+	}
+	dir, cleanup, err := r.migrationsDir(ctx, database)
+	if err != nil {
+		return "unable to read migrations", err
+	}
+	defer cleanup()
+
+	var version *uint
+	if database.Spec.Migrations.Version != nil {
+		v := uint(*database.Spec.Migrations.Version)
+		version = &v
+	}
+	state, msg, err := db.Migrate(migrator, target, dir, version, database.Spec.Migrations.AllowDown)
+	if state != nil {
+		status := &databasev1alpha1.MigrationStatus{Version: int64(state.Version), Dirty: state.Dirty}
+		if database.Status.Migrations == nil || *database.Status.Migrations != *status {
+			database.Status.Migrations = status
+			if statusErr := r.Status().Update(ctx, database); statusErr != nil {
+				return "unable to update database status", statusErr
+			}
+		}
+	}
+	return msg, err
+}
@@ -0,0 +1,219 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+	db "flow.stacc.dev/database-provisioning-poc/pkg/db"
+	"flow.stacc.dev/database-provisioning-poc/pkg/secrets"
+	"flow.stacc.dev/database-provisioning-poc/pkg/servers"
+)
+
+// errInvalidServer is returned when a database has neither a server nor a server selector
+var errInvalidServer = errors.New("either server or serverSelector must be set")
+
+// errServerChanged is returned when the server of a database is changed after it was placed
+var errServerChanged = errors.New("the server of a database can not be changed")
+
+// errNoServer is returned when no ready database server matches the selector and placement of a database
+var errNoServer = errors.New("no database server available")
+
+// placeDatabase returns the database server of a database, selecting one by its selector and placement the first time.
+// The server is recorded in the status, and does not change afterwards.
+func (r *DatabaseReconciler) placeDatabase(ctx context.Context, database *databasev1alpha1.Database) (string, error) {
+	if database.Status.Server != nil {
+		if database.Spec.Server.Name != "" && servers.SpecRef(database) != servers.Ref(*database.Status.Server) {
+			return "invalid server", fmt.Errorf("%w: database is created on %s/%s", errServerChanged, database.Status.Server.Namespace, database.Status.Server.Name)
+		}
+		return "", nil
+	}
+
+	var server databasev1alpha1.Server
+	switch {
+	case database.Spec.Server.Name != "":
+		server = servers.SpecRef(database)
+	case database.Spec.ServerSelector != nil:
+		selected, err := r.selectServer(ctx, database)
+		if err != nil {
+			return "unable to select database server", err
+		}
+		server = servers.RefTo(selected)
+		r.Recorder.Eventf(database, corev1.EventTypeNormal, "ServerSelected", "Placed database on %s %s", server.Kind, serverName(server))
+	default:
+		return "invalid server", errInvalidServer
+	}
+
+	database.Status.Server = &server
+	if err := r.Status().Update(ctx, database); err != nil {
+		return "unable to update database status", err
+	}
+	return "", nil
+}
+
+// selectServer returns the ready database server matching the selector, type and affinities of a database
+// which is preferred by its placement policy. Ties are broken by namespace and name of the servers.
+func (r *DatabaseReconciler) selectServer(ctx context.Context, database *databasev1alpha1.Database) (*databasev1alpha1.DatabaseServer, error) {
+	placement := databasev1alpha1.Placement{}
+	if database.Spec.Placement != nil {
+		placement = *database.Spec.Placement
+	}
+	selector, err := metav1.LabelSelectorAsSelector(database.Spec.ServerSelector)
+	if err != nil {
+		return nil, err
+	}
+	var affinity, antiAffinity labels.Selector
+	if placement.Affinity != nil {
+		if affinity, err = metav1.LabelSelectorAsSelector(placement.Affinity); err != nil {
+			return nil, err
+		}
+	}
+	if placement.AntiAffinity != nil {
+		if antiAffinity, err = metav1.LabelSelectorAsSelector(placement.AntiAffinity); err != nil {
+			return nil, err
+		}
+	}
+
+	candidateServers, err := servers.List(ctx, r, selector)
+	if err != nil {
+		return nil, err
+	}
+	var databases databasev1alpha1.DatabaseList
+	if err := r.List(ctx, &databases); err != nil {
+		return nil, err
+	}
+
+	// Count the databases on each server, and find the servers hosting databases matching the affinities
+	counts := map[databasev1alpha1.Server]int{}
+	affine := map[databasev1alpha1.Server]bool{}
+	antiAffine := map[databasev1alpha1.Server]bool{}
+	for i := range databases.Items {
+		other := &databases.Items[i]
+		if other.Namespace == database.Namespace && other.Name == database.Name {
+			continue
+		}
+		// Databases waiting to be placed are on no server yet
+		if other.Status.Server == nil && other.Spec.Server.Name == "" {
+			continue
+		}
+		key := servers.DatabaseRef(other)
+		counts[key]++
+		// Affinities only match databases of the same namespace, so other tenants can not steer or learn about the placement
+		if other.Namespace != database.Namespace {
+			continue
+		}
+		if affinity != nil && affinity.Matches(labels.Set(other.Labels)) {
+			affine[key] = true
+		}
+		if antiAffinity != nil && antiAffinity.Matches(labels.Set(other.Labels)) {
+			antiAffine[key] = true
+		}
+	}
+
+	sort.Slice(candidateServers, func(i, j int) bool {
+		if candidateServers[i].Namespace != candidateServers[j].Namespace {
+			return candidateServers[i].Namespace < candidateServers[j].Namespace
+		}
+		return candidateServers[i].Name < candidateServers[j].Name
+	})
+	var candidates []*databasev1alpha1.DatabaseServer
+	for i := range candidateServers {
+		server := &candidateServers[i]
+		key := servers.RefTo(server)
+		if database.Spec.ServerType != "" && server.Spec.Type != database.Spec.ServerType {
+			continue
+		}
+		if !databasev1alpha1.IsConditionTrue(server.Status.Conditions, databasev1alpha1.ConditionReady) {
+			continue
+		}
+		if (affinity != nil && !affine[key]) || antiAffine[key] {
+			continue
+		}
+		// Servers the namespace has not been granted are never considered
+		allowed, err := servers.AllowsNamespace(ctx, r, server, database.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		if !allowed {
+			continue
+		}
+		candidates = append(candidates, server)
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("%w: no ready database server matches the selector and placement", errNoServer)
+	}
+
+	switch placement.Policy {
+	case databasev1alpha1.PlacementRoundRobin:
+		return r.roundRobin.Next(candidates), nil
+	case databasev1alpha1.PlacementLeastDiskUsed:
+		var selected *databasev1alpha1.DatabaseServer
+		var least int64
+		for _, server := range candidates {
+			size, err := r.diskUsage(ctx, server)
+			if err != nil {
+				return nil, fmt.Errorf("unable to get disk usage of server %s/%s: %w", server.Namespace, server.Name, err)
+			}
+			if selected == nil || size < least {
+				selected, least = server, size
+			}
+		}
+		return selected, nil
+	default:
+		selected := candidates[0]
+		for _, server := range candidates[1:] {
+			if counts[servers.RefTo(server)] < counts[servers.RefTo(selected)] {
+				selected = server
+			}
+		}
+		return selected, nil
+	}
+}
+
+// diskUsage returns the disk space used by the databases on a server
+func (r *DatabaseReconciler) diskUsage(ctx context.Context, server *databasev1alpha1.DatabaseServer) (int64, error) {
+	secret, err := secrets.Get(ctx, r, server.Spec.Secret)
+	if err != nil {
+		return 0, err
+	}
+	sqlServer, _, err := r.Connections.Get(server, string(secret.Data["password"]))
+	if err != nil {
+		return 0, err
+	}
+	diskUser, ok := sqlServer.(db.DiskUser)
+	if !ok {
+		return 0, fmt.Errorf("%w: disk usage is not reported for %q", db.ErrUnsupportedType, server.Spec.Type)
+	}
+	size, _, err := diskUser.DiskUsage()
+	return size, err
+}
+
+// serverName returns the name of a database server for messages, with its namespace if it has one
+func serverName(server databasev1alpha1.Server) string {
+	if server.Namespace == "" {
+		return server.Name
+	}
+	return server.Namespace + "/" + server.Name
+}
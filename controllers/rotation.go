@@ -0,0 +1,192 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/sethvargo/go-password/password"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+	db "flow.stacc.dev/database-provisioning-poc/pkg/db"
+)
+
+// generatePassword generates a password with length 48, 10 digits, allow uppercase, allow repeated chars
+func generatePassword() (string, error) {
+	return password.Generate(48, 10, 0, false, true)
+}
+
+// nextPasswordRotation returns when the password is due to be rotated, or nil if it is only rotated on request.
+// Passwords which have never been rotated are as old as the secret holding them.
+func nextPasswordRotation(database *databasev1alpha1.Database, secret *corev1.Secret) *time.Time {
+	rotation := database.Spec.PasswordRotation
+	if rotation == nil || rotation.Interval == nil || rotation.Interval.Duration <= 0 {
+		return nil
+	}
+	last := secret.CreationTimestamp.Time
+	if database.Status.LastRotated != nil {
+		last = database.Status.LastRotated.Time
+	}
+	next := last.Add(rotation.Interval.Duration)
+	return &next
+}
+
+// passwordRotationDue reports whether the password should be rotated now, either because
+// the interval has passed or because a new rotation was requested through the annotation
+func passwordRotationDue(database *databasev1alpha1.Database, secret *corev1.Secret) bool {
+	if request := database.Annotations[databasev1alpha1.RotatePasswordAnnotation]; request != "" && request != database.Status.LastRotationRequest {
+		return true
+	}
+	next := nextPasswordRotation(database, secret)
+	return next != nil && !time.Now().Before(*next)
+}
+
+// databaseUsername returns the username of a database, which defaults to the name of the database
+func databaseUsername(database *databasev1alpha1.Database) string {
+	if database.Spec.Username != "" {
+		return database.Spec.Username
+	}
+	return database.Spec.Name
+}
+
+// dualUserRotation reports whether the database alternates between two users when rotating
+func dualUserRotation(database *databasev1alpha1.Database) bool {
+	return database.Spec.PasswordRotation != nil && database.Spec.PasswordRotation.Mode == databasev1alpha1.RotationModeDual
+}
+
+// databaseUsers returns the users provisioned on the server for a database
+func databaseUsers(database *databasev1alpha1.Database, username string) []string {
+	if dualUserRotation(database) {
+		return []string{username + "_a", username + "_b"}
+	}
+	return []string{username}
+}
+
+// rotationUsers returns every user a database may have provisioned on the server in either rotation mode,
+// so users left by switching modes are deleted with the database
+func rotationUsers(username string) []string {
+	return []string{username, username + "_a", username + "_b"}
+}
+
+// validateNames checks that the engine of a server can represent the names of a database and its users,
+// and that none of the users is the admin user of the server. This covers clusters running without the
+// validating webhook and databases placed on a server by a selector.
+func validateNames(spec *databasev1alpha1.DatabaseServerSpec, database *databasev1alpha1.Database) error {
+	if err := db.ValidateDatabaseName(spec.Type, database.Spec.Name); err != nil {
+		return err
+	}
+	for _, user := range databaseUsers(database, databaseUsername(database)) {
+		if err := db.ValidateUsername(spec.Type, user); err != nil {
+			return err
+		}
+		if err := db.ValidateNotAdmin(spec, user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ownedUsers returns the users the controller created on the server for a database. Databases provisioned
+// before the users were recorded own the users of both rotation modes, which only the controller created then.
+func ownedUsers(database *databasev1alpha1.Database) []string {
+	if len(database.Status.Users) == 0 && databasev1alpha1.IsConditionTrue(database.Status.Conditions, databasev1alpha1.ConditionUserProvisioned) {
+		return rotationUsers(databaseUsername(database))
+	}
+	return database.Status.Users
+}
+
+// ownedDatabase reports whether the database on the server was created by the controller. Databases provisioned
+// before the databases were recorded were only created by the controller then.
+func ownedDatabase(database *databasev1alpha1.Database) bool {
+	if len(database.Status.Databases) == 0 && databasev1alpha1.IsConditionTrue(database.Status.Conditions, databasev1alpha1.ConditionDatabaseProvisioned) {
+		return true
+	}
+	return containsString(database.Status.Databases, database.Spec.Name)
+}
+
+// activeUser returns the user the secret holds credentials for. With dual user rotation this is
+// the user last rotated to, or the first of the two users before the first rotation.
+func activeUser(database *databasev1alpha1.Database, secret *corev1.Secret, username string) string {
+	users := databaseUsers(database, username)
+	for _, user := range users {
+		if database.Status.ActiveUser == user {
+			return user
+		}
+	}
+	if secret != nil {
+		for _, user := range users {
+			if string(secret.Data["username"]) == user {
+				return user
+			}
+		}
+	}
+	return users[0]
+}
+
+// rotatePassword changes the password of the user, first on the server and then in the secret.
+// If the secret can not be updated the old password is restored on the server, so applications
+// keep working with the credentials they have.
+// With dual user rotation the password of the inactive user is changed instead, and the secret
+// is switched over to that user. The active user is left alone until the next rotation.
+func (r *DatabaseReconciler) rotatePassword(ctx context.Context, sqlServer db.SQLServer, database *databasev1alpha1.Database, secret *corev1.Secret, target db.Database) (string, error) {
+	newPass, err := generatePassword()
+	if err != nil {
+		return "unable to generate password", err
+	}
+
+	rotated := target
+	rotated.Password = newPass
+	dual := dualUserRotation(database)
+	if dual {
+		for _, user := range databaseUsers(database, databaseUsername(database)) {
+			if user != target.Username {
+				rotated.Username = user
+			}
+		}
+	}
+	if msg, err := sqlServer.UpdatePassword(rotated); err != nil {
+		return msg, err
+	}
+
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	secret.Data["username"] = []byte(rotated.Username)
+	secret.Data["password"] = []byte(newPass)
+	// The update is rejected if the secret changed since it was read, which also restores the old password
+	if err := r.Update(ctx, secret); err != nil {
+		// The inactive user is not in use, so there is nothing to restore
+		if !dual {
+			if msg, restoreErr := sqlServer.UpdatePassword(target); restoreErr != nil {
+				r.Log.Error(restoreErr, msg, "database", database.Name, "namespace", database.Namespace)
+			}
+		}
+		return "unable to update secret with rotated password", err
+	}
+
+	now := metav1.Now()
+	database.Status.ActiveUser = rotated.Username
+	database.Status.LastRotated = &now
+	database.Status.LastRotationRequest = database.Annotations[databasev1alpha1.RotatePasswordAnnotation]
+	if err := r.Status().Update(ctx, database); err != nil {
+		return "unable to record password rotation in database status", err
+	}
+	return "Password rotated successfully", nil
+}
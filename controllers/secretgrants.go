@@ -0,0 +1,63 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+)
+
+// secretGrantRequests returns the resources of a kind keeping credentials in the namespace of a changed DatabaseSecretGrant,
+// so resources waiting for a grant are reconciled when it is created and those losing it when it is removed
+func secretGrantRequests(c client.Reader, kind string) handler.ToRequestsFunc {
+	return func(obj handler.MapObject) []reconcile.Request {
+		ctx := context.Background()
+		namespace := obj.Meta.GetNamespace()
+
+		var requests []reconcile.Request
+		add := func(meta types.NamespacedName, secret databasev1alpha1.Secret) {
+			if secret.Namespace == namespace && meta.Namespace != namespace {
+				requests = append(requests, reconcile.Request{NamespacedName: meta})
+			}
+		}
+		switch kind {
+		case databasev1alpha1.DatabaseKind:
+			var databases databasev1alpha1.DatabaseList
+			if err := c.List(ctx, &databases); err != nil {
+				return nil
+			}
+			for _, database := range databases.Items {
+				add(types.NamespacedName{Namespace: database.Namespace, Name: database.Name}, database.Spec.Secret)
+			}
+		case databasev1alpha1.DatabaseUserKind:
+			var users databasev1alpha1.DatabaseUserList
+			if err := c.List(ctx, &users); err != nil {
+				return nil
+			}
+			for _, user := range users.Items {
+				add(types.NamespacedName{Namespace: user.Namespace, Name: user.Name}, user.Spec.Secret)
+			}
+		}
+		return requests
+	}
+}
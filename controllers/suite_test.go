@@ -19,11 +19,13 @@ package controllers
 import (
 	"path/filepath"
 	"testing"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/envtest"
 	"sigs.k8s.io/controller-runtime/pkg/envtest/printer"
@@ -31,6 +33,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+	db "flow.stacc.dev/database-provisioning-poc/pkg/db"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -40,6 +43,13 @@ import (
 var cfg *rest.Config
 var k8sClient client.Client
 var testEnv *envtest.Environment
+var stopManager chan struct{}
+
+// Specs wait this long for the controllers to reconcile
+const (
+	timeout  = 20 * time.Second
+	interval = 250 * time.Millisecond
+)
 
 func TestAPIs(t *testing.T) {
 	RegisterFailHandler(Fail)
@@ -74,11 +84,59 @@ var _ = BeforeSuite(func(done Done) {
 	Expect(err).ToNot(HaveOccurred())
 	Expect(k8sClient).ToNot(BeNil())
 
+	// The controllers provision on fake database servers, kept in memory by the specs
+	db.Register(func(spec *databasev1alpha1.DatabaseServerSpec, password string) db.SQLServer {
+		return fakeServerFor(spec.Postgres.Host)
+	}, fakeServerType)
+	db.RegisterRules(db.Rules{Section: "postgres"}, fakeServerType)
+
+	mgr, err := ctrl.NewManager(cfg, ctrl.Options{Scheme: scheme.Scheme, MetricsBindAddress: "0"})
+	Expect(err).ToNot(HaveOccurred())
+	Expect(IndexFields(mgr)).To(Succeed())
+	connections := db.NewConnections()
+	Expect((&DatabaseServerReconciler{
+		Client:      mgr.GetClient(),
+		Log:         ctrl.Log.WithName("controllers").WithName("DatabaseServer"),
+		Scheme:      mgr.GetScheme(),
+		Recorder:    mgr.GetEventRecorderFor("database-controller"),
+		Connections: connections,
+	}).SetupWithManager(mgr)).To(Succeed())
+	Expect((&ClusterDatabaseServerReconciler{
+		Client:      mgr.GetClient(),
+		Log:         ctrl.Log.WithName("controllers").WithName("ClusterDatabaseServer"),
+		Scheme:      mgr.GetScheme(),
+		Recorder:    mgr.GetEventRecorderFor("database-controller"),
+		Connections: connections,
+	}).SetupWithManager(mgr)).To(Succeed())
+	Expect((&DatabaseReconciler{
+		Client:      mgr.GetClient(),
+		Log:         ctrl.Log.WithName("controllers").WithName("Database"),
+		Scheme:      mgr.GetScheme(),
+		Recorder:    mgr.GetEventRecorderFor("database-controller"),
+		Connections: connections,
+	}).SetupWithManager(mgr)).To(Succeed())
+	Expect((&DatabaseUserReconciler{
+		Client:      mgr.GetClient(),
+		Log:         ctrl.Log.WithName("controllers").WithName("DatabaseUser"),
+		Scheme:      mgr.GetScheme(),
+		Recorder:    mgr.GetEventRecorderFor("database-controller"),
+		Connections: connections,
+	}).SetupWithManager(mgr)).To(Succeed())
+
+	stopManager = make(chan struct{})
+	go func() {
+		defer GinkgoRecover()
+		Expect(mgr.Start(stopManager)).To(Succeed())
+	}()
+
 	close(done)
 }, 60)
 
 var _ = AfterSuite(func() {
 	By("tearing down the test environment")
+	if stopManager != nil {
+		close(stopManager)
+	}
 	err := testEnv.Stop()
 	Expect(err).ToNot(HaveOccurred())
 })
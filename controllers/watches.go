@@ -0,0 +1,327 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+	"flow.stacc.dev/database-provisioning-poc/pkg/servers"
+)
+
+// Fields resources are indexed by in the cache, so the resources affected by a change of another resource are found without listing all of them
+const (
+	// databaseServerField is the database server a database is created on, or an empty string while it waits for placement
+	databaseServerField = ".spec.server"
+	// databaseSecretField is the secret a database keeps its credentials in
+	databaseSecretField = ".spec.secret"
+	// databaseSourceField is the database resource a database is copied from
+	databaseSourceField = ".spec.source.database"
+	// databaseMigrationsField is the config map a database reads its migrations from
+	databaseMigrationsField = ".spec.migrations.configMap"
+	// serverSecretField is the admin secret of a database server
+	serverSecretField = ".spec.secret"
+	// dependentDatabaseField is the database resource a database user, backup or restore uses
+	dependentDatabaseField = ".spec.database"
+	// restoreBackupField is the database backup a restore restores the last dump of
+	restoreBackupField = ".spec.source.backup"
+	// claimClassField is the database class a claim is provisioned by
+	claimClassField = ".spec.className"
+)
+
+// serverKey returns the value databases on a database server are indexed by
+func serverKey(server databasev1alpha1.Server) string {
+	return server.Kind + "/" + serverName(server)
+}
+
+// IndexFields adds the indexes used by the watches of the controllers to the cache of the manager.
+// It is called once, before the controllers are set up.
+func IndexFields(mgr ctrl.Manager) error {
+	if err := indexDatabases(mgr); err != nil {
+		return err
+	}
+	if err := indexServers(mgr); err != nil {
+		return err
+	}
+	if err := indexDependents(mgr); err != nil {
+		return err
+	}
+	return mgr.GetFieldIndexer().IndexField(&databasev1alpha1.DatabaseClaim{}, claimClassField, func(obj runtime.Object) []string {
+		return []string{obj.(*databasev1alpha1.DatabaseClaim).Spec.ClassName}
+	})
+}
+
+// indexDatabases adds the indexes of databases to the cache of the manager
+func indexDatabases(mgr ctrl.Manager) error {
+	indexer := mgr.GetFieldIndexer()
+	if err := indexer.IndexField(&databasev1alpha1.Database{}, databaseServerField, func(obj runtime.Object) []string {
+		database := obj.(*databasev1alpha1.Database)
+		if database.Status.Server == nil && database.Spec.Server.Name == "" {
+			return []string{""}
+		}
+		return []string{serverKey(servers.DatabaseRef(database))}
+	}); err != nil {
+		return err
+	}
+	if err := indexer.IndexField(&databasev1alpha1.Database{}, databaseSecretField, func(obj runtime.Object) []string {
+		database := obj.(*databasev1alpha1.Database)
+		namespace := database.Spec.Secret.Namespace
+		if namespace == "" {
+			namespace = database.Namespace
+		}
+		return []string{types.NamespacedName{Namespace: namespace, Name: database.Spec.Secret.Name}.String()}
+	}); err != nil {
+		return err
+	}
+	if err := indexer.IndexField(&databasev1alpha1.Database{}, databaseMigrationsField, func(obj runtime.Object) []string {
+		database := obj.(*databasev1alpha1.Database)
+		if database.Spec.Migrations == nil || database.Spec.Migrations.ConfigMap == "" {
+			return nil
+		}
+		return []string{types.NamespacedName{Namespace: database.Namespace, Name: database.Spec.Migrations.ConfigMap}.String()}
+	}); err != nil {
+		return err
+	}
+	return indexer.IndexField(&databasev1alpha1.Database{}, databaseSourceField, func(obj runtime.Object) []string {
+		database := obj.(*databasev1alpha1.Database)
+		if database.Spec.Source == nil || database.Spec.Source.Database == nil {
+			return nil
+		}
+		namespace := database.Spec.Source.Database.Namespace
+		if namespace == "" {
+			namespace = database.Namespace
+		}
+		return []string{types.NamespacedName{Namespace: namespace, Name: database.Spec.Source.Database.Name}.String()}
+	})
+}
+
+// indexServers adds the indexes of database servers of both kinds to the cache of the manager
+func indexServers(mgr ctrl.Manager) error {
+	indexer := mgr.GetFieldIndexer()
+	if err := indexer.IndexField(&databasev1alpha1.DatabaseServer{}, serverSecretField, func(obj runtime.Object) []string {
+		server := obj.(*databasev1alpha1.DatabaseServer)
+		// The admin secret of a DatabaseServer is in its own namespace
+		return []string{types.NamespacedName{Namespace: server.Namespace, Name: server.Spec.Secret.Name}.String()}
+	}); err != nil {
+		return err
+	}
+	return indexer.IndexField(&databasev1alpha1.ClusterDatabaseServer{}, serverSecretField, func(obj runtime.Object) []string {
+		server := obj.(*databasev1alpha1.ClusterDatabaseServer)
+		return []string{types.NamespacedName{Namespace: server.Spec.Secret.Namespace, Name: server.Spec.Secret.Name}.String()}
+	})
+}
+
+// indexDependents adds the indexes of the resources using a database to the cache of the manager.
+// They only use databases in their own namespace.
+func indexDependents(mgr ctrl.Manager) error {
+	indexer := mgr.GetFieldIndexer()
+	if err := indexer.IndexField(&databasev1alpha1.DatabaseUser{}, dependentDatabaseField, func(obj runtime.Object) []string {
+		user := obj.(*databasev1alpha1.DatabaseUser)
+		return []string{types.NamespacedName{Namespace: user.Namespace, Name: user.Spec.Database.Name}.String()}
+	}); err != nil {
+		return err
+	}
+	if err := indexer.IndexField(&databasev1alpha1.DatabaseBackup{}, dependentDatabaseField, func(obj runtime.Object) []string {
+		backup := obj.(*databasev1alpha1.DatabaseBackup)
+		return []string{types.NamespacedName{Namespace: backup.Namespace, Name: backup.Spec.Database.Name}.String()}
+	}); err != nil {
+		return err
+	}
+	if err := indexer.IndexField(&databasev1alpha1.DatabaseRestore{}, dependentDatabaseField, func(obj runtime.Object) []string {
+		restore := obj.(*databasev1alpha1.DatabaseRestore)
+		var values []string
+		if restore.Spec.Database != nil {
+			values = append(values, types.NamespacedName{Namespace: restore.Namespace, Name: restore.Spec.Database.Name}.String())
+		}
+		if restore.Spec.NewDatabase != nil {
+			values = append(values, types.NamespacedName{Namespace: restore.Namespace, Name: restore.Spec.NewDatabase.Name}.String())
+		}
+		return values
+	}); err != nil {
+		return err
+	}
+	return indexer.IndexField(&databasev1alpha1.DatabaseRestore{}, restoreBackupField, func(obj runtime.Object) []string {
+		restore := obj.(*databasev1alpha1.DatabaseRestore)
+		if restore.Spec.Source.Backup == "" {
+			return nil
+		}
+		return []string{types.NamespacedName{Namespace: restore.Namespace, Name: restore.Spec.Source.Backup}.String()}
+	})
+}
+
+// indexedRequests returns the resources of a list type with an indexed field set to a value
+func indexedRequests(c client.Reader, list runtime.Object, field, value string) []reconcile.Request {
+	list = list.DeepCopyObject()
+	if err := c.List(context.Background(), list, client.MatchingField(field, value)); err != nil {
+		return nil
+	}
+	items, err := apimeta.ExtractList(list)
+	if err != nil {
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(items))
+	for _, item := range items {
+		object, err := apimeta.Accessor(item)
+		if err != nil {
+			continue
+		}
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: object.GetNamespace(), Name: object.GetName()}})
+	}
+	return requests
+}
+
+// databaseRequests returns the databases with an indexed field set to a value
+func databaseRequests(c client.Reader, field, value string) []reconcile.Request {
+	return indexedRequests(c, &databasev1alpha1.DatabaseList{}, field, value)
+}
+
+// serverDatabaseRequests returns the databases on a changed database server of a kind, so they are reconciled when it becomes ready,
+// together with the databases waiting for a server to be placed on
+func serverDatabaseRequests(c client.Reader, kind string) handler.ToRequestsFunc {
+	return func(obj handler.MapObject) []reconcile.Request {
+		server := databasev1alpha1.Server{Kind: kind, Name: obj.Meta.GetName(), Namespace: obj.Meta.GetNamespace()}
+		return append(databaseRequests(c, databaseServerField, serverKey(server)), databaseRequests(c, databaseServerField, "")...)
+	}
+}
+
+// secretDatabases returns the databases keeping credentials in a secret, and the databases on the database servers it is the admin secret of
+func secretDatabases(c client.Reader, secret types.NamespacedName) []reconcile.Request {
+	requests := databaseRequests(c, databaseSecretField, secret.String())
+	for _, kind := range []string{databasev1alpha1.DatabaseServerKind, databasev1alpha1.ClusterDatabaseServerKind} {
+		for _, server := range adminSecretServers(c, kind, secret) {
+			ref := databasev1alpha1.Server{Kind: kind, Namespace: server.Namespace, Name: server.Name}
+			requests = append(requests, databaseRequests(c, databaseServerField, serverKey(ref))...)
+		}
+	}
+	return requests
+}
+
+// secretDatabaseRequests returns the databases keeping credentials in a changed secret,
+// and the databases on the database servers it is the admin secret of
+func secretDatabaseRequests(c client.Reader) handler.ToRequestsFunc {
+	return func(obj handler.MapObject) []reconcile.Request {
+		return secretDatabases(c, types.NamespacedName{Namespace: obj.Meta.GetNamespace(), Name: obj.Meta.GetName()})
+	}
+}
+
+// sourceDatabaseRequests returns the databases copied from a changed database, so they are created once it is provisioned
+func sourceDatabaseRequests(c client.Reader) handler.ToRequestsFunc {
+	return func(obj handler.MapObject) []reconcile.Request {
+		source := types.NamespacedName{Namespace: obj.Meta.GetNamespace(), Name: obj.Meta.GetName()}
+		return databaseRequests(c, databaseSourceField, source.String())
+	}
+}
+
+// configMapDatabaseRequests returns the databases reading their migrations from a changed config map
+func configMapDatabaseRequests(c client.Reader) handler.ToRequestsFunc {
+	return func(obj handler.MapObject) []reconcile.Request {
+		configMap := types.NamespacedName{Namespace: obj.Meta.GetNamespace(), Name: obj.Meta.GetName()}
+		return databaseRequests(c, databaseMigrationsField, configMap.String())
+	}
+}
+
+// databaseServerRequests returns the database server of a kind a changed database is created on,
+// so a server being deleted is deleted once the last database on it is gone
+func databaseServerRequests(kind string) handler.ToRequestsFunc {
+	return func(obj handler.MapObject) []reconcile.Request {
+		database, ok := obj.Object.(*databasev1alpha1.Database)
+		if !ok {
+			return nil
+		}
+		server := servers.DatabaseRef(database)
+		if server.Kind != kind || server.Name == "" {
+			return nil
+		}
+		return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: server.Namespace, Name: server.Name}}}
+	}
+}
+
+// adminSecretServers returns the database servers of a kind using a secret as admin secret
+func adminSecretServers(c client.Reader, kind string, secret types.NamespacedName) []reconcile.Request {
+	switch kind {
+	case databasev1alpha1.DatabaseServerKind:
+		return indexedRequests(c, &databasev1alpha1.DatabaseServerList{}, serverSecretField, secret.String())
+	case databasev1alpha1.ClusterDatabaseServerKind:
+		return indexedRequests(c, &databasev1alpha1.ClusterDatabaseServerList{}, serverSecretField, secret.String())
+	}
+	return nil
+}
+
+// adminSecretRequests returns the database servers of a kind using a changed secret as admin secret
+func adminSecretRequests(c client.Reader, kind string) handler.ToRequestsFunc {
+	return func(obj handler.MapObject) []reconcile.Request {
+		return adminSecretServers(c, kind, types.NamespacedName{Namespace: obj.Meta.GetNamespace(), Name: obj.Meta.GetName()})
+	}
+}
+
+// dependentRequests returns the resources of a list type using the databases of requests
+func dependentRequests(c client.Reader, list runtime.Object, databases []reconcile.Request) []reconcile.Request {
+	var requests []reconcile.Request
+	for _, database := range databases {
+		requests = append(requests, indexedRequests(c, list, dependentDatabaseField, database.NamespacedName.String())...)
+	}
+	return requests
+}
+
+// databaseDependentRequests returns the resources of a list type using a changed database,
+// so they are reconciled when it becomes ready or its credentials change
+func databaseDependentRequests(c client.Reader, list runtime.Object) handler.ToRequestsFunc {
+	return func(obj handler.MapObject) []reconcile.Request {
+		database := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: obj.Meta.GetNamespace(), Name: obj.Meta.GetName()}}
+		return dependentRequests(c, list, []reconcile.Request{database})
+	}
+}
+
+// serverDependentRequests returns the resources of a list type using the databases on a changed database server of a kind
+func serverDependentRequests(c client.Reader, list runtime.Object, kind string) handler.ToRequestsFunc {
+	return func(obj handler.MapObject) []reconcile.Request {
+		server := databasev1alpha1.Server{Kind: kind, Name: obj.Meta.GetName(), Namespace: obj.Meta.GetNamespace()}
+		return dependentRequests(c, list, databaseRequests(c, databaseServerField, serverKey(server)))
+	}
+}
+
+// secretDependentRequests returns the resources of a list type using the databases keeping credentials in a changed secret,
+// or on the database servers it is the admin secret of
+func secretDependentRequests(c client.Reader, list runtime.Object) handler.ToRequestsFunc {
+	return func(obj handler.MapObject) []reconcile.Request {
+		secret := types.NamespacedName{Namespace: obj.Meta.GetNamespace(), Name: obj.Meta.GetName()}
+		return dependentRequests(c, list, secretDatabases(c, secret))
+	}
+}
+
+// backupRestoreRequests returns the restores of the last dump of a changed database backup
+func backupRestoreRequests(c client.Reader) handler.ToRequestsFunc {
+	return func(obj handler.MapObject) []reconcile.Request {
+		backup := types.NamespacedName{Namespace: obj.Meta.GetNamespace(), Name: obj.Meta.GetName()}
+		return indexedRequests(c, &databasev1alpha1.DatabaseRestoreList{}, restoreBackupField, backup.String())
+	}
+}
+
+// classClaimRequests returns the claims provisioned by a changed database class, so they are bound once it is created
+func classClaimRequests(c client.Reader) handler.ToRequestsFunc {
+	return func(obj handler.MapObject) []reconcile.Request {
+		return indexedRequests(c, &databasev1alpha1.DatabaseClaimList{}, claimClassField, obj.Meta.GetName())
+	}
+}
@@ -19,16 +19,22 @@ package main
 import (
 	"flag"
 	"os"
+	"time"
 
-	kubernetes "flow.stacc.dev/database-provisioning-poc/pkg/kubernetes"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
 
 	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
 	"flow.stacc.dev/database-provisioning-poc/controllers"
+	db "flow.stacc.dev/database-provisioning-poc/pkg/db"
+	"flow.stacc.dev/database-provisioning-poc/pkg/labelcache"
+	"flow.stacc.dev/database-provisioning-poc/pkg/webhooks"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -47,26 +53,29 @@ func init() {
 func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
+	var enableWebhooks bool
+	var deletionTimeout time.Duration
+	var migrationsRoot string
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.BoolVar(&enableWebhooks, "enable-webhooks", false,
+		"Enable the admission webhooks. "+
+			"Requires the webhook and cert-manager sections of config/default to be enabled.")
+	flag.DurationVar(&deletionTimeout, "deletion-timeout", 0,
+		"How long deleting a database or user on its server is retried before the Database or DatabaseUser is deleted anyway, "+
+			"leaving them on the server. 0 retries until it succeeds.")
+	flag.StringVar(&migrationsRoot, "migrations-root", "",
+		"The directory migrations of Databases from a path have to be in, e.g. a volume of migrations. "+
+			"If empty, migrations are only read from config maps.")
 	flag.Parse()
 
 	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
 
-	client, err := kubernetes.NewClient("", "")
-	if err != nil {
-		setupLog.Error(err, "failed to create k8s client")
-	}
-
-	// Get k8s clientset
-	clientset, err := kubernetes.NewClientset(client)
-	if err != nil {
-		setupLog.Error(err, "failed to create k8s clientset")
-	}
-
+	// Only the secrets, config maps and jobs labelled for the controller are cached, not every one in the cluster
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+		NewCache:           labelcache.New(labels.SelectorFromSet(labels.Set{databasev1alpha1.WatchLabel: "true"})),
 		Scheme:             scheme,
 		MetricsBindAddress: metricsAddr,
 		Port:               9443,
@@ -78,28 +87,100 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Database servers are connected to once and shared by both controllers
+	connections := db.NewConnections()
+	metrics.Registry.MustRegister(connections)
+	metrics.Registry.MustRegister(controllers.NewDatabaseCollector(mgr.GetClient()))
+	if err := mgr.Add(manager.RunnableFunc(func(stop <-chan struct{}) error {
+		<-stop
+		connections.Close()
+		return nil
+	})); err != nil {
+		setupLog.Error(err, "unable to add connection cleanup to manager")
+		os.Exit(1)
+	}
+
+	if err := controllers.IndexFields(mgr); err != nil {
+		setupLog.Error(err, "unable to index fields")
+		os.Exit(1)
+	}
 	if err = (&controllers.DatabaseServerReconciler{
-		Client:              mgr.GetClient(),
-		Log:                 ctrl.Log.WithName("controllers").WithName("DatabaseServer"),
-		Scheme:              mgr.GetScheme(),
-		KubernetesClient:    client,
-		KubernetesClientset: clientset,
+		Client:      mgr.GetClient(),
+		Log:         ctrl.Log.WithName("controllers").WithName("DatabaseServer"),
+		Scheme:      mgr.GetScheme(),
+		Recorder:    mgr.GetEventRecorderFor("database-controller"),
+		Connections: connections,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "DatabaseServer")
 		os.Exit(1)
 	}
+	if err = (&controllers.ClusterDatabaseServerReconciler{
+		Client:      mgr.GetClient(),
+		Log:         ctrl.Log.WithName("controllers").WithName("ClusterDatabaseServer"),
+		Scheme:      mgr.GetScheme(),
+		Recorder:    mgr.GetEventRecorderFor("database-controller"),
+		Connections: connections,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "ClusterDatabaseServer")
+		os.Exit(1)
+	}
 	if err = (&controllers.DatabaseReconciler{
-		Client:              mgr.GetClient(),
-		Log:                 ctrl.Log.WithName("controllers").WithName("Database"),
-		Scheme:              mgr.GetScheme(),
-		KubernetesClient:    client,
-		KubernetesClientset: clientset,
+		Client:          mgr.GetClient(),
+		Log:             ctrl.Log.WithName("controllers").WithName("Database"),
+		Scheme:          mgr.GetScheme(),
+		Recorder:        mgr.GetEventRecorderFor("database-controller"),
+		Connections:     connections,
+		DeletionTimeout: deletionTimeout,
+		MigrationsRoot:  migrationsRoot,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Database")
 		os.Exit(1)
 	}
+	if err = (&controllers.DatabaseUserReconciler{
+		Client:          mgr.GetClient(),
+		Log:             ctrl.Log.WithName("controllers").WithName("DatabaseUser"),
+		Scheme:          mgr.GetScheme(),
+		Recorder:        mgr.GetEventRecorderFor("database-controller"),
+		Connections:     connections,
+		DeletionTimeout: deletionTimeout,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "DatabaseUser")
+		os.Exit(1)
+	}
+	if err = (&controllers.DatabaseBackupReconciler{
+		Client:    mgr.GetClient(),
+		APIReader: mgr.GetAPIReader(),
+		Log:       ctrl.Log.WithName("controllers").WithName("DatabaseBackup"),
+		Scheme:    mgr.GetScheme(),
+		Recorder:  mgr.GetEventRecorderFor("database-controller"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "DatabaseBackup")
+		os.Exit(1)
+	}
+	if err = (&controllers.DatabaseRestoreReconciler{
+		Client:   mgr.GetClient(),
+		Log:      ctrl.Log.WithName("controllers").WithName("DatabaseRestore"),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("database-controller"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "DatabaseRestore")
+		os.Exit(1)
+	}
+	if err = (&controllers.DatabaseClaimReconciler{
+		Client:   mgr.GetClient(),
+		Log:      ctrl.Log.WithName("controllers").WithName("DatabaseClaim"),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("database-controller"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "DatabaseClaim")
+		os.Exit(1)
+	}
 	// +kubebuilder:scaffold:builder
 
+	if enableWebhooks {
+		webhooks.Register(mgr, migrationsRoot)
+	}
+
 	setupLog.Info("starting manager")
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
 		setupLog.Error(err, "problem running manager")
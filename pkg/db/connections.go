@@ -0,0 +1,173 @@
+package db
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+)
+
+// Connections keeps one connected driver, and with it one pool of connections, per database server.
+// Reconciles of every database on a server share the pool instead of connecting on each reconcile.
+// A pool is replaced when the database server is recreated, or when its spec or admin password changes.
+type Connections struct {
+	mu    sync.Mutex
+	pools map[types.NamespacedName]*pool
+}
+
+type pool struct {
+	uid        types.UID
+	hash       string
+	serverType string
+	server     SQLServer
+}
+
+// statser is implemented by drivers backed by database/sql
+type statser interface {
+	Stats() sql.DBStats
+}
+
+// NewConnections creates an empty set of connections
+func NewConnections() *Connections {
+	return &Connections{pools: make(map[types.NamespacedName]*pool)}
+}
+
+// Get returns a connected driver for the database server, connecting to it if there is no pool for
+// the current spec and password of the server
+func (c *Connections) Get(databaseServer *databasev1alpha1.DatabaseServer, password string) (SQLServer, string, error) {
+	key := types.NamespacedName{Namespace: databaseServer.Namespace, Name: databaseServer.Name}
+	hash, err := hashServer(&databaseServer.Spec, password)
+	if err != nil {
+		return nil, "unable to hash database server spec", err
+	}
+
+	if server, ok := c.lookup(key, databaseServer.UID, hash); ok {
+		return server, "Reusing connection to database", nil
+	}
+
+	// Connecting is done without holding the lock, so an unreachable server does not block reconciles of the others
+	server, err := New(&databaseServer.Spec, password)
+	if err != nil {
+		return nil, "unable to create database server driver", err
+	}
+	if msg, err := server.Connect(); err != nil {
+		return nil, msg, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p, ok := c.pools[key]; ok {
+		if p.uid == databaseServer.UID && p.hash == hash {
+			// Another reconcile connected meanwhile, its pool is kept
+			server.Disconnect()
+			return p.server, "Reusing connection to database", nil
+		}
+		// Credentials or spec changed, the old pool can not be used anymore
+		p.server.Disconnect()
+	}
+	c.pools[key] = &pool{
+		uid:        databaseServer.UID,
+		hash:       hash,
+		serverType: databaseServer.Spec.Type,
+		server:     server,
+	}
+	return server, "Connection to database successful", nil
+}
+
+// lookup returns the pool of a database server if it was connected with the current spec and password
+func (c *Connections) lookup(key types.NamespacedName, uid types.UID, hash string) (SQLServer, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.pools[key]
+	if !ok || p.uid != uid || p.hash != hash {
+		return nil, false
+	}
+	return p.server, true
+}
+
+// Remove disconnects the pool of a database server which no longer exists
+func (c *Connections) Remove(key types.NamespacedName) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p, ok := c.pools[key]; ok {
+		p.server.Disconnect()
+		delete(c.pools, key)
+	}
+}
+
+// Close disconnects every pool
+func (c *Connections) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, p := range c.pools {
+		p.server.Disconnect()
+		delete(c.pools, key)
+	}
+}
+
+// hashServer identifies the spec and admin password a pool was connected with
+func hashServer(spec *databasev1alpha1.DatabaseServerSpec, password string) (string, error) {
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.New()
+	sum.Write(data)
+	sum.Write([]byte{0})
+	sum.Write([]byte(password))
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+var (
+	poolLabels = []string{"server", "type"}
+
+	poolsDesc = prometheus.NewDesc("database_controller_pools",
+		"Number of connection pools to database servers", nil, nil)
+	poolOpenDesc = prometheus.NewDesc("database_controller_pool_open_connections",
+		"Number of established connections to the database server, both in use and idle", poolLabels, nil)
+	poolInUseDesc = prometheus.NewDesc("database_controller_pool_in_use_connections",
+		"Number of connections to the database server currently in use", poolLabels, nil)
+	poolIdleDesc = prometheus.NewDesc("database_controller_pool_idle_connections",
+		"Number of idle connections to the database server", poolLabels, nil)
+	poolWaitCountDesc = prometheus.NewDesc("database_controller_pool_wait_count_total",
+		"Total number of connections waited for", poolLabels, nil)
+	poolWaitDurationDesc = prometheus.NewDesc("database_controller_pool_wait_duration_seconds_total",
+		"Total time blocked waiting for a new connection", poolLabels, nil)
+)
+
+// Describe implements prometheus.Collector
+func (c *Connections) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolsDesc
+	ch <- poolOpenDesc
+	ch <- poolInUseDesc
+	ch <- poolIdleDesc
+	ch <- poolWaitCountDesc
+	ch <- poolWaitDurationDesc
+}
+
+// Collect implements prometheus.Collector
+func (c *Connections) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(poolsDesc, prometheus.GaugeValue, float64(len(c.pools)))
+	for key, p := range c.pools {
+		s, ok := p.server.(statser)
+		if !ok {
+			continue
+		}
+		stats := s.Stats()
+		labels := []string{key.String(), p.serverType}
+		ch <- prometheus.MustNewConstMetric(poolOpenDesc, prometheus.GaugeValue, float64(stats.OpenConnections), labels...)
+		ch <- prometheus.MustNewConstMetric(poolInUseDesc, prometheus.GaugeValue, float64(stats.InUse), labels...)
+		ch <- prometheus.MustNewConstMetric(poolIdleDesc, prometheus.GaugeValue, float64(stats.Idle), labels...)
+		ch <- prometheus.MustNewConstMetric(poolWaitCountDesc, prometheus.CounterValue, float64(stats.WaitCount), labels...)
+		ch <- prometheus.MustNewConstMetric(poolWaitDurationDesc, prometheus.CounterValue, stats.WaitDuration.Seconds(), labels...)
+	}
+}
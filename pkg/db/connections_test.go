@@ -0,0 +1,138 @@
+package db
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+)
+
+// fakeServer counts connects and disconnects instead of talking to a server
+type fakeServer struct {
+	SQLServer
+	connected bool
+}
+
+func (fs *fakeServer) Connect() (string, error) {
+	fs.connected = true
+	return "Connection to database successful", nil
+}
+
+func (fs *fakeServer) Disconnect() {
+	fs.connected = false
+}
+
+// slowServer connects once release is closed, like a server which does not answer
+type slowServer struct {
+	fakeServer
+}
+
+var release = make(chan struct{})
+
+func (ss *slowServer) Connect() (string, error) {
+	<-release
+	return ss.fakeServer.Connect()
+}
+
+func init() {
+	Register(func(spec *databasev1alpha1.DatabaseServerSpec, password string) SQLServer {
+		return &fakeServer{}
+	}, "fake")
+	Register(func(spec *databasev1alpha1.DatabaseServerSpec, password string) SQLServer {
+		return &slowServer{}
+	}, "slow")
+}
+
+func TestConnectionsReusePool(t *testing.T) {
+	connections := NewConnections()
+	server := &databasev1alpha1.DatabaseServer{
+		ObjectMeta: metav1.ObjectMeta{Name: "server", Namespace: "default", UID: "1"},
+		Spec:       databasev1alpha1.DatabaseServerSpec{Type: "fake"},
+	}
+
+	first, _, err := connections.Get(server, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := connections.Get(server, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Fatal("expected the pool to be reused for an unchanged server")
+	}
+
+	// A new password replaces the pool
+	third, _, err := connections.Get(server, "rotated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third == first || first.(*fakeServer).connected {
+		t.Fatal("expected the pool to be replaced when the password changes")
+	}
+
+	// So does a recreated server with the same name
+	server.UID = "2"
+	fourth, _, err := connections.Get(server, "rotated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fourth == third || third.(*fakeServer).connected {
+		t.Fatal("expected the pool to be replaced when the server is recreated")
+	}
+
+	connections.Remove(types.NamespacedName{Name: "server", Namespace: "default"})
+	if fourth.(*fakeServer).connected {
+		t.Fatal("expected the pool to be disconnected when the server is removed")
+	}
+}
+
+func TestConnectionsUnsupportedType(t *testing.T) {
+	server := &databasev1alpha1.DatabaseServer{
+		ObjectMeta: metav1.ObjectMeta{Name: "server", Namespace: "default", UID: "1"},
+		Spec:       databasev1alpha1.DatabaseServerSpec{Type: "oracle"},
+	}
+	if _, _, err := NewConnections().Get(server, "password"); !errors.Is(err, ErrUnsupportedType) {
+		t.Fatal("expected an error for an unsupported type")
+	}
+}
+
+func TestConnectionsSlowServerDoesNotBlockOthers(t *testing.T) {
+	connections := NewConnections()
+	slow := &databasev1alpha1.DatabaseServer{
+		ObjectMeta: metav1.ObjectMeta{Name: "slow", Namespace: "default", UID: "1"},
+		Spec:       databasev1alpha1.DatabaseServerSpec{Type: "slow"},
+	}
+	fast := &databasev1alpha1.DatabaseServer{
+		ObjectMeta: metav1.ObjectMeta{Name: "fast", Namespace: "default", UID: "2"},
+		Spec:       databasev1alpha1.DatabaseServerSpec{Type: "fake"},
+	}
+
+	slowDone := make(chan struct{})
+	go func() {
+		defer close(slowDone)
+		if _, _, err := connections.Get(slow, "password"); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	fastDone := make(chan struct{})
+	go func() {
+		defer close(fastDone)
+		if _, _, err := connections.Get(fast, "password"); err != nil {
+			t.Error(err)
+		}
+	}()
+	select {
+	case <-fastDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected connecting to a server not to wait for another server connecting")
+	}
+
+	close(release)
+	<-slowDone
+}
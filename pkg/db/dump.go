@@ -0,0 +1,34 @@
+package db
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+// DumpFileEnv is the environment variable holding the path of the dump file for the commands of a DumpTool
+const DumpFileEnv = "DUMP_FILE"
+
+// DumpTool describes how to dump and restore a database with the command line tools of its engine.
+// The commands are run by a shell in a container of Image with Env set.
+type DumpTool struct {
+	// Image is the default image containing the tools
+	Image string
+	// Env configures the connection to the server as the user of the database, with the password taken from a secret
+	Env []corev1.EnvVar
+	// Dump writes a logical dump of the database to $DUMP_FILE
+	Dump string
+	// Restore loads the dump in $DUMP_FILE into the database, replacing objects which already exist
+	Restore string
+	// Extension is the file extension of dumps
+	Extension string
+}
+
+// Dumper is implemented by drivers of engines with tools for logical dumps and restores.
+// The tools log in as the user of the database, so jobs running them only get access to that database.
+type Dumper interface {
+	DumpTool(database Database, password corev1.SecretKeySelector) DumpTool
+}
+
+// passwordEnv returns an environment variable with the password from a secret
+func passwordEnv(name string, password corev1.SecretKeySelector) corev1.EnvVar {
+	return corev1.EnvVar{Name: name, ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &password}}
+}
@@ -0,0 +1,72 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/golang-migrate/migrate/v4"
+	migratedatabase "github.com/golang-migrate/migrate/v4/database"
+	// Migrations are read from a directory
+	_ "github.com/golang-migrate/migrate/v4/source/file"
+)
+
+// ErrMigrationDirty is returned when a migration failed halfway and the database has to be fixed by hand
+var ErrMigrationDirty = errors.New("database is dirty")
+
+// ErrDownMigration is returned when the requested version is lower than the current one and down migrations are not allowed
+var ErrDownMigration = errors.New("down migrations are not allowed")
+
+// Migrator is implemented by drivers of engines supported by golang-migrate
+type Migrator interface {
+	// MigrationDriver connects to the database as its user and returns the golang-migrate driver for the connection
+	MigrationDriver(database Database) (migratedatabase.Driver, error)
+}
+
+// MigrationState is the version of the last migration applied to a database
+type MigrationState struct {
+	Version uint
+	Dirty   bool
+}
+
+// Migrate applies the migrations in dir to the database as its user, up to version or to the latest one when nil.
+// A version lower than the current one runs the down migrations in between if allowDown is set, version 0 runs all of them.
+// The state of the database is nil when it could not be read.
+func Migrate(migrator Migrator, database Database, dir string, version *uint, allowDown bool) (*MigrationState, string, error) {
+	driver, err := migrator.MigrationDriver(database)
+	if err != nil {
+		return nil, "unable to connect to database as user", err
+	}
+	m, err := migrate.NewWithDatabaseInstance("file://"+dir, database.Name, driver)
+	if err != nil {
+		driver.Close()
+		return nil, "unable to read migrations", err
+	}
+	defer m.Close()
+
+	current, dirty, err := m.Version()
+	if err != nil && err != migrate.ErrNilVersion {
+		return nil, "unable to read migration version", err
+	}
+	state := &MigrationState{Version: current, Dirty: dirty}
+	if dirty {
+		return state, fmt.Sprintf("migration to version %d failed and has to be fixed by hand", current), ErrMigrationDirty
+	}
+
+	switch {
+	case version == nil:
+		err = m.Up()
+	case *version < current && !allowDown:
+		return state, fmt.Sprintf("database is at version %d, which is newer than version %d", current, *version), ErrDownMigration
+	case *version == 0:
+		err = m.Down()
+	default:
+		err = m.Migrate(*version)
+	}
+	if current, dirty, versionErr := m.Version(); versionErr == nil || versionErr == migrate.ErrNilVersion {
+		state = &MigrationState{Version: current, Dirty: dirty}
+	}
+	if err != nil && err != migrate.ErrNoChange {
+		return state, "unable to apply migrations", err
+	}
+	return state, "Migrations successfully applied", nil
+}
@@ -2,22 +2,43 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"strconv"
+	"strings"
 
+	migratedatabase "github.com/golang-migrate/migrate/v4/database"
+	migratemongodb "github.com/golang-migrate/migrate/v4/database/mongodb"
 	"go.mongodb.org/mongo-driver/bson"
+	corev1 "k8s.io/api/core/v1"
 
 	"go.mongodb.org/mongo-driver/mongo"
-	_ "go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
 )
 
-// Mongo object
-type Mongo struct {
-	Name     string
-	Username string
-	Password string
+func init() {
+	Register(func(spec *databasev1alpha1.DatabaseServerSpec, password string) SQLServer {
+		return &MongoServer{
+			Username: spec.Mongo.Username,
+			Password: password,
+			Host:     spec.Mongo.Host,
+			Port:     spec.Mongo.Port,
+			Ssl:      spec.Mongo.Ssl,
+		}
+	}, "mongo", "mongodb")
+	RegisterRules(Rules{Section: "mongo", MaxDatabaseName: 63, InvalidDatabaseChars: `/\. "$*<>:|?`, ReservedNames: []string{"admin", "local", "config"}}, "mongo", "mongodb")
 }
 
+// mongoUserNotFound is the code of the error returned when dropping a user which does not exist
+const mongoUserNotFound = 11
+
+// mongoUserExists is the code of the error returned when creating a user which exists
+const mongoUserExists = 51003
+
 // MongoServer object
 type MongoServer struct {
 	Username string
@@ -25,72 +46,259 @@ type MongoServer struct {
 	Host     string
 	Port     int32
 	Ssl      bool
-	Mongo    Mongo
 	Client   *mongo.Client
-	DB       *mongo.Database
 }
 
 // CreateUser creates a user
-func (ms *MongoServer) CreateUser() (string, error) {
+func (ms *MongoServer) CreateUser(database Database) (string, error) {
+	roles, err := mongoDatabaseRoleDocuments(database)
+	if err != nil {
+		return "unable to map privileges", err
+	}
 	// Check if user exists on server
-	if res := ms.DB.RunCommand(context.Background(), bson.D{
-		{Key: "createUser", Value: ms.Mongo.Username},
-		{Key: "pwd", Value: ms.Mongo.Password},
-		{Key: "roles", Value: []bson.M{
-			{"role": "readWrite",
-				"db": ms.Mongo.Name}}}}); res.Err() != nil {
+	if res := ms.Client.Database(database.Name).RunCommand(context.Background(), bson.D{
+		{Key: "createUser", Value: database.Username},
+		{Key: "pwd", Value: database.Password},
+		{Key: "roles", Value: roles}}); res.Err() != nil {
+		var cmdErr mongo.CommandError
+		if errors.As(res.Err(), &cmdErr) && cmdErr.Code == mongoUserExists {
+			if !database.Owned {
+				return "User already exists", ErrUserExists
+			}
+			return "User already exists", nil
+		}
 		return "unable to create user", res.Err()
 	}
 	return "User created successfully", nil
 }
 
+// UpdatePassword of user
+func (ms *MongoServer) UpdatePassword(database Database) (string, error) {
+	if res := ms.Client.Database(database.Name).RunCommand(context.Background(), bson.D{
+		{Key: "updateUser", Value: database.Username},
+		{Key: "pwd", Value: database.Password}}); res.Err() != nil {
+		return "unable to update password of user", res.Err()
+	}
+	return "Password updated successfully", nil
+}
+
 // DeleteUser from server
-func (ms *MongoServer) DeleteUser() (string, error) {
-	if res := ms.DB.RunCommand(context.Background(), bson.D{{Key: "dropUser", Value: ms.Mongo.Username}}); res.Err() != nil {
+func (ms *MongoServer) DeleteUser(database Database) (string, error) {
+	if res := ms.Client.Database(database.Name).RunCommand(context.Background(), bson.D{{Key: "dropUser", Value: database.Username}}); res.Err() != nil {
+		// A user which does not exist is already deleted, like DROP USER IF EXISTS on the other engines
+		var cmdErr mongo.CommandError
+		if errors.As(res.Err(), &cmdErr) && cmdErr.Code == mongoUserNotFound {
+			return "User does not exist", nil
+		}
 		return "unable to drop user", res.Err()
 	}
 	return "User dropped successfully", nil
 }
 
-// CreateDatabase creates a database
-func (ms *MongoServer) CreateDatabase() (string, error) {
-	// Try to create database
-	ms.DB = ms.Client.Database(ms.Mongo.Name)
+// CreateDatabase creates a database, as a copy of the source database if there is one
+func (ms *MongoServer) CreateDatabase(database Database) (string, error) {
+	// A database with collections has been copied or written to already
+	collections, err := ms.Client.Database(database.Name).ListCollectionNames(context.Background(), bson.M{})
+	if err != nil {
+		return "unable to list collections", err
+	}
+	if len(collections) > 0 {
+		if !database.DatabaseOwned {
+			return "Database already exists", ErrDatabaseExists
+		}
+		return "Database already exists", nil
+	}
+	// Databases are created by mongo when they are first written to
+	if database.Source == "" {
+		return "Database created successfully", nil
+	}
+	if err := ms.copyCollections(database.Source, database.Name); err != nil {
+		// Drop the partial copy, so the next attempt starts over
+		ms.Client.Database(database.Name).Drop(context.Background())
+		return fmt.Sprintf("unable to copy database %s", database.Source), err
+	}
+	return fmt.Sprintf("Database created as a copy of %s", database.Source), nil
+}
+
+// mongoCopyBatchSize is the number of documents inserted at a time when copying a collection
+const mongoCopyBatchSize = 1000
 
-	return "Database created successfully", nil
+// copyCollections copies the collections of one database into another, with their indexes and documents
+func (ms *MongoServer) copyCollections(from, to string) error {
+	ctx := context.Background()
+	source := ms.Client.Database(from)
+	target := ms.Client.Database(to)
+	collections, err := source.ListCollectionNames(ctx, bson.M{"type": "collection"})
+	if err != nil {
+		return err
+	}
+	for _, collection := range collections {
+		if strings.HasPrefix(collection, "system.") {
+			continue
+		}
+		if err := target.RunCommand(ctx, bson.D{{Key: "create", Value: collection}}).Err(); err != nil {
+			return err
+		}
+		if err := copyIndexes(ctx, source.Collection(collection), target); err != nil {
+			return err
+		}
+
+		cursor, err := source.Collection(collection).Find(ctx, bson.M{})
+		if err != nil {
+			return err
+		}
+		batch := make([]interface{}, 0, mongoCopyBatchSize)
+		for cursor.Next(ctx) {
+			// The cursor reuses its buffer for the next document
+			batch = append(batch, append(bson.Raw(nil), cursor.Current...))
+			if len(batch) == mongoCopyBatchSize {
+				if _, err := target.Collection(collection).InsertMany(ctx, batch); err != nil {
+					cursor.Close(ctx)
+					return err
+				}
+				batch = batch[:0]
+			}
+		}
+		err = cursor.Err()
+		cursor.Close(ctx)
+		if err != nil {
+			return err
+		}
+		if len(batch) > 0 {
+			if _, err := target.Collection(collection).InsertMany(ctx, batch); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// copyIndexes creates the indexes of a collection on the collection with the same name in another database
+func copyIndexes(ctx context.Context, source *mongo.Collection, target *mongo.Database) error {
+	cursor, err := source.Indexes().List(ctx)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	var indexes []bson.M
+	for cursor.Next(ctx) {
+		var index bson.M
+		if err := cursor.Decode(&index); err != nil {
+			return err
+		}
+		// The index on _id is created with the collection
+		if index["name"] == "_id_" {
+			continue
+		}
+		// The namespace and version are set by the server
+		delete(index, "ns")
+		delete(index, "v")
+		indexes = append(indexes, index)
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	if len(indexes) == 0 {
+		return nil
+	}
+	return target.RunCommand(ctx, bson.D{{Key: "createIndexes", Value: source.Name()}, {Key: "indexes", Value: indexes}}).Err()
 }
 
 // DeleteDatabase from server
-func (ms *MongoServer) DeleteDatabase() (string, error) {
-	if err := ms.DB.Drop(context.Background()); err != nil {
+func (ms *MongoServer) DeleteDatabase(database Database) (string, error) {
+	if err := ms.Client.Database(database.Name).Drop(context.Background()); err != nil {
 		return "unable to delete database", err
 	}
 	return "Database deleted successfully", nil
 }
 
-// GrantPermissions to user
-func (ms *MongoServer) GrantPermissions() (string, error) {
-	// Grant permissions to user
-	if res := ms.DB.RunCommand(context.Background(), bson.D{
-		{Key: "grantRolesToUser", Value: ms.Mongo.Username},
-		{Key: "roles", Value: []bson.M{
-			{"role": "readWrite",
-				"db": ms.Mongo.Name}}}}); res.Err() != nil {
+// GrantPermissions to user.
+// The roles of the user are replaced, which revokes roles no longer part of the level.
+func (ms *MongoServer) GrantPermissions(database Database) (string, error) {
+	roles, err := mongoDatabaseRoleDocuments(database)
+	if err != nil {
+		return "unable to map privileges", err
+	}
+	if res := ms.Client.Database(database.Name).RunCommand(context.Background(), bson.D{
+		{Key: "updateUser", Value: database.Username},
+		{Key: "roles", Value: roles}}); res.Err() != nil {
 		return "unable to grant permissions", res.Err()
 	}
 	return "Permissions successfully granted", nil
 }
 
+// mongoDatabaseRoleDocuments returns the roles of the user on the database
+func mongoDatabaseRoleDocuments(database Database) ([]bson.M, error) {
+	roles, err := mongoRoles(database.Privileges)
+	if err != nil {
+		return nil, err
+	}
+	documents := make([]bson.M, 0, len(roles))
+	for _, role := range roles {
+		documents = append(documents, bson.M{"role": role, "db": database.Name})
+	}
+	return documents, nil
+}
+
+// VerifyLogin checks that the user can log in to the database with its password
+func (ms *MongoServer) VerifyLogin(database Database) (string, error) {
+	// Users are created in the database they are given access to
+	auth := options.Credential{Username: database.Username, Password: database.Password, AuthSource: database.Name}
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(ms.url()).SetAuth(auth))
+	if err != nil {
+		return "unable to connect to database as user", err
+	}
+	defer client.Disconnect(context.Background())
+	if err := client.Ping(context.Background(), readpref.Primary()); err != nil {
+		return "unable to log in to database as user", err
+	}
+	return "Login to database successful", nil
+}
+
+// VerifyAccess checks that the user can log in to the database and read and write in it.
+// The check writes a document to a collection of its own and drops the collection afterwards.
+// Users without privileges to write are only checked by logging in.
+func (ms *MongoServer) VerifyAccess(database Database) (string, error) {
+	if !writable(database.Privileges) {
+		return ms.VerifyLogin(database)
+	}
+	auth := options.Credential{Username: database.Username, Password: database.Password, AuthSource: database.Name}
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(ms.url()).SetAuth(auth))
+	if err != nil {
+		return "unable to connect to database as user", err
+	}
+	defer client.Disconnect(context.Background())
+	collection := client.Database(database.Name).Collection("database_controller_verify")
+	if _, err := collection.InsertOne(context.Background(), bson.M{"value": 1}); err != nil {
+		return "unable to write as user", err
+	}
+	defer collection.Drop(context.Background())
+	if err := collection.FindOne(context.Background(), bson.M{"value": 1}).Err(); err != nil {
+		return "unable to read as user", err
+	}
+	return "User can read and write database", nil
+}
+
+// url returns the connection string of the server, without credentials
+func (ms *MongoServer) url() string {
+	return fmt.Sprintf("mongodb://%s/?ssl=%t", net.JoinHostPort(ms.Host, strconv.Itoa(int(ms.Port))), ms.Ssl)
+}
+
 // Connect to Mongoserver
 func (ms *MongoServer) Connect() (string, error) {
-	url := fmt.Sprintf("mongodb://%s:%s@%s:%d/?ssl=%t", ms.Username, ms.Password, ms.Host, ms.Port, ms.Ssl)
-	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(url))
+	// Credentials are passed outside of the uri, so they do not need to be escaped
+	auth := options.Credential{Username: ms.Username, Password: ms.Password}
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(ms.url()).SetAuth(auth))
 	if err != nil {
 		return "unable to connect to database", err
 	}
+	// The client connects lazily, so make sure the server is reachable before using it
+	if err := client.Ping(context.Background(), readpref.Primary()); err != nil {
+		client.Disconnect(context.Background())
+		return "ping to database failed", err
+	}
 
 	ms.Client = client
-	ms.DB = ms.Client.Database(ms.Mongo.Name)
 
 	return "Connection to database successful", nil
 }
@@ -99,3 +307,61 @@ func (ms *MongoServer) Connect() (string, error) {
 func (ms *MongoServer) Disconnect() {
 	ms.Client.Disconnect(context.Background())
 }
+
+// Ping checks that the server is still reachable
+func (ms *MongoServer) Ping() (string, error) {
+	if err := ms.Client.Ping(context.Background(), readpref.Primary()); err != nil {
+		return "ping to database failed", err
+	}
+	return "Ping to database successful", nil
+}
+
+// DiskUsage returns the size on disk of all databases on the server
+func (ms *MongoServer) DiskUsage() (int64, string, error) {
+	// The size is reported as a double
+	var result struct {
+		TotalSize float64 `bson:"totalSize"`
+	}
+	if err := ms.Client.Database("admin").RunCommand(context.Background(), bson.D{{Key: "listDatabases", Value: 1}}).Decode(&result); err != nil {
+		return 0, "unable to get size of databases", err
+	}
+	return int64(result.TotalSize), "Size of databases successfully read", nil
+}
+
+// DumpTool dumps the database with mongodump to a gzipped archive, and restores it with mongorestore.
+// Collections are renamed into the database, which may have another name than the one dumped.
+func (ms *MongoServer) DumpTool(database Database, password corev1.SecretKeySelector) DumpTool {
+	connection := `--host="$MONGO_HOST" --port="$MONGO_PORT" --username="$MONGO_USER" --password="$MONGO_PASSWORD" --authenticationDatabase="$MONGO_DATABASE"`
+	if ms.Ssl {
+		connection += " --ssl"
+	}
+	return DumpTool{
+		Image: "mongo:4.4",
+		Env: []corev1.EnvVar{
+			{Name: "MONGO_HOST", Value: ms.Host},
+			{Name: "MONGO_PORT", Value: strconv.Itoa(int(ms.Port))},
+			{Name: "MONGO_USER", Value: database.Username},
+			{Name: "MONGO_DATABASE", Value: database.Name},
+			passwordEnv("MONGO_PASSWORD", password),
+		},
+		Dump:      "mongodump " + connection + ` --db="$MONGO_DATABASE" --archive="$DUMP_FILE" --gzip`,
+		Restore:   "mongorestore " + connection + ` --archive="$DUMP_FILE" --gzip --drop --nsFrom='$db$.$collection$' --nsTo="$MONGO_DATABASE"'.$collection$'`,
+		Extension: "archive.gz",
+	}
+}
+
+// MigrationDriver connects to the database as its user, recording migrations in the schema_migrations collection.
+// Migrations are json arrays of database commands.
+func (ms *MongoServer) MigrationDriver(database Database) (migratedatabase.Driver, error) {
+	auth := options.Credential{Username: database.Username, Password: database.Password, AuthSource: database.Name}
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(ms.url()).SetAuth(auth))
+	if err != nil {
+		return nil, err
+	}
+	driver, err := migratemongodb.WithInstance(client, &migratemongodb.Config{DatabaseName: database.Name})
+	if err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+	return driver, nil
+}
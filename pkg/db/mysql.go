@@ -1,99 +1,345 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"net"
+	"strconv"
 	"strings"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
+	migratedatabase "github.com/golang-migrate/migrate/v4/database"
+	migratemysql "github.com/golang-migrate/migrate/v4/database/mysql"
+	corev1 "k8s.io/api/core/v1"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
 )
 
-// Mysql object
-type Mysql struct {
-	Name     string
-	Username string
-	Password string
+func init() {
+	Register(func(spec *databasev1alpha1.DatabaseServerSpec, password string) SQLServer {
+		hostPattern := spec.Mysql.HostPattern
+		if hostPattern == "" {
+			hostPattern = "%"
+		}
+		return &MysqlServer{
+			Username:    spec.Mysql.Username,
+			Password:    password,
+			Host:        spec.Mysql.Host,
+			Port:        spec.Mysql.Port,
+			Ssl:         spec.Mysql.Ssl,
+			HostPattern: hostPattern,
+		}
+	}, "mysql")
+	// Databases are directories, so their names can not contain path separators
+	RegisterRules(Rules{Section: "mysql", MaxDatabaseName: 64, MaxUsername: 32, InvalidDatabaseChars: `/\.`,
+		ReservedNames: []string{"mysql", "information_schema", "performance_schema", "sys"}}, "mysql")
 }
 
 // MysqlServer object
 type MysqlServer struct {
-	Username string
-	Password string
-	Host     string
-	Port     int32
-	Ssl      bool
-	Mysql    Mysql
-	DB       *sql.DB
+	Username    string
+	Password    string
+	Host        string
+	Port        int32
+	Ssl         bool
+	HostPattern string
+	DB          *sql.DB
 }
 
-// CreateUser creates a user
-func (ms *MysqlServer) CreateUser() (string, error) {
+// CreateUser creates a user.
+// A user with an account for another host, e.g. from before the host pattern changed, has the account
+// renamed instead, which keeps its password and grants.
+func (ms *MysqlServer) CreateUser(database Database) (string, error) {
 	// Check if user exists on server
-	var user string
-	ms.DB.QueryRow(fmt.Sprintf("SELECT user FROM mysql.user WHERE user='%s'", ms.Mysql.Username)).Scan(&user)
+	hosts, err := ms.userHosts(database.Username)
+	if err != nil {
+		return "unable to look up user in database server", err
+	}
 
 	// If user doesn't exist create new
-	if user == "" {
-		_, err := ms.DB.Exec(fmt.Sprintf("CREATE USER '%s'@'%s' IDENTIFIED BY '%s'", ms.Mysql.Username, ms.Host, ms.Mysql.Password))
+	if len(hosts) == 0 {
+		_, err := ms.DB.Exec("CREATE USER ?@? IDENTIFIED BY ?", database.Username, ms.HostPattern, database.Password)
 		if err != nil {
 			return "unable to create role in database", err
 		}
 		return "User created successfully", nil
-	} else {
-		return "User already exists", nil
 	}
+	if !database.Owned {
+		return "User already exists", ErrUserExists
+	}
+	for _, host := range hosts {
+		if host == ms.HostPattern {
+			return "User already exists", nil
+		}
+	}
+	if _, err := ms.DB.Exec("RENAME USER ?@? TO ?@?", database.Username, hosts[0], database.Username, ms.HostPattern); err != nil {
+		return "unable to move user to host pattern", err
+	}
+	return "User moved to host pattern", nil
 }
 
-// DeleteUser from server
-func (ms *MysqlServer) DeleteUser() (string, error) {
-	_, err := ms.DB.Exec(fmt.Sprintf("DROP USER IF EXISTS '%s'@'%s'", ms.Mysql.Username, ms.Host))
+// userHosts returns the hosts the user has accounts for
+func (ms *MysqlServer) userHosts(username string) ([]string, error) {
+	rows, err := ms.DB.Query("SELECT host FROM mysql.user WHERE user = ?", username)
 	if err != nil {
-		return "unable to drop user in database server", err
+		return nil, err
+	}
+	defer rows.Close()
+	var hosts []string
+	for rows.Next() {
+		var host string
+		if err := rows.Scan(&host); err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, rows.Err()
+}
+
+// UpdatePassword of user
+func (ms *MysqlServer) UpdatePassword(database Database) (string, error) {
+	_, err := ms.DB.Exec("ALTER USER ?@? IDENTIFIED BY ?", database.Username, ms.HostPattern, database.Password)
+	if err != nil {
+		return "unable to update password of user in database server", err
+	}
+	return "Password updated successfully", nil
+}
+
+// DeleteUser from server, including accounts left behind for other hosts
+func (ms *MysqlServer) DeleteUser(database Database) (string, error) {
+	hosts, err := ms.userHosts(database.Username)
+	if err != nil {
+		return "unable to look up user in database server", err
+	}
+	for _, host := range hosts {
+		if _, err := ms.DB.Exec("DROP USER IF EXISTS ?@?", database.Username, host); err != nil {
+			return "unable to drop user in database server", err
+		}
 	}
 	return "User deleted successfully", nil
 }
 
 // CreateDatabase creates a database
-func (ms *MysqlServer) CreateDatabase() (string, error) {
+func (ms *MysqlServer) CreateDatabase(database Database) (string, error) {
 	// Try to create database
-	_, err := ms.DB.Exec(fmt.Sprintf("CREATE DATABASE %s", ms.Mysql.Name))
+	_, err := ms.DB.Exec(fmt.Sprintf("CREATE DATABASE %s", QuoteMysqlIdentifier(database.Name)))
 	if err != nil {
 		if !strings.Contains(err.Error(), "exists") {
 			return "unable to create database in database server", err
+		} else if !database.DatabaseOwned {
+			return "Database already exists", ErrDatabaseExists
 		} else {
 			return "Database already exists", nil
 		}
 	}
+	if database.Source != "" {
+		if err := ms.copyTables(database.Source, database.Name); err != nil {
+			// Drop the partial copy, so the next attempt starts over
+			ms.DB.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS %s", QuoteMysqlIdentifier(database.Name)))
+			return fmt.Sprintf("unable to copy database %s", database.Source), err
+		}
+		return fmt.Sprintf("Database created as a copy of %s", database.Source), nil
+	}
 	return "Database created successfully", nil
 }
 
+// copyTables copies the tables of one database into another, with their indexes and rows.
+// Foreign keys, views, triggers and routines are not copied.
+func (ms *MysqlServer) copyTables(from, to string) error {
+	rows, err := ms.DB.Query("SELECT TABLE_NAME FROM information_schema.TABLES WHERE TABLE_SCHEMA = ? AND TABLE_TYPE = 'BASE TABLE'", from)
+	if err != nil {
+		return err
+	}
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			rows.Close()
+			return err
+		}
+		tables = append(tables, table)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		source := QuoteMysqlIdentifier(from) + "." + QuoteMysqlIdentifier(table)
+		target := QuoteMysqlIdentifier(to) + "." + QuoteMysqlIdentifier(table)
+		if _, err := ms.DB.Exec(fmt.Sprintf("CREATE TABLE %s LIKE %s", target, source)); err != nil {
+			return err
+		}
+		if _, err := ms.DB.Exec(fmt.Sprintf("INSERT INTO %s SELECT * FROM %s", target, source)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // DeleteDatabase from server
-func (ms *MysqlServer) DeleteDatabase() (string, error) {
-	_, err := ms.DB.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS %s", ms.Mysql.Name))
+func (ms *MysqlServer) DeleteDatabase(database Database) (string, error) {
+	_, err := ms.DB.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS %s", QuoteMysqlIdentifier(database.Name)))
 	if err != nil {
 		return "unable to drop database in database server", err
 	}
 	return "Database deleted successfully", nil
 }
 
-// GrantPermissions to user
-func (ms *MysqlServer) GrantPermissions() (string, error) {
-	// Grant permissions to user
-	_, err := ms.DB.Exec(fmt.Sprintf("GRANT ALL PRIVILEGES ON %s.* TO '%s'@'%s'", ms.Mysql.Name, ms.Mysql.Username, ms.Host))
+// GrantPermissions to user.
+// Privileges granted on the database which are no longer part of the level are revoked.
+func (ms *MysqlServer) GrantPermissions(database Database) (string, error) {
+	privileges, err := mysqlPrivileges(database.Privileges)
+	if err != nil {
+		return "unable to map privileges", err
+	}
+
+	// ALL PRIVILEGES covers anything already granted
+	if !containsPrivilege(privileges, "ALL PRIVILEGES") {
+		granted, err := ms.grantedPrivileges(database)
+		if err != nil {
+			return "unable to look up privileges in database", err
+		}
+		var revoke []string
+		for _, privilege := range granted {
+			if !containsPrivilege(privileges, privilege) {
+				revoke = append(revoke, privilege)
+			}
+		}
+		if len(revoke) > 0 {
+			_, err := ms.DB.Exec(fmt.Sprintf("REVOKE %s ON %s.* FROM ?@?", strings.Join(revoke, ", "), QuoteMysqlGrantDatabase(database.Name)), database.Username, ms.HostPattern)
+			if err != nil {
+				return "unable to revoke permissions in database", err
+			}
+		}
+	}
+
+	_, err = ms.DB.Exec(fmt.Sprintf("GRANT %s ON %s.* TO ?@?", strings.Join(privileges, ", "), QuoteMysqlGrantDatabase(database.Name)), database.Username, ms.HostPattern)
 	if err != nil {
 		return "unable to grant permissions in database", err
 	}
 	return "Permissions successfully granted", nil
 }
 
+// mysqlPrivilegeColumns are the columns of mysql.db holding the privileges on a database
+var mysqlPrivilegeColumns = map[string]string{
+	"SELECT":                  "Select_priv",
+	"INSERT":                  "Insert_priv",
+	"UPDATE":                  "Update_priv",
+	"DELETE":                  "Delete_priv",
+	"CREATE":                  "Create_priv",
+	"DROP":                    "Drop_priv",
+	"INDEX":                   "Index_priv",
+	"ALTER":                   "Alter_priv",
+	"CREATE TEMPORARY TABLES": "Create_tmp_table_priv",
+	"LOCK TABLES":             "Lock_tables_priv",
+	"EXECUTE":                 "Execute_priv",
+	"CREATE VIEW":             "Create_view_priv",
+	"SHOW VIEW":               "Show_view_priv",
+	"CREATE ROUTINE":          "Create_routine_priv",
+	"ALTER ROUTINE":           "Alter_routine_priv",
+	"EVENT":                   "Event_priv",
+	"TRIGGER":                 "Trigger_priv",
+	"REFERENCES":              "References_priv",
+}
+
+// grantedPrivileges returns the privileges the user has on the database.
+// The user and host are looked up as they are, instead of in a grantee string which would have to be quoted.
+func (ms *MysqlServer) grantedPrivileges(database Database) ([]string, error) {
+	columns := make([]string, len(mysqlDatabasePrivileges))
+	values := make([]string, len(mysqlDatabasePrivileges))
+	dest := make([]interface{}, len(mysqlDatabasePrivileges))
+	for i, privilege := range mysqlDatabasePrivileges {
+		columns[i] = mysqlPrivilegeColumns[privilege]
+		dest[i] = &values[i]
+	}
+	query := fmt.Sprintf("SELECT %s FROM mysql.db WHERE User = ? AND Host = ? AND Db = ?", strings.Join(columns, ", "))
+	err := ms.DB.QueryRow(query, database.Username, ms.HostPattern, mysqlGrantPattern(database.Name)).Scan(dest...)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var privileges []string
+	for i, privilege := range mysqlDatabasePrivileges {
+		if values[i] == "Y" {
+			privileges = append(privileges, privilege)
+		}
+	}
+	return privileges, nil
+}
+
+// VerifyLogin checks that the user can log in to the database with its password
+func (ms *MysqlServer) VerifyLogin(database Database) (string, error) {
+	db, err := sql.Open("mysql", ms.config(database.Username, database.Password, database.Name).FormatDSN())
+	if err != nil {
+		return "unable to connect to database as user", err
+	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		return "unable to log in to database as user", err
+	}
+	return "Login to database successful", nil
+}
+
+// VerifyAccess checks that the user can log in to the database and read and write in it.
+// The check writes to a temporary table, which only exists in the session of the check.
+// Users without privileges to write are only checked by logging in.
+func (ms *MysqlServer) VerifyAccess(database Database) (string, error) {
+	if !writable(database.Privileges) {
+		return ms.VerifyLogin(database)
+	}
+	db, err := sql.Open("mysql", ms.config(database.Username, database.Password, database.Name).FormatDSN())
+	if err != nil {
+		return "unable to connect to database as user", err
+	}
+	defer db.Close()
+	// Temporary tables belong to a session, so every statement has to use the same connection
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return "unable to log in to database as user", err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(context.Background(), "CREATE TEMPORARY TABLE database_controller_verify (value integer)"); err != nil {
+		return "unable to create table as user", err
+	}
+	defer conn.ExecContext(context.Background(), "DROP TEMPORARY TABLE database_controller_verify")
+	if _, err := conn.ExecContext(context.Background(), "INSERT INTO database_controller_verify (value) VALUES (?)", 1); err != nil {
+		return "unable to write as user", err
+	}
+	var value int
+	if err := conn.QueryRowContext(context.Background(), "SELECT value FROM database_controller_verify").Scan(&value); err != nil {
+		return "unable to read as user", err
+	}
+	return "User can read and write database", nil
+}
+
+// config returns the connection configuration for a user and database on the server
+func (ms *MysqlServer) config(username, password, database string) *mysql.Config {
+	config := mysql.NewConfig()
+	config.User = username
+	config.Passwd = password
+	config.Net = "tcp"
+	config.Addr = net.JoinHostPort(ms.Host, strconv.Itoa(int(ms.Port)))
+	config.DBName = database
+	config.TLSConfig = strconv.FormatBool(ms.Ssl)
+	return config
+}
+
 // Connect to postgresserver
 func (ms *MysqlServer) Connect() (string, error) {
-	url := fmt.Sprintf("%s:%s@tcp(%s:%d)/mysql?tls=%t", ms.Username, ms.Password, ms.Host, ms.Port, ms.Ssl)
-	db, err := sql.Open("mysql", url)
+	config := ms.config(ms.Username, ms.Password, "mysql")
+	// Account names and passwords can not be bound server side in statements like CREATE USER,
+	// so let the driver escape placeholders according to the sql_mode of the server
+	config.InterpolateParams = true
+	db, err := sql.Open("mysql", config.FormatDSN())
 	if err != nil {
 		return "unable to connect to database", err
 	}
 	if err := db.Ping(); err != nil {
+		db.Close()
 		return "ping to database failed", err
 	}
 	ms.DB = db
@@ -104,3 +350,64 @@ func (ms *MysqlServer) Connect() (string, error) {
 func (ms *MysqlServer) Disconnect() {
 	ms.DB.Close()
 }
+
+// Ping checks that the server is still reachable
+func (ms *MysqlServer) Ping() (string, error) {
+	if err := ms.DB.Ping(); err != nil {
+		return "ping to database failed", err
+	}
+	return "Ping to database successful", nil
+}
+
+// DiskUsage returns the size of the data and indexes of all tables on the server
+func (ms *MysqlServer) DiskUsage() (int64, string, error) {
+	var size int64
+	if err := ms.DB.QueryRow("SELECT COALESCE(SUM(DATA_LENGTH + INDEX_LENGTH), 0) FROM information_schema.TABLES").Scan(&size); err != nil {
+		return 0, "unable to get size of databases", err
+	}
+	return size, "Size of databases successfully read", nil
+}
+
+// Stats returns statistics of the connection pool
+func (ms *MysqlServer) Stats() sql.DBStats {
+	return ms.DB.Stats()
+}
+
+// DumpTool dumps the database with mysqldump, and restores it with mysql
+func (ms *MysqlServer) DumpTool(database Database, password corev1.SecretKeySelector) DumpTool {
+	sslMode := "DISABLED"
+	if ms.Ssl {
+		sslMode = "REQUIRED"
+	}
+	return DumpTool{
+		Image: "mysql:8.0",
+		Env: []corev1.EnvVar{
+			{Name: "MYSQL_HOST", Value: ms.Host},
+			{Name: "MYSQL_TCP_PORT", Value: strconv.Itoa(int(ms.Port))},
+			{Name: "MYSQL_USER", Value: database.Username},
+			{Name: "MYSQL_SSL_MODE", Value: sslMode},
+			{Name: "MYSQL_DATABASE", Value: database.Name},
+			passwordEnv("MYSQL_PWD", password),
+		},
+		Dump:      `mysqldump --user="$MYSQL_USER" --ssl-mode="$MYSQL_SSL_MODE" --single-transaction --no-tablespaces --routines --triggers "$MYSQL_DATABASE" > "$DUMP_FILE"`,
+		Restore:   `mysql --user="$MYSQL_USER" --ssl-mode="$MYSQL_SSL_MODE" "$MYSQL_DATABASE" < "$DUMP_FILE"`,
+		Extension: "sql",
+	}
+}
+
+// MigrationDriver connects to the database as its user, recording migrations in the schema_migrations table.
+// Migrations may contain several statements.
+func (ms *MysqlServer) MigrationDriver(database Database) (migratedatabase.Driver, error) {
+	config := ms.config(database.Username, database.Password, database.Name)
+	config.MultiStatements = true
+	db, err := sql.Open("mysql", config.FormatDSN())
+	if err != nil {
+		return nil, err
+	}
+	driver, err := migratemysql.WithInstance(db, &migratemysql.Config{DatabaseName: database.Name})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return driver, nil
+}
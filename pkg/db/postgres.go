@@ -3,16 +3,30 @@ package db
 import (
 	"database/sql"
 	"fmt"
+	"strconv"
 	"strings"
+	"sync"
 
+	migratedatabase "github.com/golang-migrate/migrate/v4/database"
+	migratepostgres "github.com/golang-migrate/migrate/v4/database/postgres"
 	_ "github.com/jackc/pgx/v4/stdlib"
+	corev1 "k8s.io/api/core/v1"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
 )
 
-// Postgres object
-type Postgres struct {
-	Name     string
-	Username string
-	Password string
+func init() {
+	Register(func(spec *databasev1alpha1.DatabaseServerSpec, password string) SQLServer {
+		return &PostgresServer{
+			Username: spec.Postgres.Username,
+			Password: password,
+			Host:     spec.Postgres.Host,
+			Port:     spec.Postgres.Port,
+			SslMode:  spec.Postgres.SslMode,
+		}
+	}, "postgres", "postgresql")
+	// Identifiers are truncated to NAMEDATALEN-1 bytes
+	RegisterRules(Rules{Section: "postgres", MaxDatabaseName: 63, MaxUsername: 63, ReservedNames: []string{"postgres", "template0", "template1"}}, "postgres", "postgresql")
 }
 
 // PostgresServer object
@@ -22,77 +36,225 @@ type PostgresServer struct {
 	Host     string
 	Port     int32
 	SslMode  string
-	Postgres Postgres
 	DB       *sql.DB
+
+	// databases are pools of admin connections to single databases, for statements which only apply to the database connected to
+	mu        sync.Mutex
+	databases map[string]*sql.DB
 }
 
 // CreateUser creates a user
-func (ps *PostgresServer) CreateUser() (string, error) {
+func (ps *PostgresServer) CreateUser(database Database) (string, error) {
 	// Check if user exists on server
-	commandTag, err := ps.DB.Exec(fmt.Sprintf("SELECT usename FROM pg_user WHERE usename='%s'", ps.Postgres.Username))
-	rows, _ := commandTag.RowsAffected()
+	var exists bool
+	err := ps.DB.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = $1)", database.Username).Scan(&exists)
+	if err != nil {
+		return "unable to look up role in database", err
+	}
 	// If user doesn't exist create new
-	if err != nil || rows == 0 {
-		_, err = ps.DB.Exec(fmt.Sprintf("CREATE USER \"%s\" WITH PASSWORD '%s'", ps.Postgres.Username, ps.Postgres.Password))
+	if !exists {
+		_, err = ps.DB.Exec(fmt.Sprintf("CREATE USER %s WITH PASSWORD %s", QuotePostgresIdentifier(database.Username), QuotePostgresLiteral(database.Password)))
 		if err != nil {
 			return "unable to create role in database", err
 		}
 		return "User created successfully", nil
+	} else if !database.Owned {
+		return "User already exists", ErrUserExists
 	} else {
 		return "User already exists", nil
 	}
 }
 
+// UpdatePassword of user
+func (ps *PostgresServer) UpdatePassword(database Database) (string, error) {
+	_, err := ps.DB.Exec(fmt.Sprintf("ALTER USER %s WITH PASSWORD %s", QuotePostgresIdentifier(database.Username), QuotePostgresLiteral(database.Password)))
+	if err != nil {
+		return "unable to update password of role in database", err
+	}
+	return "Password updated successfully", nil
+}
+
 // DeleteUser from server
-func (ps *PostgresServer) DeleteUser() (string, error) {
-	_, err := ps.DB.Exec(fmt.Sprintf("DROP USER IF EXISTS \"%s\"", ps.Postgres.Username))
+func (ps *PostgresServer) DeleteUser(database Database) (string, error) {
+	_, err := ps.DB.Exec(fmt.Sprintf("DROP USER IF EXISTS %s", QuotePostgresIdentifier(database.Username)))
 	if err != nil {
 		return "unable to drop user in database server", err
 	}
 	return "User deleted successfully", nil
 }
 
-// CreateDatabase creates a database
-func (ps *PostgresServer) CreateDatabase() (string, error) {
+// CreateDatabase creates a database, as a copy of the source database if there is one.
+// The server copies the source as a template, which fails while anyone else is connected to it.
+func (ps *PostgresServer) CreateDatabase(database Database) (string, error) {
+	statement := fmt.Sprintf("CREATE DATABASE %s", QuotePostgresIdentifier(database.Name))
+	if database.Source != "" {
+		statement += fmt.Sprintf(" TEMPLATE %s", QuotePostgresIdentifier(database.Source))
+		ps.closeDatabase(database.Source)
+	}
 	// Try to create database
-	_, err := ps.DB.Exec(fmt.Sprintf("CREATE DATABASE \"%s\"", ps.Postgres.Name))
+	_, err := ps.DB.Exec(statement)
 	if err != nil {
 		if strings.Contains(err.Error(), "already exists") {
-			return "Database already exisis", nil
+			if !database.DatabaseOwned {
+				return "Database already exists", ErrDatabaseExists
+			}
+			return "Database already exists", nil
 		} else {
 			return "unable to create database in database server", err
 		}
 	}
+	if database.Source != "" {
+		return fmt.Sprintf("Database created as a copy of %s", database.Source), nil
+	}
 	return "Database created successfully", nil
 }
 
 // DeleteDatabase from server
-func (ps *PostgresServer) DeleteDatabase() (string, error) {
-	_, err := ps.DB.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS \"%s\"", ps.Postgres.Name))
+func (ps *PostgresServer) DeleteDatabase(database Database) (string, error) {
+	// A database can not be dropped while connected to
+	ps.closeDatabase(database.Name)
+	_, err := ps.DB.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS %s", QuotePostgresIdentifier(database.Name)))
 	if err != nil {
 		return "unable to drop database in database server", err
 	}
 	return "Database deleted successfully", nil
 }
 
-// GrantPermissions to user
-func (ps *PostgresServer) GrantPermissions() (string, error) {
-	// Grant permissions to user
-	_, err := ps.DB.Exec(fmt.Sprintf("GRANT ALL ON DATABASE \"%s\" TO \"%s\"", ps.Postgres.Name, ps.Postgres.Username))
+// GrantPermissions to user.
+// Everything is revoked before granting the privileges of the level, in one transaction,
+// so privileges no longer part of the level are removed without the user losing access meanwhile.
+func (ps *PostgresServer) GrantPermissions(database Database) (string, error) {
+	grants, err := postgresPrivileges(database.Privileges)
+	if err != nil {
+		return "unable to map privileges", err
+	}
+
+	// Schemas and tables belong to a database, so they can only be granted on while connected to it
+	db, err := ps.database(database.Name)
 	if err != nil {
+		return "unable to connect to database", err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return "unable to connect to database", err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range postgresGrantStatements(database, grants) {
+		if _, err := tx.Exec(statement); err != nil {
+			return "unable to grant permissions in database", err
+		}
+	}
+	if err := tx.Commit(); err != nil {
 		return "unable to grant permissions in database", err
 	}
 	return "Permissions successfully granted", nil
 }
 
+// postgresGrantStatements returns the statements revoking everything from the user of a database and granting it the privileges of its level.
+// Default privileges only apply to tables created by the role they are altered for, so they are altered for the admin user, and for every
+// owner of the database, which create tables from the application, in migrations and when restoring a dump.
+func postgresGrantStatements(database Database, grants postgresGrants) []string {
+	name := QuotePostgresIdentifier(database.Name)
+	user := QuotePostgresIdentifier(database.Username)
+	// The admin user is the current role, which default privileges are altered for without FOR ROLE
+	creators := []string{""}
+	for _, owner := range database.Owners {
+		// Tables of the user itself are owned by it and need no grants
+		if owner != database.Username {
+			creators = append(creators, " FOR ROLE "+QuotePostgresIdentifier(owner))
+		}
+	}
+
+	statements := []string{
+		// Every role may connect to new databases and, before postgres 15, create in their public schema.
+		// Access is only given by the grants below, so users of other databases on the server stay out.
+		fmt.Sprintf("REVOKE ALL ON DATABASE %s FROM PUBLIC", name),
+		"REVOKE ALL ON SCHEMA public FROM PUBLIC",
+		fmt.Sprintf("REVOKE ALL ON DATABASE %s FROM %s", name, user),
+		fmt.Sprintf("REVOKE ALL ON SCHEMA public FROM %s", user),
+		fmt.Sprintf("REVOKE ALL ON ALL TABLES IN SCHEMA public FROM %s", user),
+		fmt.Sprintf("REVOKE ALL ON ALL SEQUENCES IN SCHEMA public FROM %s", user),
+	}
+	for _, creator := range creators {
+		statements = append(statements,
+			fmt.Sprintf("ALTER DEFAULT PRIVILEGES%s IN SCHEMA public REVOKE ALL ON TABLES FROM %s", creator, user),
+			fmt.Sprintf("ALTER DEFAULT PRIVILEGES%s IN SCHEMA public REVOKE ALL ON SEQUENCES FROM %s", creator, user))
+	}
+	statements = append(statements,
+		fmt.Sprintf("GRANT %s ON DATABASE %s TO %s", strings.Join(grants.database, ", "), name, user),
+		fmt.Sprintf("GRANT %s ON SCHEMA public TO %s", strings.Join(grants.schema, ", "), user),
+		fmt.Sprintf("GRANT %s ON ALL TABLES IN SCHEMA public TO %s", strings.Join(grants.tables, ", "), user))
+	for _, creator := range creators {
+		// Tables created later, e.g. by a migration or when restoring a dump, get the same privileges
+		statements = append(statements, fmt.Sprintf("ALTER DEFAULT PRIVILEGES%s IN SCHEMA public GRANT %s ON TABLES TO %s", creator, strings.Join(grants.tables, ", "), user))
+	}
+	if len(grants.sequences) > 0 {
+		statements = append(statements, fmt.Sprintf("GRANT %s ON ALL SEQUENCES IN SCHEMA public TO %s", strings.Join(grants.sequences, ", "), user))
+		for _, creator := range creators {
+			statements = append(statements, fmt.Sprintf("ALTER DEFAULT PRIVILEGES%s IN SCHEMA public GRANT %s ON SEQUENCES TO %s", creator, strings.Join(grants.sequences, ", "), user))
+		}
+	}
+	return statements
+}
+
+// VerifyLogin checks that the user can log in to the database with its password
+func (ps *PostgresServer) VerifyLogin(database Database) (string, error) {
+	db, err := sql.Open("pgx", ps.dsn(database.Username, database.Password, database.Name))
+	if err != nil {
+		return "unable to connect to database as user", err
+	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		return "unable to log in to database as user", err
+	}
+	return "Login to database successful", nil
+}
+
+// VerifyAccess checks that the user can log in to the database and read and write in it.
+// The check writes to a temporary table inside a transaction which is rolled back.
+// Users without privileges to write are only checked by logging in.
+func (ps *PostgresServer) VerifyAccess(database Database) (string, error) {
+	if !writable(database.Privileges) {
+		return ps.VerifyLogin(database)
+	}
+	db, err := sql.Open("pgx", ps.dsn(database.Username, database.Password, database.Name))
+	if err != nil {
+		return "unable to connect to database as user", err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return "unable to log in to database as user", err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("CREATE TEMPORARY TABLE database_controller_verify (value integer) ON COMMIT DROP"); err != nil {
+		return "unable to create table as user", err
+	}
+	if _, err := tx.Exec("INSERT INTO database_controller_verify (value) VALUES ($1)", 1); err != nil {
+		return "unable to write as user", err
+	}
+	var value int
+	if err := tx.QueryRow("SELECT value FROM database_controller_verify").Scan(&value); err != nil {
+		return "unable to read as user", err
+	}
+	return "User can read and write database", nil
+}
+
+// dsn returns the connection string for a user and database on the server
+func (ps *PostgresServer) dsn(username, password, database string) string {
+	return fmt.Sprintf("user=%s password=%s host=%s port=%d database=%s sslmode=%s",
+		postgresDSNValue(username), postgresDSNValue(password), postgresDSNValue(ps.Host), ps.Port, postgresDSNValue(database), postgresDSNValue(ps.SslMode))
+}
+
 // Connect to postgresserver
 func (ps *PostgresServer) Connect() (string, error) {
-	url := fmt.Sprintf("user='%s' password='%s' host='%s' port=%d database='postgres' sslmode='%s'", ps.Username, ps.Password, ps.Host, ps.Port, ps.SslMode)
-	db, err := sql.Open("pgx", url)
+	db, err := sql.Open("pgx", ps.dsn(ps.Username, ps.Password, "postgres"))
 	if err != nil {
 		return "unable to connect to database", err
 	}
 	if err := db.Ping(); err != nil {
+		db.Close()
 		return "ping to database failed", err
 	}
 	ps.DB = db
@@ -101,5 +263,96 @@ func (ps *PostgresServer) Connect() (string, error) {
 
 // Disconnect from postgresserver
 func (ps *PostgresServer) Disconnect() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for name, db := range ps.databases {
+		db.Close()
+		delete(ps.databases, name)
+	}
 	ps.DB.Close()
 }
+
+// database returns the pool of admin connections to a database on the server, opening it the first time
+func (ps *PostgresServer) database(name string) (*sql.DB, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if db, ok := ps.databases[name]; ok {
+		return db, nil
+	}
+	db, err := sql.Open("pgx", ps.dsn(ps.Username, ps.Password, name))
+	if err != nil {
+		return nil, err
+	}
+	// Statements on single databases are rare, one connection each is enough
+	db.SetMaxOpenConns(1)
+	if ps.databases == nil {
+		ps.databases = make(map[string]*sql.DB)
+	}
+	ps.databases[name] = db
+	return db, nil
+}
+
+// closeDatabase closes the pool of admin connections to a database, which has to be done before it is dropped or copied
+func (ps *PostgresServer) closeDatabase(name string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if db, ok := ps.databases[name]; ok {
+		db.Close()
+		delete(ps.databases, name)
+	}
+}
+
+// Ping checks that the server is still reachable
+func (ps *PostgresServer) Ping() (string, error) {
+	if err := ps.DB.Ping(); err != nil {
+		return "ping to database failed", err
+	}
+	return "Ping to database successful", nil
+}
+
+// DiskUsage returns the size of the databases on the server which can be connected to
+func (ps *PostgresServer) DiskUsage() (int64, string, error) {
+	var size int64
+	if err := ps.DB.QueryRow("SELECT COALESCE(SUM(pg_database_size(datname)), 0) FROM pg_database WHERE datallowconn").Scan(&size); err != nil {
+		return 0, "unable to get size of databases", err
+	}
+	return size, "Size of databases successfully read", nil
+}
+
+// Stats returns statistics of the connection pool
+func (ps *PostgresServer) Stats() sql.DBStats {
+	return ps.DB.Stats()
+}
+
+// DumpTool dumps the database with pg_dump in its custom format, and restores it with pg_restore.
+// It logs in as the user of the database, and ownership and grants of the source do not apply, so restored objects are owned by that user.
+func (ps *PostgresServer) DumpTool(database Database, password corev1.SecretKeySelector) DumpTool {
+	return DumpTool{
+		Image: "postgres:13",
+		Env: []corev1.EnvVar{
+			{Name: "PGHOST", Value: ps.Host},
+			{Name: "PGPORT", Value: strconv.Itoa(int(ps.Port))},
+			{Name: "PGUSER", Value: database.Username},
+			{Name: "PGSSLMODE", Value: ps.SslMode},
+			{Name: "PGDATABASE", Value: database.Name},
+			passwordEnv("PGPASSWORD", password),
+		},
+		Dump:      `pg_dump --format=custom --file="$DUMP_FILE"`,
+		Restore:   `pg_restore --clean --if-exists --no-owner --no-acl --dbname="$PGDATABASE" "$DUMP_FILE"`,
+		Extension: "dump",
+	}
+}
+
+// MigrationDriver connects to the database as its user, recording migrations in the schema_migrations table
+func (ps *PostgresServer) MigrationDriver(database Database) (migratedatabase.Driver, error) {
+	db, err := sql.Open("pgx", ps.dsn(database.Username, database.Password, database.Name))
+	if err != nil {
+		return nil, err
+	}
+	driver, err := migratepostgres.WithInstance(db, &migratepostgres.Config{DatabaseName: database.Name})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return driver, nil
+}
@@ -0,0 +1,139 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+)
+
+// ErrUnsupportedPrivilege is returned for privilege levels and custom privileges a driver does not know
+var ErrUnsupportedPrivilege = errors.New("unsupported privilege")
+
+// Custom privileges are written into statements, so only privileges listed here are allowed
+var (
+	postgresTablePrivileges = []string{"SELECT", "INSERT", "UPDATE", "DELETE", "TRUNCATE", "REFERENCES", "TRIGGER"}
+	mysqlDatabasePrivileges = []string{"SELECT", "INSERT", "UPDATE", "DELETE", "CREATE", "DROP", "INDEX", "ALTER",
+		"CREATE TEMPORARY TABLES", "LOCK TABLES", "EXECUTE", "CREATE VIEW", "SHOW VIEW", "CREATE ROUTINE",
+		"ALTER ROUTINE", "EVENT", "TRIGGER", "REFERENCES"}
+	mongoDatabaseRoles = []string{"read", "readWrite", "dbAdmin", "dbOwner", "userAdmin"}
+)
+
+// postgresGrants are the privileges of a user on the database, the public schema, and the tables and sequences in it
+type postgresGrants struct {
+	database  []string
+	schema    []string
+	tables    []string
+	sequences []string
+}
+
+// postgresPrivileges maps a privilege level to postgres privileges
+func postgresPrivileges(privileges databasev1alpha1.Privileges) (postgresGrants, error) {
+	switch privileges.Level {
+	case "", databasev1alpha1.PrivilegeOwner:
+		return postgresGrants{
+			database:  []string{"CONNECT", "CREATE", "TEMPORARY"},
+			schema:    []string{"USAGE", "CREATE"},
+			tables:    []string{"ALL"},
+			sequences: []string{"ALL"},
+		}, nil
+	case databasev1alpha1.PrivilegeReadWrite:
+		return postgresGrants{
+			database:  []string{"CONNECT", "TEMPORARY"},
+			schema:    []string{"USAGE"},
+			tables:    []string{"SELECT", "INSERT", "UPDATE", "DELETE"},
+			sequences: []string{"USAGE", "SELECT", "UPDATE"},
+		}, nil
+	case databasev1alpha1.PrivilegeReadOnly:
+		return postgresGrants{
+			database:  []string{"CONNECT"},
+			schema:    []string{"USAGE"},
+			tables:    []string{"SELECT"},
+			sequences: []string{"SELECT"},
+		}, nil
+	case databasev1alpha1.PrivilegeCustom:
+		tables, err := customPrivileges(privileges.Custom, postgresTablePrivileges, strings.ToUpper)
+		if err != nil {
+			return postgresGrants{}, err
+		}
+		grants := postgresGrants{
+			database: []string{"CONNECT"},
+			schema:   []string{"USAGE"},
+			tables:   tables,
+		}
+		// Inserting into tables with serial columns needs the sequences behind them
+		if containsPrivilege(tables, "INSERT") {
+			grants.sequences = []string{"USAGE", "SELECT"}
+		}
+		return grants, nil
+	}
+	return postgresGrants{}, fmt.Errorf("%w: level %q", ErrUnsupportedPrivilege, privileges.Level)
+}
+
+// mysqlPrivileges maps a privilege level to mysql privileges on the database
+func mysqlPrivileges(privileges databasev1alpha1.Privileges) ([]string, error) {
+	switch privileges.Level {
+	case "", databasev1alpha1.PrivilegeOwner:
+		return []string{"ALL PRIVILEGES"}, nil
+	case databasev1alpha1.PrivilegeReadWrite:
+		return []string{"SELECT", "INSERT", "UPDATE", "DELETE", "CREATE TEMPORARY TABLES", "LOCK TABLES", "EXECUTE"}, nil
+	case databasev1alpha1.PrivilegeReadOnly:
+		return []string{"SELECT", "SHOW VIEW"}, nil
+	case databasev1alpha1.PrivilegeCustom:
+		return customPrivileges(privileges.Custom, mysqlDatabasePrivileges, strings.ToUpper)
+	}
+	return nil, fmt.Errorf("%w: level %q", ErrUnsupportedPrivilege, privileges.Level)
+}
+
+// mongoRoles maps a privilege level to mongo roles on the database
+func mongoRoles(privileges databasev1alpha1.Privileges) ([]string, error) {
+	switch privileges.Level {
+	case "", databasev1alpha1.PrivilegeOwner:
+		return []string{"dbOwner"}, nil
+	case databasev1alpha1.PrivilegeReadWrite:
+		return []string{"readWrite"}, nil
+	case databasev1alpha1.PrivilegeReadOnly:
+		return []string{"read"}, nil
+	case databasev1alpha1.PrivilegeCustom:
+		return customPrivileges(privileges.Custom, mongoDatabaseRoles, func(role string) string { return role })
+	}
+	return nil, fmt.Errorf("%w: level %q", ErrUnsupportedPrivilege, privileges.Level)
+}
+
+// writable reports whether the privileges include writing data, which decides how access is verified.
+// Custom privileges are only verified by logging in.
+func writable(privileges databasev1alpha1.Privileges) bool {
+	switch privileges.Level {
+	case "", databasev1alpha1.PrivilegeOwner, databasev1alpha1.PrivilegeReadWrite:
+		return true
+	}
+	return false
+}
+
+// customPrivileges normalizes custom privileges and checks them against the ones allowed, removing duplicates
+func customPrivileges(custom []string, allowed []string, normalize func(string) string) ([]string, error) {
+	if len(custom) == 0 {
+		return nil, fmt.Errorf("%w: level custom without any privileges", ErrUnsupportedPrivilege)
+	}
+	var privileges []string
+	for _, privilege := range custom {
+		privilege = normalize(strings.Join(strings.Fields(privilege), " "))
+		if !containsPrivilege(allowed, privilege) {
+			return nil, fmt.Errorf("%w: %q", ErrUnsupportedPrivilege, privilege)
+		}
+		if !containsPrivilege(privileges, privilege) {
+			privileges = append(privileges, privilege)
+		}
+	}
+	return privileges, nil
+}
+
+func containsPrivilege(privileges []string, privilege string) bool {
+	for _, p := range privileges {
+		if p == privilege {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package db
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+)
+
+func TestCustomPrivileges(t *testing.T) {
+	privileges, err := mysqlPrivileges(databasev1alpha1.Privileges{
+		Level:  databasev1alpha1.PrivilegeCustom,
+		Custom: []string{"select", " create  temporary tables", "SELECT"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"SELECT", "CREATE TEMPORARY TABLES"}; !reflect.DeepEqual(privileges, expected) {
+		t.Fatalf("expected %v, got %v", expected, privileges)
+	}
+
+	for _, custom := range [][]string{nil, {"SELECT; DROP DATABASE mysql"}, {"ALL PRIVILEGES"}, {"GRANT OPTION"}} {
+		_, err := mysqlPrivileges(databasev1alpha1.Privileges{Level: databasev1alpha1.PrivilegeCustom, Custom: custom})
+		if !errors.Is(err, ErrUnsupportedPrivilege) {
+			t.Fatalf("expected %v to be rejected", custom)
+		}
+	}
+
+	// Mongo role names are case sensitive
+	if _, err := mongoRoles(databasev1alpha1.Privileges{Level: databasev1alpha1.PrivilegeCustom, Custom: []string{"readwrite"}}); !errors.Is(err, ErrUnsupportedPrivilege) {
+		t.Fatal("expected unknown mongo role to be rejected")
+	}
+}
+
+func TestPostgresPrivilegesDefaultToOwner(t *testing.T) {
+	owner, err := postgresPrivileges(databasev1alpha1.Privileges{Level: databasev1alpha1.PrivilegeOwner})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaulted, err := postgresPrivileges(databasev1alpha1.Privileges{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(owner, defaulted) {
+		t.Fatal("expected privileges without a level to be owner")
+	}
+
+	custom, err := postgresPrivileges(databasev1alpha1.Privileges{Level: databasev1alpha1.PrivilegeCustom, Custom: []string{"insert"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(custom.sequences) == 0 {
+		t.Fatal("expected insert to grant usage of sequences")
+	}
+}
+
+func TestMysqlPrivilegeColumns(t *testing.T) {
+	for _, privilege := range mysqlDatabasePrivileges {
+		if mysqlPrivilegeColumns[privilege] == "" {
+			t.Errorf("expected a column of mysql.db for privilege %s", privilege)
+		}
+	}
+}
+
+func TestPostgresDefaultPrivilegesForOwners(t *testing.T) {
+	grants, err := postgresPrivileges(databasev1alpha1.Privileges{Level: databasev1alpha1.PrivilegeReadOnly})
+	if err != nil {
+		t.Fatal(err)
+	}
+	statements := postgresGrantStatements(Database{Name: "orders", Username: "reporting", Owners: []string{"orders_a", "orders_b", "reporting"}}, grants)
+
+	defaults := map[string]bool{}
+	for _, statement := range statements {
+		if strings.HasPrefix(statement, "ALTER DEFAULT PRIVILEGES") && strings.Contains(statement, " GRANT ") && strings.HasSuffix(statement, "ON TABLES TO \"reporting\"") {
+			defaults[statement] = true
+		}
+	}
+	for _, expected := range []string{
+		`ALTER DEFAULT PRIVILEGES IN SCHEMA public GRANT SELECT ON TABLES TO "reporting"`,
+		`ALTER DEFAULT PRIVILEGES FOR ROLE "orders_a" IN SCHEMA public GRANT SELECT ON TABLES TO "reporting"`,
+		`ALTER DEFAULT PRIVILEGES FOR ROLE "orders_b" IN SCHEMA public GRANT SELECT ON TABLES TO "reporting"`,
+	} {
+		if !defaults[expected] {
+			t.Errorf("expected statement %s in %v", expected, statements)
+		}
+	}
+	// The user owns the tables it creates
+	if len(defaults) != 3 {
+		t.Errorf("expected 3 default privileges on tables, got %v", defaults)
+	}
+}
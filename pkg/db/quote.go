@@ -0,0 +1,54 @@
+package db
+
+import (
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Names of databases and users come straight from custom resources, so they must never be
+// interpolated into statements as is. Values are bound as parameters wherever the protocol
+// allows it. Statements which do not accept parameters, such as CREATE DATABASE or
+// CREATE USER on postgres, use the quoting functions below instead.
+
+// QuotePostgresIdentifier quotes a name for use as an identifier in a postgres statement
+func QuotePostgresIdentifier(name string) string {
+	return pgx.Identifier{name}.Sanitize()
+}
+
+// QuotePostgresLiteral quotes a value for use as a string literal in a postgres statement.
+// Values containing backslashes are written as escape strings, E'...', so the result does not depend on
+// standard_conforming_strings.
+func QuotePostgresLiteral(value string) string {
+	value = strings.ReplaceAll(value, `'`, `''`)
+	if strings.Contains(value, `\`) {
+		return `E'` + strings.ReplaceAll(value, `\`, `\\`) + `'`
+	}
+	return `'` + value + `'`
+}
+
+// QuoteMysqlIdentifier quotes a name for use as an identifier in a mysql statement
+func QuoteMysqlIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// QuoteMysqlGrantDatabase quotes a database name for use in the ON clause of a mysql GRANT or REVOKE.
+// In that position "_" and "%" are wildcards, which would widen the grant to other databases.
+func QuoteMysqlGrantDatabase(name string) string {
+	return QuoteMysqlIdentifier(mysqlGrantPattern(name))
+}
+
+// mysqlGrantPattern escapes the wildcards in a database name, which is how mysql stores the database of a grant
+func mysqlGrantPattern(name string) string {
+	name = strings.ReplaceAll(name, `\`, `\\`)
+	name = strings.ReplaceAll(name, `_`, `\_`)
+	name = strings.ReplaceAll(name, `%`, `\%`)
+	return name
+}
+
+// postgresDSNValue quotes a value for use in a postgres keyword/value connection string
+func postgresDSNValue(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return `'` + value + `'`
+}
@@ -0,0 +1,167 @@
+package db
+
+import (
+	"strings"
+	"testing"
+
+	fuzz "github.com/google/gofuzz"
+	"github.com/jackc/pgconn"
+)
+
+// dangerous are the characters which have a meaning inside or around quoted names and values
+var dangerous = []rune("\"'`\\_%;-/*$ \t\n\r\x00\x1aaZ09äø😀")
+
+// fuzzStrings returns a corpus of hand picked inputs followed by random strings up to the
+// longest name accepted by the Database CRD
+func fuzzStrings(n int) []string {
+	corpus := []string{
+		"",
+		"db",
+		`"`,
+		`""`,
+		`'`,
+		`\`,
+		`\'`,
+		"`",
+		"``",
+		`a"; DROP DATABASE postgres; --`,
+		`a'; DROP USER root; --`,
+		"a`; DROP DATABASE mysql; -- ",
+		`x\'; SELECT 1; --`,
+		"\x00",
+		"a\x00\"b",
+		"my_db%",
+	}
+
+	f := fuzz.New().NilChance(0).Funcs(func(s *string, c fuzz.Continue) {
+		runes := make([]rune, c.Intn(64))
+		for i := range runes {
+			runes[i] = dangerous[c.Intn(len(dangerous))]
+		}
+		*s = string(runes)
+	})
+	for i := 0; i < n; i++ {
+		var s string
+		f.Fuzz(&s)
+		corpus = append(corpus, s)
+	}
+	return corpus
+}
+
+// scanQuoted reads a token quoted with q from the start of s, where a doubled q stands for itself.
+// If backslash is true a backslash escapes the character following it.
+func scanQuoted(s string, q byte, backslash bool) (value, rest string, ok bool) {
+	if len(s) == 0 || s[0] != q {
+		return "", s, false
+	}
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch {
+		case backslash && s[i] == '\\':
+			if i+1 == len(s) {
+				return "", s, false
+			}
+			i++
+			b.WriteByte(s[i])
+		case s[i] == q && i+1 < len(s) && s[i+1] == q:
+			i++
+			b.WriteByte(q)
+		case s[i] == q:
+			return b.String(), s[i+1:], true
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return "", s, false
+}
+
+// scanPostgresLiteral reads a string literal from the start of s, as postgres would with the
+// given setting of standard_conforming_strings
+func scanPostgresLiteral(s string, standardConformingStrings bool) (string, string, bool) {
+	if strings.HasPrefix(s, "E'") {
+		return scanQuoted(s[1:], '\'', true)
+	}
+	return scanQuoted(s, '\'', !standardConformingStrings)
+}
+
+func TestQuotePostgresIdentifier(t *testing.T) {
+	for _, name := range fuzzStrings(5000) {
+		statement := "CREATE DATABASE " + QuotePostgresIdentifier(name) + " OWNER x"
+		value, rest, ok := scanQuoted(strings.TrimPrefix(statement, "CREATE DATABASE "), '"', false)
+		if !ok || rest != " OWNER x" {
+			t.Fatalf("identifier %q escaped its quoting: %s", name, statement)
+		}
+		// Postgres can not represent null bytes, so they are dropped
+		if value != strings.ReplaceAll(name, "\x00", "") {
+			t.Fatalf("identifier %q was quoted as %q", name, value)
+		}
+	}
+}
+
+func TestQuotePostgresLiteral(t *testing.T) {
+	for _, value := range fuzzStrings(5000) {
+		for _, standardConformingStrings := range []bool{true, false} {
+			statement := "CREATE USER x WITH PASSWORD " + QuotePostgresLiteral(value) + " VALID UNTIL 'infinity'"
+			unquoted, rest, ok := scanPostgresLiteral(strings.TrimPrefix(statement, "CREATE USER x WITH PASSWORD "), standardConformingStrings)
+			if !ok || rest != " VALID UNTIL 'infinity'" {
+				t.Fatalf("literal %q escaped its quoting: %s", value, statement)
+			}
+			if unquoted != value {
+				t.Fatalf("literal %q was quoted as %q", value, unquoted)
+			}
+		}
+	}
+}
+
+func TestQuoteMysqlIdentifier(t *testing.T) {
+	for _, name := range fuzzStrings(5000) {
+		statement := "CREATE DATABASE " + QuoteMysqlIdentifier(name) + " CHARACTER SET utf8mb4"
+		value, rest, ok := scanQuoted(strings.TrimPrefix(statement, "CREATE DATABASE "), '`', false)
+		if !ok || rest != " CHARACTER SET utf8mb4" {
+			t.Fatalf("identifier %q escaped its quoting: %s", name, statement)
+		}
+		if value != name {
+			t.Fatalf("identifier %q was quoted as %q", name, value)
+		}
+	}
+}
+
+func TestQuoteMysqlGrantDatabase(t *testing.T) {
+	for _, name := range fuzzStrings(5000) {
+		statement := "GRANT ALL PRIVILEGES ON " + QuoteMysqlGrantDatabase(name) + ".* TO ?@?"
+		pattern, rest, ok := scanQuoted(strings.TrimPrefix(statement, "GRANT ALL PRIVILEGES ON "), '`', false)
+		if !ok || rest != ".* TO ?@?" {
+			t.Fatalf("database %q escaped its quoting: %s", name, statement)
+		}
+		// Every wildcard in the pattern must be escaped, so it only matches the database itself
+		var value strings.Builder
+		for i := 0; i < len(pattern); i++ {
+			switch pattern[i] {
+			case '\\':
+				i++
+				value.WriteByte(pattern[i])
+			case '_', '%':
+				t.Fatalf("database %q left a wildcard in %q", name, pattern)
+			default:
+				value.WriteByte(pattern[i])
+			}
+		}
+		if value.String() != name {
+			t.Fatalf("database %q was quoted as %q", name, value.String())
+		}
+	}
+}
+
+func TestPostgresDSNValue(t *testing.T) {
+	for _, password := range fuzzStrings(1000) {
+		// Connection strings are sent as null terminated strings and can not contain null bytes
+		password = strings.ReplaceAll(password, "\x00", "")
+		config, err := pgconn.ParseConfig("host=localhost user=postgres password=" + postgresDSNValue(password) + " sslmode=disable")
+		if err != nil {
+			t.Fatalf("password %q could not be parsed: %v", password, err)
+		}
+		if config.Password != password || config.User != "postgres" {
+			t.Fatalf("password %q was parsed as %q", password, config.Password)
+		}
+	}
+}
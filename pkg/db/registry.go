@@ -0,0 +1,61 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+)
+
+// Factory builds a driver for a database server from its spec and the admin password stored in its secret
+type Factory func(spec *databasev1alpha1.DatabaseServerSpec, password string) SQLServer
+
+// ErrUnsupportedType is returned for database servers of a type no driver is registered for
+var ErrUnsupportedType = errors.New("unsupported database server type")
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+)
+
+// Register makes a driver available for database servers of the given types.
+// Drivers register themselves from an init function, so adding an engine does not touch the controllers.
+// It panics if a type is registered twice.
+func Register(factory Factory, types ...string) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if factory == nil {
+		panic("db: Register factory is nil")
+	}
+	for _, t := range types {
+		if _, dup := factories[t]; dup {
+			panic("db: Register called twice for type " + t)
+		}
+		factories[t] = factory
+	}
+}
+
+// New builds a driver for the type of the database server
+func New(spec *databasev1alpha1.DatabaseServerSpec, password string) (SQLServer, error) {
+	factoriesMu.RLock()
+	factory, ok := factories[spec.Type]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w %q, supported types are %v", ErrUnsupportedType, spec.Type, Types())
+	}
+	return factory(spec, password), nil
+}
+
+// Types returns a sorted list of the registered database server types
+func Types() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	types := make([]string, 0, len(factories))
+	for t := range factories {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
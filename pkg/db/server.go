@@ -1,11 +1,55 @@
 package db
 
+import (
+	"errors"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+)
+
+// ErrUserExists is returned by CreateUser for users which exist on the server but are not owned by the caller
+var ErrUserExists = errors.New("user already exists")
+
+// ErrDatabaseExists is returned by CreateDatabase for databases which exist on the server but are not owned by the caller
+var ErrDatabaseExists = errors.New("database already exists")
+
+// Database is a database on a server and the user given access to it
+type Database struct {
+	Name       string
+	Username   string
+	Password   string
+	Privileges databasev1alpha1.Privileges
+	// Source is a database on the same server which CreateDatabase copies when the database does not exist yet
+	Source string
+	// Owned is set when the user was created by the resource provisioning it. CreateUser only takes over
+	// existing users which are owned, others may be the admin user or belong to someone else.
+	Owned bool
+	// DatabaseOwned is set when the database was created by the resource provisioning it. CreateDatabase only accepts
+	// existing databases which are owned, others may be system databases or belong to someone else.
+	DatabaseOwned bool
+	// Owners are the users creating tables in the database besides the admin user, e.g. both users of dual user rotation.
+	// GrantPermissions gives the user its privileges on the tables they create later.
+	Owners []string
+}
+
+// SQLServer is a connection to a database server able to provision databases and users on it
 type SQLServer interface {
 	Connect() (string, error)
 	Disconnect()
-	CreateUser() (string, error)
-	DeleteUser() (string, error)
-	CreateDatabase() (string, error)
-	DeleteDatabase() (string, error)
-	GrantPermissions() (string, error)
+	Ping() (string, error)
+	CreateUser(database Database) (string, error)
+	UpdatePassword(database Database) (string, error)
+	DeleteUser(database Database) (string, error)
+	CreateDatabase(database Database) (string, error)
+	DeleteDatabase(database Database) (string, error)
+	GrantPermissions(database Database) (string, error)
+	// VerifyLogin and VerifyAccess connect as the user instead of using the pool, which is logged in as the admin user.
+	// The connection is not kept, so every check logs in with the current password.
+	VerifyLogin(database Database) (string, error)
+	VerifyAccess(database Database) (string, error)
+}
+
+// DiskUser is implemented by drivers able to report the disk space used by the databases on a server
+type DiskUser interface {
+	// DiskUsage returns the size of all databases on the server in bytes
+	DiskUsage() (int64, string, error)
 }
@@ -0,0 +1,156 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+)
+
+// ErrInvalidName is returned for names of databases or users the engine of a server can not represent
+var ErrInvalidName = errors.New("invalid name")
+
+// ErrMigrationsPath is returned for migrations from a path outside the directory migrations may be read from
+var ErrMigrationsPath = errors.New("migrations path not allowed")
+
+// ErrSectionMismatch is returned for database servers whose engine section does not match their type
+var ErrSectionMismatch = errors.New("engine section does not match type")
+
+// Rules are the limits an engine puts on a database server spec and on the names of databases and users
+type Rules struct {
+	// Section is the field of DatabaseServerSpec the engine is configured by, e.g. postgres
+	Section string
+	// MaxDatabaseName and MaxUsername are the longest names of databases and users in bytes, 0 for no limit
+	MaxDatabaseName int
+	MaxUsername     int
+	// InvalidDatabaseChars are characters not allowed in names of databases
+	InvalidDatabaseChars string
+	// ReservedNames are the system databases and users of the engine, which tenants must never take over.
+	// They are compared regardless of case.
+	ReservedNames []string
+}
+
+var (
+	rulesMu sync.RWMutex
+	rules   = make(map[string]Rules)
+)
+
+// RegisterRules makes the rules of an engine available for database servers of the given types.
+// Drivers register their rules from an init function next to their factory.
+func RegisterRules(r Rules, types ...string) {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	for _, t := range types {
+		if _, dup := rules[t]; dup {
+			panic("db: RegisterRules called twice for type " + t)
+		}
+		rules[t] = r
+	}
+}
+
+func rulesFor(serverType string) (Rules, bool) {
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
+	r, ok := rules[serverType]
+	return r, ok
+}
+
+// sections returns the engine sections set in the spec of a database server
+func sections(spec *databasev1alpha1.DatabaseServerSpec) map[string]bool {
+	return map[string]bool{
+		"postgres": spec.Postgres != databasev1alpha1.Postgres{},
+		"mysql":    spec.Mysql != databasev1alpha1.Mysql{},
+		"mongo":    spec.Mongo != databasev1alpha1.Mongo{},
+	}
+}
+
+// ValidateServer checks that the spec of a database server has the section of its type, and no other
+func ValidateServer(spec *databasev1alpha1.DatabaseServerSpec) error {
+	r, ok := rulesFor(spec.Type)
+	if !ok {
+		return fmt.Errorf("%w %q, supported types are %v", ErrUnsupportedType, spec.Type, Types())
+	}
+	set := sections(spec)
+	if !set[r.Section] {
+		return fmt.Errorf("%w: type %s is configured by section %s, which is not set", ErrSectionMismatch, spec.Type, r.Section)
+	}
+	for section, isSet := range set {
+		if isSet && section != r.Section {
+			return fmt.Errorf("%w: section %s is set on a server of type %s", ErrSectionMismatch, section, spec.Type)
+		}
+	}
+	return nil
+}
+
+// ValidateDatabaseName checks that a database name can be represented by the engine of a type.
+// Names for types without rules are not checked.
+func ValidateDatabaseName(serverType, name string) error {
+	r, ok := rulesFor(serverType)
+	if !ok {
+		return nil
+	}
+	if err := validateName("database", name, r.MaxDatabaseName, r.ReservedNames, serverType); err != nil {
+		return err
+	}
+	if i := strings.IndexAny(name, r.InvalidDatabaseChars); i >= 0 {
+		return fmt.Errorf("%w: database name %q contains %q, which %s does not allow", ErrInvalidName, name, name[i], serverType)
+	}
+	return nil
+}
+
+// ValidateUsername checks that a username can be represented by the engine of a type.
+// Names for types without rules are not checked.
+func ValidateUsername(serverType, name string) error {
+	r, ok := rulesFor(serverType)
+	if !ok {
+		return nil
+	}
+	return validateName("user", name, r.MaxUsername, r.ReservedNames, serverType)
+}
+
+// ValidateNotAdmin checks that a username is not the admin user of a server, which tenants must never
+// take over, whatever the type of the server
+func ValidateNotAdmin(spec *databasev1alpha1.DatabaseServerSpec, username string) error {
+	for _, admin := range []string{spec.Postgres.Username, spec.Mysql.Username, spec.Mongo.Username} {
+		if admin != "" && admin == username {
+			return fmt.Errorf("%w: user %q is the admin user of the server", ErrInvalidName, username)
+		}
+	}
+	return nil
+}
+
+func validateName(kind, name string, max int, reserved []string, serverType string) error {
+	for _, r := range reserved {
+		if strings.EqualFold(name, r) {
+			return fmt.Errorf("%w: %s name %q is reserved by %s", ErrInvalidName, kind, name, serverType)
+		}
+	}
+	switch {
+	case name == "":
+		return fmt.Errorf("%w: %s name is empty", ErrInvalidName, kind)
+	case strings.ContainsRune(name, 0):
+		return fmt.Errorf("%w: %s name %q contains a null character", ErrInvalidName, kind, name)
+	case max > 0 && len(name) > max:
+		return fmt.Errorf("%w: %s name %q is longer than the %d bytes %s allows", ErrInvalidName, kind, name, max, serverType)
+	}
+	return nil
+}
+
+// ValidateMigrationsPath checks that a directory of migrations is in root, or root itself. Without a root no path is allowed,
+// only config maps, which are in the namespace of the database. Otherwise any file the controller can read could be applied.
+func ValidateMigrationsPath(root, path string) error {
+	if root == "" {
+		return fmt.Errorf("%w: migrations can only be read from config maps", ErrMigrationsPath)
+	}
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("%w: %s is not an absolute path", ErrMigrationsPath, path)
+	}
+	rel, err := filepath.Rel(filepath.Clean(root), filepath.Clean(path))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%w: %s is not in %s", ErrMigrationsPath, path, root)
+	}
+	return nil
+}
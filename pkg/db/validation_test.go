@@ -0,0 +1,101 @@
+package db
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+)
+
+func TestValidateServer(t *testing.T) {
+	postgres := databasev1alpha1.Postgres{Host: "localhost", Username: "postgres", Port: 5432, SslMode: "require"}
+	tests := []struct {
+		spec databasev1alpha1.DatabaseServerSpec
+		want error
+	}{
+		{databasev1alpha1.DatabaseServerSpec{Type: "postgres", Postgres: postgres}, nil},
+		{databasev1alpha1.DatabaseServerSpec{Type: "postgresql", Postgres: postgres}, nil},
+		{databasev1alpha1.DatabaseServerSpec{Type: "mysql", Postgres: postgres}, ErrSectionMismatch},
+		{databasev1alpha1.DatabaseServerSpec{Type: "postgres", Postgres: postgres, Mongo: databasev1alpha1.Mongo{Host: "localhost"}}, ErrSectionMismatch},
+		{databasev1alpha1.DatabaseServerSpec{Type: "oracle", Postgres: postgres}, ErrUnsupportedType},
+	}
+	for _, tt := range tests {
+		if err := ValidateServer(&tt.spec); !errors.Is(err, tt.want) && err != tt.want {
+			t.Errorf("ValidateServer(%s) = %v, want %v", tt.spec.Type, err, tt.want)
+		}
+	}
+}
+
+func TestValidateNames(t *testing.T) {
+	tests := []struct {
+		serverType string
+		database   string
+		username   string
+		valid      bool
+	}{
+		{"postgres", "orders", "orders", true},
+		{"postgres", strings.Repeat("a", 64), "orders", false},
+		{"postgres", "orders", "ord\x00ers", false},
+		{"mysql", "orders.v2", "orders", false},
+		{"mysql", "orders", strings.Repeat("a", 33), false},
+		{"mongo", "orders$", "orders", false},
+		{"mongo", "orders", strings.Repeat("a", 100), true},
+		{"unknown", "orders.v2", "", true},
+		{"postgres", "template1", "orders", false},
+		{"postgres", "orders", "postgres", false},
+		{"mysql", "Information_Schema", "orders", false},
+		{"mysql", "orders", "sys", false},
+		{"mongo", "admin", "orders", false},
+		{"mongo", "orders", "local", false},
+		{"mongo", "mysql", "postgres", true},
+	}
+	for _, tt := range tests {
+		err := ValidateDatabaseName(tt.serverType, tt.database)
+		if err == nil {
+			err = ValidateUsername(tt.serverType, tt.username)
+		}
+		if (err == nil) != tt.valid {
+			t.Errorf("names %q and %q on %s: got %v, want valid %t", tt.database, tt.username, tt.serverType, err, tt.valid)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidName) {
+			t.Errorf("names %q and %q on %s: got %v, want ErrInvalidName", tt.database, tt.username, tt.serverType, err)
+		}
+	}
+}
+
+func TestValidateNotAdmin(t *testing.T) {
+	spec := databasev1alpha1.DatabaseServerSpec{Type: "postgres", Postgres: databasev1alpha1.Postgres{Host: "localhost", Username: "postgres"}}
+	if err := ValidateNotAdmin(&spec, "postgres"); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("ValidateNotAdmin(postgres) = %v, want %v", err, ErrInvalidName)
+	}
+	if err := ValidateNotAdmin(&spec, "orders"); err != nil {
+		t.Errorf("ValidateNotAdmin(orders) = %v, want nil", err)
+	}
+}
+
+func TestValidateMigrationsPath(t *testing.T) {
+	tests := []struct {
+		root  string
+		path  string
+		valid bool
+	}{
+		{"/migrations", "/migrations/orders", true},
+		{"/migrations", "/migrations", true},
+		{"/migrations/", "/migrations/orders/../payments", true},
+		{"/migrations", "/migrations/../etc", false},
+		{"/migrations", "/migrations-other/orders", false},
+		{"/migrations", "/var/run/secrets", false},
+		{"/migrations", "orders", false},
+		{"", "/migrations/orders", false},
+	}
+	for _, tt := range tests {
+		err := ValidateMigrationsPath(tt.root, tt.path)
+		if (err == nil) != tt.valid {
+			t.Errorf("path %q in root %q: got %v, want valid %t", tt.path, tt.root, err, tt.valid)
+		}
+		if err != nil && !errors.Is(err, ErrMigrationsPath) {
+			t.Errorf("path %q in root %q: got %v, want ErrMigrationsPath", tt.path, tt.root, err)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+// Package labelcache caches secrets, config maps and jobs only when they carry a label, instead of every one in the cluster
+package labelcache
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Cache is the cache of the manager, with secrets, config maps, jobs and cron jobs only cached when they match
+// a label selector. Those types are common and large in most clusters, while the controller only needs few of them.
+//
+// Objects of these types not matching the selector are read from the API server by Get, e.g. the admin secrets of
+// database servers, and changes to them are not watched. List only returns the objects matching the selector.
+type Cache struct {
+	cache.Cache
+	scheme    *runtime.Scheme
+	api       client.Reader
+	factory   informers.SharedInformerFactory
+	informers map[reflect.Type]toolscache.SharedIndexInformer
+	lists     map[reflect.Type]toolscache.SharedIndexInformer
+}
+
+var _ cache.Cache = &Cache{}
+
+// New returns a function creating the cache of a manager, which only caches secrets, config maps and jobs matching a selector
+func New(selector labels.Selector) cache.NewCacheFunc {
+	return func(config *rest.Config, opts cache.Options) (cache.Cache, error) {
+		def, err := cache.New(config, opts)
+		if err != nil {
+			return nil, err
+		}
+		clientset, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		api, err := client.New(config, client.Options{Scheme: opts.Scheme, Mapper: opts.Mapper})
+		if err != nil {
+			return nil, err
+		}
+		var resync time.Duration
+		if opts.Resync != nil {
+			resync = *opts.Resync
+		}
+		factoryOpts := []informers.SharedInformerOption{
+			informers.WithTweakListOptions(func(o *metav1.ListOptions) { o.LabelSelector = selector.String() }),
+		}
+		if opts.Namespace != "" {
+			factoryOpts = append(factoryOpts, informers.WithNamespace(opts.Namespace))
+		}
+		return newCache(def, opts.Scheme, api, informers.NewSharedInformerFactoryWithOptions(clientset, resync, factoryOpts...)), nil
+	}
+}
+
+// newCache returns a cache reading the labelled types from the informers of a factory, and other types from a default cache
+func newCache(def cache.Cache, scheme *runtime.Scheme, api client.Reader, factory informers.SharedInformerFactory) *Cache {
+	secrets := factory.Core().V1().Secrets().Informer()
+	configMaps := factory.Core().V1().ConfigMaps().Informer()
+	jobs := factory.Batch().V1().Jobs().Informer()
+	cronJobs := factory.Batch().V1beta1().CronJobs().Informer()
+	return &Cache{
+		Cache:   def,
+		scheme:  scheme,
+		api:     api,
+		factory: factory,
+		informers: map[reflect.Type]toolscache.SharedIndexInformer{
+			reflect.TypeOf(&corev1.Secret{}):        secrets,
+			reflect.TypeOf(&corev1.ConfigMap{}):     configMaps,
+			reflect.TypeOf(&batchv1.Job{}):          jobs,
+			reflect.TypeOf(&batchv1beta1.CronJob{}): cronJobs,
+		},
+		lists: map[reflect.Type]toolscache.SharedIndexInformer{
+			reflect.TypeOf(&corev1.SecretList{}):        secrets,
+			reflect.TypeOf(&corev1.ConfigMapList{}):     configMaps,
+			reflect.TypeOf(&batchv1.JobList{}):          jobs,
+			reflect.TypeOf(&batchv1beta1.CronJobList{}): cronJobs,
+		},
+	}
+}
+
+// Get reads an object of a labelled type from the informer, or from the API server when it does not match the selector
+func (c *Cache) Get(ctx context.Context, key client.ObjectKey, obj runtime.Object) error {
+	informer, ok := c.informers[reflect.TypeOf(obj)]
+	if !ok {
+		return c.Cache.Get(ctx, key, obj)
+	}
+	storeKey := key.Name
+	if key.Namespace != "" {
+		storeKey = key.Namespace + "/" + key.Name
+	}
+	item, exists, err := informer.GetIndexer().GetByKey(storeKey)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return c.api.Get(ctx, key, obj)
+	}
+	reflect.ValueOf(obj).Elem().Set(reflect.ValueOf(item.(runtime.Object).DeepCopyObject()).Elem())
+	return nil
+}
+
+// List lists the objects of a labelled type matching the selector from the informer. Lists by field are read from the API server.
+func (c *Cache) List(ctx context.Context, list runtime.Object, opts ...client.ListOption) error {
+	informer, ok := c.lists[reflect.TypeOf(list)]
+	if !ok {
+		return c.Cache.List(ctx, list, opts...)
+	}
+	listOpts := (&client.ListOptions{}).ApplyOptions(opts)
+	if listOpts.FieldSelector != nil {
+		return c.api.List(ctx, list, opts...)
+	}
+
+	var items []interface{}
+	if listOpts.Namespace != "" {
+		var err error
+		if items, err = informer.GetIndexer().ByIndex(toolscache.NamespaceIndex, listOpts.Namespace); err != nil {
+			return err
+		}
+	} else {
+		items = informer.GetIndexer().List()
+	}
+	objects := make([]runtime.Object, 0, len(items))
+	for _, item := range items {
+		obj := item.(runtime.Object)
+		if listOpts.LabelSelector != nil {
+			accessor, err := apimeta.Accessor(obj)
+			if err != nil {
+				return err
+			}
+			if !listOpts.LabelSelector.Matches(labels.Set(accessor.GetLabels())) {
+				continue
+			}
+		}
+		objects = append(objects, obj.DeepCopyObject())
+	}
+	return apimeta.SetList(list, objects)
+}
+
+// GetInformer returns the informer of the labelled types, so watches only see objects matching the selector
+func (c *Cache) GetInformer(obj runtime.Object) (cache.Informer, error) {
+	if informer, ok := c.informers[reflect.TypeOf(obj)]; ok {
+		return informer, nil
+	}
+	return c.Cache.GetInformer(obj)
+}
+
+// GetInformerForKind returns the informer of a kind, see GetInformer
+func (c *Cache) GetInformerForKind(gvk schema.GroupVersionKind) (cache.Informer, error) {
+	obj, err := c.scheme.New(gvk)
+	if err != nil {
+		return nil, err
+	}
+	return c.GetInformer(obj)
+}
+
+// IndexField adds an index to the default cache. The labelled types can not be indexed.
+func (c *Cache) IndexField(obj runtime.Object, field string, extractValue client.IndexerFunc) error {
+	if _, ok := c.informers[reflect.TypeOf(obj)]; ok {
+		return fmt.Errorf("labelcache: indexes on %T are not supported", obj)
+	}
+	return c.Cache.IndexField(obj, field, extractValue)
+}
+
+// Start runs the informers of the labelled types and of the default cache until the channel is closed. It blocks.
+func (c *Cache) Start(stop <-chan struct{}) error {
+	c.factory.Start(stop)
+	return c.Cache.Start(stop)
+}
+
+// WaitForCacheSync waits for the informers of the labelled types and of the default cache to sync
+func (c *Cache) WaitForCacheSync(stop <-chan struct{}) bool {
+	for _, informer := range c.informers {
+		if !toolscache.WaitForCacheSync(stop, informer.HasSynced) {
+			return false
+		}
+	}
+	return c.Cache.WaitForCacheSync(stop)
+}
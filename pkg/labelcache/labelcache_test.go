@@ -0,0 +1,106 @@
+package labelcache
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func secret(namespace, name string, labels map[string]string) *corev1.Secret {
+	return &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: labels}}
+}
+
+// testCache returns a cache whose informers see the labelled secrets, and whose API server only has the unlabelled one
+func testCache(t *testing.T, stop chan struct{}) *Cache {
+	watched := map[string]string{"watch": "true"}
+	clientset := kubefake.NewSimpleClientset(
+		secret("team-a", "orders", watched),
+		secret("team-a", "payments", map[string]string{"watch": "true", "app": "payments"}),
+		secret("team-b", "orders", watched),
+	)
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0)
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	api := fake.NewFakeClientWithScheme(scheme, secret("team-a", "admin", nil))
+
+	c := newCache(nil, scheme, api, factory)
+	factory.Start(stop)
+	for _, informer := range c.informers {
+		if !toolscache.WaitForCacheSync(stop, informer.HasSynced) {
+			t.Fatal("informers did not sync")
+		}
+	}
+	return c
+}
+
+func TestGet(t *testing.T) {
+	stop := make(chan struct{})
+	defer close(stop)
+	c := testCache(t, stop)
+
+	var s corev1.Secret
+	if err := c.Get(context.Background(), client.ObjectKey{Namespace: "team-a", Name: "orders"}, &s); err != nil {
+		t.Fatalf("labelled secret: %v", err)
+	}
+	if s.Name != "orders" || s.Namespace != "team-a" {
+		t.Errorf("labelled secret: got %s/%s", s.Namespace, s.Name)
+	}
+	// Secrets without the label are read from the API server
+	if err := c.Get(context.Background(), client.ObjectKey{Namespace: "team-a", Name: "admin"}, &s); err != nil {
+		t.Fatalf("unlabelled secret: %v", err)
+	}
+	if s.Name != "admin" {
+		t.Errorf("unlabelled secret: got %s", s.Name)
+	}
+	if err := c.Get(context.Background(), client.ObjectKey{Namespace: "team-a", Name: "missing"}, &s); !apierrors.IsNotFound(err) {
+		t.Errorf("missing secret: got %v, want not found", err)
+	}
+}
+
+func TestList(t *testing.T) {
+	stop := make(chan struct{})
+	defer close(stop)
+	c := testCache(t, stop)
+
+	tests := []struct {
+		opts []client.ListOption
+		want int
+	}{
+		{nil, 3},
+		{[]client.ListOption{client.InNamespace("team-a")}, 2},
+		{[]client.ListOption{client.InNamespace("team-a"), client.MatchingLabels{"app": "payments"}}, 1},
+		{[]client.ListOption{client.MatchingLabelsSelector{Selector: labels.Everything()}}, 3},
+	}
+	for i, tt := range tests {
+		var list corev1.SecretList
+		if err := c.List(context.Background(), &list, tt.opts...); err != nil {
+			t.Fatalf("list %d: %v", i, err)
+		}
+		if len(list.Items) != tt.want {
+			t.Errorf("list %d: got %d secrets, want %d", i, len(list.Items), tt.want)
+		}
+	}
+}
+
+func TestIndexFieldOfLabelledType(t *testing.T) {
+	stop := make(chan struct{})
+	defer close(stop)
+	c := testCache(t, stop)
+
+	if err := c.IndexField(&corev1.Secret{}, ".type", func(runtime.Object) []string { return nil }); err == nil {
+		t.Error("expected indexing secrets to fail")
+	}
+}
@@ -0,0 +1,61 @@
+// Package secrets decides which namespaces databases and users may keep their credentials in
+package secrets
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+)
+
+// Get returns the secret a reference points to, read through the cache of the manager
+func Get(ctx context.Context, c client.Reader, ref databasev1alpha1.Secret) (*corev1.Secret, error) {
+	var secret corev1.Secret
+	if err := c.Get(ctx, client.ObjectKey{Namespace: ref.Namespace, Name: ref.Name}, &secret); err != nil {
+		return nil, err
+	}
+	return &secret, nil
+}
+
+// Allowed reports whether a resource of a kind in a namespace may write its credentials to a secret.
+// Secrets in the namespace of the resource are always allowed, others need a DatabaseSecretGrant in the namespace of the secret.
+func Allowed(ctx context.Context, c client.Reader, kind, namespace string, secret databasev1alpha1.Secret) (bool, error) {
+	if secret.Namespace == namespace {
+		return true, nil
+	}
+	var grants databasev1alpha1.DatabaseSecretGrantList
+	if err := c.List(ctx, &grants, client.InNamespace(secret.Namespace)); err != nil {
+		return false, err
+	}
+	for i := range grants.Items {
+		if Grants(&grants.Items[i], kind, namespace, secret.Name) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Grants reports whether a grant allows a resource of a kind in a namespace to write the secret with a name in the namespace of the grant
+func Grants(grant *databasev1alpha1.DatabaseSecretGrant, kind, namespace, name string) bool {
+	from := false
+	for _, f := range grant.Spec.From {
+		if f.Kind == kind && f.Namespace == namespace {
+			from = true
+			break
+		}
+	}
+	if !from {
+		return false
+	}
+	if len(grant.Spec.SecretNames) == 0 {
+		return true
+	}
+	for _, secretName := range grant.Spec.SecretNames {
+		if secretName == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,36 @@
+package secrets
+
+import (
+	"testing"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+)
+
+func TestGrants(t *testing.T) {
+	grant := &databasev1alpha1.DatabaseSecretGrant{
+		Spec: databasev1alpha1.DatabaseSecretGrantSpec{
+			From: []databasev1alpha1.SecretGrantFrom{
+				{Kind: databasev1alpha1.DatabaseKind, Namespace: "team-a"},
+			},
+		},
+	}
+	tests := []struct {
+		kind        string
+		namespace   string
+		name        string
+		secretNames []string
+		want        bool
+	}{
+		{databasev1alpha1.DatabaseKind, "team-a", "orders", nil, true},
+		{databasev1alpha1.DatabaseUserKind, "team-a", "orders", nil, false},
+		{databasev1alpha1.DatabaseKind, "team-b", "orders", nil, false},
+		{databasev1alpha1.DatabaseKind, "team-a", "orders", []string{"orders"}, true},
+		{databasev1alpha1.DatabaseKind, "team-a", "payments", []string{"orders"}, false},
+	}
+	for _, tt := range tests {
+		grant.Spec.SecretNames = tt.secretNames
+		if got := Grants(grant, tt.kind, tt.namespace, tt.name); got != tt.want {
+			t.Errorf("Grants(%s, %s, %s) with secret names %v = %t, want %t", tt.kind, tt.namespace, tt.name, tt.secretNames, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package servers
+
+import (
+	"sync"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+)
+
+// Cursor takes turns between database servers. Servers are ordered by namespace and name, and each turn goes to
+// the first candidate after the server of the last turn, starting over at the first. Servers which stop or start
+// being candidates keep their place in the order, so the others are not skipped or given a turn twice.
+// The zero value starts at the first server.
+type Cursor struct {
+	mu   sync.Mutex
+	last *databasev1alpha1.Server
+}
+
+// Next returns the candidate whose turn it is and moves the cursor to it.
+// The candidates must be sorted by namespace and name.
+func (c *Cursor) Next(candidates []*databasev1alpha1.DatabaseServer) *databasev1alpha1.DatabaseServer {
+	if len(candidates) == 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	next := candidates[0]
+	if c.last != nil {
+		for _, server := range candidates {
+			if after(server, *c.last) {
+				next = server
+				break
+			}
+		}
+	}
+	last := RefTo(next)
+	c.last = &last
+	return next
+}
+
+// after reports whether a server comes after a reference in the order of namespace and name
+func after(server *databasev1alpha1.DatabaseServer, ref databasev1alpha1.Server) bool {
+	if server.Namespace != ref.Namespace {
+		return server.Namespace > ref.Namespace
+	}
+	return server.Name > ref.Name
+}
@@ -0,0 +1,58 @@
+package servers
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+)
+
+func server(name string) *databasev1alpha1.DatabaseServer {
+	return &databasev1alpha1.DatabaseServer{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name}}
+}
+
+func TestCursorTakesTurns(t *testing.T) {
+	a, b, c := server("a"), server("b"), server("c")
+	var cursor Cursor
+	for i, want := range []string{"a", "b", "c", "a", "b"} {
+		if got := cursor.Next([]*databasev1alpha1.DatabaseServer{a, b, c}); got.Name != want {
+			t.Fatalf("turn %d went to %s, want %s", i, got.Name, want)
+		}
+	}
+}
+
+func TestCursorWithChangingCandidates(t *testing.T) {
+	a, aa, b, c, d := server("a"), server("aa"), server("b"), server("c"), server("d")
+	var cursor Cursor
+	turns := []struct {
+		candidates []*databasev1alpha1.DatabaseServer
+		want       string
+	}{
+		{[]*databasev1alpha1.DatabaseServer{a, b, c}, "a"},
+		{[]*databasev1alpha1.DatabaseServer{a, b, c}, "b"},
+		// The server of the last turn stops being a candidate, the next one still gets its turn
+		{[]*databasev1alpha1.DatabaseServer{a, c}, "c"},
+		// A new server joins after the cursor and gets its turn before starting over
+		{[]*databasev1alpha1.DatabaseServer{a, b, c, d}, "d"},
+		{[]*databasev1alpha1.DatabaseServer{a, b, c, d}, "a"},
+		{[]*databasev1alpha1.DatabaseServer{a, b, c, d}, "b"},
+		// A new server joining before the cursor waits for the next round
+		{[]*databasev1alpha1.DatabaseServer{a, aa, b, c, d}, "c"},
+		{[]*databasev1alpha1.DatabaseServer{a, aa, b, c, d}, "d"},
+		{[]*databasev1alpha1.DatabaseServer{a, aa, b, c, d}, "a"},
+		{[]*databasev1alpha1.DatabaseServer{a, aa, b, c, d}, "aa"},
+	}
+	for i, turn := range turns {
+		if got := cursor.Next(turn.candidates); got.Name != turn.want {
+			t.Fatalf("turn %d went to %s, want %s", i, got.Name, turn.want)
+		}
+	}
+}
+
+func TestCursorWithoutCandidates(t *testing.T) {
+	var cursor Cursor
+	if got := cursor.Next(nil); got != nil {
+		t.Fatalf("expected no server, got %s", got.Name)
+	}
+}
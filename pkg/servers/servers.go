@@ -0,0 +1,135 @@
+// Package servers resolves references to database servers of both kinds and decides which namespaces may use them
+package servers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+)
+
+// Ref returns a reference with its kind set, so references to the same server compare equal
+func Ref(server databasev1alpha1.Server) databasev1alpha1.Server {
+	if server.Kind == "" {
+		server.Kind = databasev1alpha1.DatabaseServerKind
+	}
+	return server
+}
+
+// RefTo returns the reference to a database server returned by Get or List
+func RefTo(server *databasev1alpha1.DatabaseServer) databasev1alpha1.Server {
+	if server.Namespace == "" {
+		return databasev1alpha1.Server{Kind: databasev1alpha1.ClusterDatabaseServerKind, Name: server.Name}
+	}
+	return databasev1alpha1.Server{Kind: databasev1alpha1.DatabaseServerKind, Name: server.Name, Namespace: server.Namespace}
+}
+
+// DatabaseRef returns the reference to the database server a database is created on.
+// Once the database has been placed this is the server recorded in its status.
+func DatabaseRef(database *databasev1alpha1.Database) databasev1alpha1.Server {
+	if database.Status.Server != nil {
+		return Ref(*database.Status.Server)
+	}
+	return SpecRef(database)
+}
+
+// SpecRef returns the reference to the database server named in the spec of a database.
+// A DatabaseServer without namespace is in the namespace of the database.
+func SpecRef(database *databasev1alpha1.Database) databasev1alpha1.Server {
+	ref := Ref(database.Spec.Server)
+	if ref.Kind == databasev1alpha1.DatabaseServerKind && ref.Namespace == "" {
+		ref.Namespace = database.Namespace
+	}
+	return ref
+}
+
+// FromCluster returns a ClusterDatabaseServer as a DatabaseServer without namespace,
+// so both kinds are handled the same way
+func FromCluster(server *databasev1alpha1.ClusterDatabaseServer) *databasev1alpha1.DatabaseServer {
+	return &databasev1alpha1.DatabaseServer{
+		TypeMeta:   metav1.TypeMeta{APIVersion: databasev1alpha1.GroupVersion.String(), Kind: databasev1alpha1.ClusterDatabaseServerKind},
+		ObjectMeta: server.ObjectMeta,
+		Spec:       server.Spec,
+		Status:     server.Status,
+	}
+}
+
+// Get returns the database server a reference points to
+func Get(ctx context.Context, c client.Reader, ref databasev1alpha1.Server) (*databasev1alpha1.DatabaseServer, error) {
+	if Ref(ref).Kind == databasev1alpha1.ClusterDatabaseServerKind {
+		var server databasev1alpha1.ClusterDatabaseServer
+		if err := c.Get(ctx, client.ObjectKey{Name: ref.Name}, &server); err != nil {
+			return nil, err
+		}
+		return FromCluster(&server), nil
+	}
+	var server databasev1alpha1.DatabaseServer
+	if err := c.Get(ctx, client.ObjectKey{Namespace: ref.Namespace, Name: ref.Name}, &server); err != nil {
+		return nil, err
+	}
+	server.Default()
+	return &server, nil
+}
+
+// List returns the database servers of both kinds matching a selector
+func List(ctx context.Context, c client.Reader, selector labels.Selector) ([]databasev1alpha1.DatabaseServer, error) {
+	var servers databasev1alpha1.DatabaseServerList
+	if err := c.List(ctx, &servers, client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return nil, err
+	}
+	var clusterServers databasev1alpha1.ClusterDatabaseServerList
+	if err := c.List(ctx, &clusterServers, client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return nil, err
+	}
+	for i := range servers.Items {
+		servers.Items[i].Default()
+	}
+	result := servers.Items
+	for i := range clusterServers.Items {
+		result = append(result, *FromCluster(&clusterServers.Items[i]))
+	}
+	return result, nil
+}
+
+// AllowAllNamespaces in the allowed namespaces of a database server allows every namespace
+const AllowAllNamespaces = "*"
+
+// AllowsNamespace reports whether databases in a namespace may be created on a database server.
+// A DatabaseServer allows its own namespace, other namespaces have to be allowed explicitly, for a
+// ClusterDatabaseServer as well. Every namespace is only allowed by AllowAllNamespaces.
+func AllowsNamespace(ctx context.Context, c client.Reader, server *databasev1alpha1.DatabaseServer, namespace string) (bool, error) {
+	if server.Namespace != "" && server.Namespace == namespace {
+		return true, nil
+	}
+	allowed := server.Spec.AllowedNamespaces
+	if allowed == nil {
+		return false, nil
+	}
+	for _, name := range allowed.Names {
+		if name == namespace || name == AllowAllNamespaces {
+			return true, nil
+		}
+	}
+	if allowed.Selector == nil {
+		return false, nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(allowed.Selector)
+	if err != nil {
+		return false, err
+	}
+	var ns corev1.Namespace
+	if err := c.Get(ctx, client.ObjectKey{Name: namespace}, &ns); err != nil {
+		return false, err
+	}
+	return selector.Matches(labels.Set(ns.Labels)), nil
+}
+
+// SecretAllowed reports whether the admin secret of a database server is somewhere it may be read from.
+// The secret of a DatabaseServer must be in its namespace, so a server can not expose the secrets of another namespace.
+func SecretAllowed(server *databasev1alpha1.DatabaseServer) bool {
+	return server.Namespace == "" || server.Spec.Secret.Namespace == server.Namespace
+}
@@ -0,0 +1,155 @@
+package webhooks
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+	db "flow.stacc.dev/database-provisioning-poc/pkg/db"
+	"flow.stacc.dev/database-provisioning-poc/pkg/secrets"
+	"flow.stacc.dev/database-provisioning-poc/pkg/servers"
+)
+
+// +kubebuilder:webhook:path=/mutate-database-stacc-com-v1alpha1-database,mutating=true,failurePolicy=fail,groups=database.stacc.com,resources=databases,verbs=create;update,versions=v1alpha1,name=mdatabase.database.stacc.com
+// +kubebuilder:webhook:path=/validate-database-stacc-com-v1alpha1-database,mutating=false,failurePolicy=fail,groups=database.stacc.com,resources=databases,verbs=create;update,versions=v1alpha1,name=vdatabase.database.stacc.com
+
+// DatabaseValidator rejects databases on servers that do not allow their namespace, with secrets in namespaces not granted to them,
+// with names their engine can not represent, with migrations from a path outside the migrations root, and changes to the name or server of a database
+type DatabaseValidator struct {
+	Client         client.Client
+	MigrationsRoot string
+	decoder        *admission.Decoder
+}
+
+// Handle validates a database
+func (v *DatabaseValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	var database databasev1alpha1.Database
+	if err := v.decoder.Decode(req, &database); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	if req.Operation == admissionv1beta1.Update {
+		var old databasev1alpha1.Database
+		if err := v.decoder.DecodeRaw(req.OldObject, &old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		if msg := databaseChanges(&old, &database); msg != "" {
+			return admission.Denied(msg)
+		}
+		if specUnchanged(&old.Spec, &database.Spec, database.DeletionTimestamp) {
+			return admission.Allowed("")
+		}
+	}
+
+	if source := database.Spec.Source; source != nil && source.Database != nil && !source.Database.InNamespace(database.Namespace) {
+		return admission.Denied(fmt.Sprintf("source database %s/%s is not in namespace %s of the database", source.Database.Namespace, source.Database.Name, database.Namespace))
+	}
+
+	if migrations := database.Spec.Migrations; migrations != nil && migrations.Path != "" {
+		if err := db.ValidateMigrationsPath(v.MigrationsRoot, migrations.Path); err != nil {
+			return admission.Denied(err.Error())
+		}
+	}
+
+	allowed, err := secrets.Allowed(ctx, v.Client, databasev1alpha1.DatabaseKind, database.Namespace, database.Spec.Secret)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if !allowed {
+		return admission.Denied(fmt.Sprintf("secret %s/%s is not in namespace %s of the database, and no DatabaseSecretGrant allows it", database.Spec.Secret.Namespace, database.Spec.Secret.Name, database.Namespace))
+	}
+
+	// With dual user rotation the users are the username with a suffix
+	username := database.Spec.Username
+	if username == "" {
+		username = database.Spec.Name
+	}
+	users := []string{username}
+	if database.Spec.PasswordRotation != nil && database.Spec.PasswordRotation.Mode == databasev1alpha1.RotationModeDual {
+		users = []string{username + "_a", username + "_b"}
+	}
+
+	// Databases placed by a selector are only placed on servers allowing their namespace and of their server type
+	serverType := database.Spec.ServerType
+	if database.Status.Server != nil || database.Spec.Server.Name != "" {
+		server, err := servers.Get(ctx, v.Client, servers.DatabaseRef(&database))
+		switch {
+		case apierrors.IsNotFound(err):
+			// The controller waits for the server, and checks the namespace when it exists
+			return admission.Allowed("")
+		case err != nil:
+			return admission.Errored(http.StatusInternalServerError, err)
+		}
+		allowed, err := servers.AllowsNamespace(ctx, v.Client, server, database.Namespace)
+		if err != nil {
+			return admission.Errored(http.StatusInternalServerError, err)
+		}
+		if !allowed {
+			return admission.Denied(fmt.Sprintf("database server %s does not allow databases from namespace %s", server.Name, database.Namespace))
+		}
+		for _, user := range users {
+			if err := db.ValidateNotAdmin(&server.Spec, user); err != nil {
+				return admission.Denied(err.Error())
+			}
+		}
+		if source := database.Spec.Source; source != nil && source.Template != "" && !containsString(server.Spec.Templates, source.Template) {
+			return admission.Denied(fmt.Sprintf("database %s is not a template of database server %s", source.Template, server.Name))
+		}
+		serverType = server.Spec.Type
+	} else if serverType != "" && !containsString(db.Types(), serverType) {
+		return admission.Denied(fmt.Sprintf("server type %s is not supported, supported types are %v", serverType, db.Types()))
+	}
+
+	if err := db.ValidateDatabaseName(serverType, database.Spec.Name); err != nil {
+		return admission.Denied(err.Error())
+	}
+	if err := db.ValidateUsername(serverType, users[len(users)-1]); err != nil {
+		return admission.Denied(err.Error())
+	}
+	return admission.Allowed("")
+}
+
+// InjectDecoder injects the decoder
+func (v *DatabaseValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	return nil
+}
+
+// databaseChanges returns why an update of a database is not allowed, or an empty string when it is
+func databaseChanges(old, database *databasev1alpha1.Database) string {
+	if old.Spec.Name != database.Spec.Name {
+		return fmt.Sprintf("spec.name can not be changed from %s, the database on the server is not renamed", old.Spec.Name)
+	}
+	if database.Spec.Server.Name == "" {
+		return ""
+	}
+	// The server is fixed once named, or once the database has been placed by its selector
+	var current *databasev1alpha1.Server
+	switch {
+	case old.Status.Server != nil:
+		ref := servers.Ref(*old.Status.Server)
+		current = &ref
+	case old.Spec.Server.Name != "":
+		ref := servers.SpecRef(old)
+		current = &ref
+	}
+	if current != nil && servers.SpecRef(database) != *current {
+		return fmt.Sprintf("spec.server can not be changed, the database is created on %s %s", current.Kind, current.Name)
+	}
+	return ""
+}
+
+func containsString(slice []string, s string) bool {
+	for _, item := range slice {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
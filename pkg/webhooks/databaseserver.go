@@ -0,0 +1,75 @@
+package webhooks
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+	db "flow.stacc.dev/database-provisioning-poc/pkg/db"
+	"flow.stacc.dev/database-provisioning-poc/pkg/servers"
+)
+
+// +kubebuilder:webhook:path=/mutate-database-stacc-com-v1alpha1-databaseserver,mutating=true,failurePolicy=fail,groups=database.stacc.com,resources=databaseservers,verbs=create;update,versions=v1alpha1,name=mdatabaseserver.database.stacc.com
+// +kubebuilder:webhook:path=/validate-database-stacc-com-v1alpha1-databaseserver,mutating=false,failurePolicy=fail,groups=database.stacc.com,resources=databaseservers;clusterdatabaseservers,verbs=create;update,versions=v1alpha1,name=vdatabaseserver.database.stacc.com
+
+// DatabaseServerValidator rejects database servers of both kinds reading their admin secret from another namespace,
+// or with an engine section not matching their type
+type DatabaseServerValidator struct {
+	decoder *admission.Decoder
+}
+
+// Handle validates a database server
+func (v *DatabaseServerValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	var server, old *databasev1alpha1.DatabaseServer
+	if req.Kind.Kind == databasev1alpha1.ClusterDatabaseServerKind {
+		var clusterServer databasev1alpha1.ClusterDatabaseServer
+		if err := v.decoder.Decode(req, &clusterServer); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		if req.Operation == admissionv1beta1.Update {
+			var oldClusterServer databasev1alpha1.ClusterDatabaseServer
+			if err := v.decoder.DecodeRaw(req.OldObject, &oldClusterServer); err != nil {
+				return admission.Errored(http.StatusBadRequest, err)
+			}
+			old = servers.FromCluster(&oldClusterServer)
+		}
+		if clusterServer.Spec.Secret.Namespace == "" {
+			return admission.Denied("spec.secret.namespace is required for a ClusterDatabaseServer")
+		}
+		server = servers.FromCluster(&clusterServer)
+	} else {
+		server = &databasev1alpha1.DatabaseServer{}
+		if err := v.decoder.Decode(req, server); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		if req.Operation == admissionv1beta1.Update {
+			old = &databasev1alpha1.DatabaseServer{}
+			if err := v.decoder.DecodeRaw(req.OldObject, old); err != nil {
+				return admission.Errored(http.StatusBadRequest, err)
+			}
+		}
+	}
+	// Servers created before their secret had to be in their namespace can still have their finalizers removed
+	if old != nil && specUnchanged(&old.Spec, &server.Spec, server.DeletionTimestamp) {
+		return admission.Allowed("")
+	}
+
+	if !servers.SecretAllowed(server) {
+		return admission.Denied(fmt.Sprintf("the secret of a DatabaseServer must be in namespace %s of the server, copy secret %s/%s there or use a ClusterDatabaseServer for a secret in another namespace",
+			server.Namespace, server.Spec.Secret.Namespace, server.Spec.Secret.Name))
+	}
+	if err := db.ValidateServer(&server.Spec); err != nil {
+		return admission.Denied(err.Error())
+	}
+	return admission.Allowed("")
+}
+
+// InjectDecoder injects the decoder
+func (v *DatabaseServerValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	return nil
+}
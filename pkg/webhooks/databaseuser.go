@@ -0,0 +1,83 @@
+package webhooks
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+	db "flow.stacc.dev/database-provisioning-poc/pkg/db"
+	"flow.stacc.dev/database-provisioning-poc/pkg/secrets"
+	"flow.stacc.dev/database-provisioning-poc/pkg/servers"
+)
+
+// +kubebuilder:webhook:path=/mutate-database-stacc-com-v1alpha1-databaseuser,mutating=true,failurePolicy=fail,groups=database.stacc.com,resources=databaseusers,verbs=create;update,versions=v1alpha1,name=mdatabaseuser.database.stacc.com
+// +kubebuilder:webhook:path=/validate-database-stacc-com-v1alpha1-databaseuser,mutating=false,failurePolicy=fail,groups=database.stacc.com,resources=databaseusers,verbs=create;update,versions=v1alpha1,name=vdatabaseuser.database.stacc.com
+
+// DatabaseUserValidator rejects database users of databases in other namespaces, with secrets in namespaces
+// not granted to them, or with names their engine can not represent or of the admin user of the server
+type DatabaseUserValidator struct {
+	Client  client.Client
+	decoder *admission.Decoder
+}
+
+// Handle validates a database user
+func (v *DatabaseUserValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	var user databasev1alpha1.DatabaseUser
+	if err := v.decoder.Decode(req, &user); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if req.Operation == admissionv1beta1.Update {
+		var old databasev1alpha1.DatabaseUser
+		if err := v.decoder.DecodeRaw(req.OldObject, &old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		if specUnchanged(&old.Spec, &user.Spec, user.DeletionTimestamp) {
+			return admission.Allowed("")
+		}
+	}
+	if !user.Spec.Database.InNamespace(user.Namespace) {
+		return admission.Denied(fmt.Sprintf("database %s/%s is not in namespace %s of the user", user.Spec.Database.Namespace, user.Spec.Database.Name, user.Namespace))
+	}
+	allowed, err := secrets.Allowed(ctx, v.Client, databasev1alpha1.DatabaseUserKind, user.Namespace, user.Spec.Secret)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if !allowed {
+		return admission.Denied(fmt.Sprintf("secret %s/%s is not in namespace %s of the user, and no DatabaseSecretGrant allows it", user.Spec.Secret.Namespace, user.Spec.Secret.Name, user.Namespace))
+	}
+
+	// The engine is known once the database and its server exist, until then the controller waits for them
+	var database databasev1alpha1.Database
+	if err := v.Client.Get(ctx, client.ObjectKey{Namespace: user.Namespace, Name: user.Spec.Database.Name}, &database); err != nil {
+		if apierrors.IsNotFound(err) {
+			return admission.Allowed("")
+		}
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	server, err := servers.Get(ctx, v.Client, servers.DatabaseRef(&database))
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return admission.Allowed("")
+		}
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if err := db.ValidateUsername(server.Spec.Type, user.Spec.Username); err != nil {
+		return admission.Denied(err.Error())
+	}
+	if err := db.ValidateNotAdmin(&server.Spec, user.Spec.Username); err != nil {
+		return admission.Denied(err.Error())
+	}
+	return admission.Allowed("")
+}
+
+// InjectDecoder injects the decoder
+func (v *DatabaseUserValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	return nil
+}
@@ -0,0 +1,43 @@
+// Package webhooks contains the admission webhooks defaulting and validating the resources of the controller
+package webhooks
+
+import (
+	"reflect"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	databasev1alpha1 "flow.stacc.dev/database-provisioning-poc/api/v1alpha1"
+)
+
+// Paths the webhooks are served at, matching the generated webhook configuration
+const (
+	mutateDatabasePath         = "/mutate-database-stacc-com-v1alpha1-database"
+	mutateDatabaseServerPath   = "/mutate-database-stacc-com-v1alpha1-databaseserver"
+	mutateDatabaseUserPath     = "/mutate-database-stacc-com-v1alpha1-databaseuser"
+	validateDatabasePath       = "/validate-database-stacc-com-v1alpha1-database"
+	validateDatabaseServerPath = "/validate-database-stacc-com-v1alpha1-databaseserver"
+	validateDatabaseUserPath   = "/validate-database-stacc-com-v1alpha1-databaseuser"
+)
+
+// Register adds the admission webhooks to the webhook server of the manager.
+// Migrations of databases from a path have to be in migrationsRoot, see db.ValidateMigrationsPath.
+func Register(mgr ctrl.Manager, migrationsRoot string) {
+	server := mgr.GetWebhookServer()
+	// Defaults are set by the Default methods of the resources, which the controllers apply as well
+	server.Register(mutateDatabasePath, admission.DefaultingWebhookFor(&databasev1alpha1.Database{}))
+	server.Register(mutateDatabaseServerPath, admission.DefaultingWebhookFor(&databasev1alpha1.DatabaseServer{}))
+	server.Register(mutateDatabaseUserPath, admission.DefaultingWebhookFor(&databasev1alpha1.DatabaseUser{}))
+	server.Register(validateDatabasePath, &webhook.Admission{Handler: &DatabaseValidator{Client: mgr.GetClient(), MigrationsRoot: migrationsRoot}})
+	server.Register(validateDatabaseServerPath, &webhook.Admission{Handler: &DatabaseServerValidator{}})
+	server.Register(validateDatabaseUserPath, &webhook.Admission{Handler: &DatabaseUserValidator{Client: mgr.GetClient()}})
+}
+
+// specUnchanged reports whether an update leaves the spec as it is, e.g. only changing finalizers or annotations,
+// or is to an object being deleted. Such updates are admitted without checking the namespaces and grants again:
+// they may have been revoked since the object was created, and must not keep it from being deleted.
+func specUnchanged(oldSpec, spec interface{}, deletionTimestamp *metav1.Time) bool {
+	return deletionTimestamp != nil || reflect.DeepEqual(oldSpec, spec)
+}